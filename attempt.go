@@ -0,0 +1,67 @@
+package sqlmq
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Outcomes of an Attempt.
+const (
+	AttemptSucceeded = "success"
+	AttemptRetried   = "retry"
+	AttemptDeferred  = "deferred"
+	AttemptGivenUp   = "givenUp"
+)
+
+// Attempt is a try to process a message, recorded into an AttemptTable after the message is marked.
+type Attempt struct {
+	MessageId  int64     // id of the message, the UUID is used instead by a UUID StdTable.
+	TryCount   uint16    // the attempt is the TryCount-th try of the message.
+	Worker     string    // the consumer processed the message, see SqlMQ.Worker.
+	StartedAt  time.Time // when the handling started.
+	FinishedAt time.Time // when the handling finished.
+	Error      string    // the error of the handling, empty if succeeded.
+	Outcome    string    // AttemptSucceeded, AttemptRetried, AttemptDeferred or AttemptGivenUp.
+}
+
+var defaultWorker = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}()
+
+func (mq *SqlMQ) worker() string {
+	if mq.Worker != "" {
+		return mq.Worker
+	}
+	return defaultWorker
+}
+
+// recordAttempt record an attempt of msg by db if the table is an AttemptTable. The outcome is
+// decided by err and retryAfter the same way as markFail. Errors are logged but not returned,
+// a failed recording by a transaction makes it failed to commit.
+func (mq *SqlMQ) recordAttempt(
+	table Table, db DBOrTx, msg Message, startedAt time.Time, retryAfter time.Duration, err error,
+) {
+	t, ok := table.(AttemptTable)
+	if !ok {
+		return
+	}
+	var attempt = Attempt{
+		MessageId: msg.GetId(), TryCount: triedCount(msg) + 1, Worker: mq.worker(),
+		StartedAt: startedAt, FinishedAt: time.Now(), Outcome: AttemptSucceeded,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		if _, deferred := asDefer(err); deferred {
+			attempt.Outcome = AttemptDeferred
+		} else if retryAfter < 0 || mq.retriesExhausted(msg) {
+			attempt.Outcome = AttemptGivenUp
+		} else {
+			attempt.Outcome = AttemptRetried
+		}
+	}
+	if err := t.RecordAttempt(db, msg, attempt); err != nil {
+		mq.log().Error(err)
+	}
+}
@@ -0,0 +1,92 @@
+package sqlmq
+
+import "time"
+
+// BreakerState is the state of a queue's circuit breaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"   // messages are consumed normally.
+	BreakerOpen     BreakerState = "open"     // messages are not fetched until the cooldown ends.
+	BreakerHalfOpen BreakerState = "halfOpen" // the next message decides to close or open again.
+)
+
+type breaker struct {
+	state    BreakerState
+	failures int
+}
+
+// BreakerState return the state of a queue's circuit breaker.
+func (mq *SqlMQ) BreakerState(queue string) BreakerState {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	if b := mq.breakers[queue]; b != nil {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// record the result of a queue's handler into its breaker. A deferral is neither a success nor
+// a failure, it's not recorded.
+func (mq *SqlMQ) recordBreaker(queue string, err error) {
+	if mq.BreakerThreshold <= 0 {
+		return
+	}
+	if _, ok := asDefer(err); ok {
+		return
+	}
+	mq.mutex.Lock()
+	if mq.breakers == nil {
+		mq.breakers = make(map[string]*breaker)
+	}
+	b := mq.breakers[queue]
+	if b == nil {
+		b = &breaker{state: BreakerClosed}
+		mq.breakers[queue] = b
+	}
+	var state = b.state
+	if err == nil {
+		b.state, b.failures = BreakerClosed, 0
+	} else if b.failures++; b.state == BreakerHalfOpen ||
+		b.state == BreakerClosed && b.failures >= mq.BreakerThreshold {
+		b.state = BreakerOpen
+	}
+	var newState = b.state
+	if newState != state && (state == BreakerOpen || newState == BreakerOpen) {
+		mq.applyPausedQueues()
+	}
+	mq.mutex.Unlock()
+
+	if newState == state {
+		return
+	}
+	if newState == BreakerOpen {
+		cooldown := mq.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = time.Minute
+		}
+		time.AfterFunc(cooldown, func() {
+			mq.halfOpenBreaker(queue)
+		})
+	}
+	if mq.OnBreakerChange != nil {
+		mq.OnBreakerChange(queue, newState)
+	}
+}
+
+func (mq *SqlMQ) halfOpenBreaker(queue string) {
+	mq.mutex.Lock()
+	b := mq.breakers[queue]
+	if b == nil || b.state != BreakerOpen {
+		mq.mutex.Unlock()
+		return
+	}
+	b.state = BreakerHalfOpen
+	mq.applyPausedQueues()
+	mq.mutex.Unlock()
+
+	if mq.OnBreakerChange != nil {
+		mq.OnBreakerChange(queue, BreakerHalfOpen)
+	}
+	mq.NotifyConsumeAt(time.Now(), "breaker half open")
+}
@@ -0,0 +1,61 @@
+package sqlmq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type pausableMockTable struct {
+	*MockTable
+	paused []string
+	mutex  sync.Mutex
+}
+
+func (table *pausableMockTable) SetPausedQueues(queues []string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.paused = queues
+}
+
+func (table *pausableMockTable) pausedQueues() []string {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.paused
+}
+
+func ExampleSqlMQ_BreakerState() {
+	var table = &pausableMockTable{MockTable: NewMockTable("mock", 0)}
+	var mq = &SqlMQ{Table: table, BreakerThreshold: 2, BreakerCooldown: 10 * time.Millisecond}
+	var changes = make(chan BreakerState, 10)
+	mq.OnBreakerChange = func(queue string, state BreakerState) {
+		changes <- state
+	}
+	var printChange = func() {
+		state := <-changes
+		fmt.Println(state, table.pausedQueues())
+	}
+	var err = errors.New("error happened")
+	mq.recordBreaker("test", err)
+	fmt.Println(mq.BreakerState("test"), table.pausedQueues())
+	mq.recordBreaker("test", err)
+	printChange()
+
+	printChange()
+	mq.recordBreaker("test", err)
+	printChange()
+
+	printChange()
+	mq.recordBreaker("test", nil)
+	printChange()
+	fmt.Println(mq.BreakerState("test"), mq.BreakerState("other"))
+	// Output:
+	// closed []
+	// open [test]
+	// halfOpen []
+	// open [test]
+	// halfOpen []
+	// closed []
+	// closed closed
+}
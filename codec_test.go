@@ -0,0 +1,49 @@
+package sqlmq
+
+import "fmt"
+
+// a codec that marshals strings as is.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(v.(string)), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+func ExampleNewBinaryStdTable() {
+	testDB.Exec("DROP TABLE IF EXISTS sqlmq_binary")
+	table := NewBinaryStdTable(testDB, "sqlmq_binary", 0, rawCodec{})
+	table.SetQueues([]string{"test"})
+
+	fmt.Println(table.ProduceMessage(testDB, &StdMessage{Queue: "test", Data: "not json"}))
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	var data string
+	fmt.Println(table.Codec().Unmarshal(msg.(*StdMessage).Data.([]byte), &data), data)
+	// Output:
+	// <nil>
+	// <nil> not json
+}
+
+func ExampleJSONCodec() {
+	data, err := JSONCodec.Marshal(map[string]int{"a": 1})
+	fmt.Println(string(data), err)
+
+	var v map[string]int
+	fmt.Println(JSONCodec.Unmarshal(data, &v), v)
+	// Output:
+	// {"a":1} <nil>
+	// <nil> map[a:1]
+}
@@ -0,0 +1,90 @@
+package sqlmq
+
+import "errors"
+
+// Sentinel errors to distinguish failures by errors.Is, in a Logger integration or hooks.
+var (
+	// The message's queue has no registered handler and no default handler is set.
+	ErrNoHandler = errors.New("sqlmq: no handler")
+	// The message is given up after its handler failed.
+	ErrGivenUp = errors.New("sqlmq: message given up")
+	// The transaction of handling exceeded SqlMQ.TxTimeout.
+	ErrTxTimeout = errors.New("sqlmq: transaction timeout")
+	// No connection is available from the pool within SqlMQ.AcquireTimeout.
+	ErrAcquireTimeout = errors.New("sqlmq: acquire connection timeout")
+)
+
+// sentinelError keeps the message of its cause (or msg), and makes errors.Is(err, sentinel) true.
+// fmt.Errorf with "%w" would put the sentinel's text into the message, and it can't wrap both the
+// sentinel and the cause before Go 1.20, so errors.As still finds the cause by Unwrap here.
+type sentinelError struct {
+	sentinel error
+	cause    error
+	msg      string
+}
+
+func (e *sentinelError) Error() string {
+	if e.msg != "" {
+		return e.msg
+	}
+	return e.cause.Error()
+}
+
+func (e *sentinelError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.cause
+}
+
+// FailStage is the stage at which handling a message failed.
+type FailStage string
+
+const (
+	FailHandler FailStage = "handler" // no handler, or the handler returned an error or panicked.
+	FailMark    FailStage = "mark"    // marking the message as success failed.
+	FailCommit  FailStage = "commit"  // committing the transaction failed.
+)
+
+// FailStageOf return the stage of an error of handling a message, like the errors logged by
+// SqlMQ.Logger, or an empty stage if err is not such an error.
+func FailStageOf(err error) FailStage {
+	for err != nil {
+		if e, ok := err.(*stageError); ok {
+			return e.stage
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return ""
+}
+
+// stageError keeps the message of its cause, and records the stage of the failure.
+type stageError struct {
+	stage FailStage
+	error
+}
+
+func (e *stageError) Unwrap() error {
+	return e.error
+}
+
+// Stack return the stack of the first error having one in the chain, so that Logger still logs
+// the stack traced by errs.Trace.
+func (e *stageError) Stack() string {
+	for err := e.error; err != nil; {
+		if s, ok := err.(interface{ Stack() string }); ok {
+			return s.Stack()
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+//go:build go1.13
+// +build go1.13
+
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func ExampleErrNoHandler() {
+	var mq = getSqlMQ()
+	_, err := mq.handlerOf(mq.Table, &StdMessage{Queue: "no-handler"})
+	fmt.Println(err, errors.Is(err, ErrNoHandler))
+	// Output:
+	// unknown queue: no-handler true
+}
+
+func ExampleErrGivenUp() {
+	var mq = recreateSqlMQ()
+	mq.MaxRetries = 1
+	if err := mq.Register("test", failHandler); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test", TriedCount: 1}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	_, err = mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	fmt.Println(err, errors.Is(err, ErrGivenUp), errors.Is(err, ErrNoHandler))
+	// Output:
+	// error happened true false
+}
+
+func ExampleErrTxTimeout() {
+	var mq = recreateSqlMQ()
+	mq.TxTimeout = 10 * time.Millisecond
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		time.Sleep(20 * time.Millisecond)
+		return 0, true, nil
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	_, err = mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	fmt.Println(errors.Is(err, ErrTxTimeout))
+	// Output:
+	// true
+}
+
+func ExampleErrAcquireTimeout() {
+	var mq = getSqlMQ()
+	mq.DB = getDB()
+	mq.DB.SetMaxOpenConns(1)
+	mq.AcquireTimeout = 10 * time.Millisecond
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	_, _, err = mq.beginTx()
+	fmt.Println(errors.Is(err, ErrAcquireTimeout))
+
+	tx.Rollback()
+	lease.end()
+	tx, lease, err = mq.beginTx()
+	fmt.Println(err)
+	tx.Rollback()
+	lease.end()
+	// Output:
+	// true
+	// <nil>
+}
+
+func ExampleFailStageOf() {
+	var mq = recreateSqlMQ()
+	mq.TxTimeout = 10 * time.Millisecond
+	if err := mq.Register("fail", failHandler); err != nil {
+		panic(err)
+	}
+	if err := mq.Register("ok", noopHandler); err != nil {
+		panic(err)
+	}
+	if err := mq.Register("slow", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		time.Sleep(20 * time.Millisecond)
+		return 0, true, nil
+	}); err != nil {
+		panic(err)
+	}
+	for _, msg := range []*StdMessage{{Queue: "fail"}, {Queue: "ok"}, {Queue: "slow"}} {
+		if msg.Queue != "ok" { // not produced, so MarkSuccess fails.
+			if err := mq.Produce(nil, msg); err != nil {
+				panic(err)
+			}
+		}
+		tx, lease, err := mq.beginTx()
+		if err != nil {
+			panic(err)
+		}
+		_, err = mq.handle(context.Background(), lease, mq.Table, tx, msg)
+		fmt.Println(msg.Queue, FailStageOf(err), errors.Is(err, ErrTxTimeout))
+	}
+	fmt.Println(FailStageOf(errors.New("other")) == "")
+	// Output:
+	// fail handler false
+	// ok mark false
+	// slow mark true
+	// true
+}
@@ -6,5 +6,4 @@ require (
 	github.com/lib/pq v1.10.1
 	github.com/lovego/errs v0.0.2
 	github.com/lovego/logger v0.0.1
-	github.com/lovego/sleep v0.0.2
 )
@@ -0,0 +1,64 @@
+package sqlmq
+
+import "time"
+
+// acquireInFlight count the messages being handled into their queues, see MaxInFlightPerQueue.
+func (mq *SqlMQ) acquireInFlight(msgs ...Message) {
+	if len(mq.MaxInFlightPerQueue) == 0 {
+		return
+	}
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	if mq.inFlight == nil {
+		mq.inFlight = make(map[string]int)
+	}
+	var changed bool
+	for _, msg := range msgs {
+		queue := msg.QueueName()
+		full := mq.inFlightFull(queue)
+		mq.inFlight[queue]++
+		changed = changed || !full && mq.inFlightFull(queue)
+	}
+	if changed {
+		mq.applyPausedQueues()
+	}
+}
+
+// releaseInFlight uncount the handled messages from their queues, the consuming loop is waked up
+// if a queue drops below its limit.
+func (mq *SqlMQ) releaseInFlight(msgs ...Message) {
+	if len(mq.MaxInFlightPerQueue) == 0 {
+		return
+	}
+	mq.mutex.Lock()
+	var changed bool
+	for _, msg := range msgs {
+		queue := msg.QueueName()
+		full := mq.inFlightFull(queue)
+		if mq.inFlight[queue]--; mq.inFlight[queue] <= 0 {
+			delete(mq.inFlight, queue)
+		}
+		changed = changed || full && !mq.inFlightFull(queue)
+	}
+	if changed {
+		mq.applyPausedQueues()
+	}
+	mq.mutex.Unlock()
+	if changed {
+		mq.NotifyConsumeAt(time.Now(), "in-flight released")
+	}
+}
+
+// whether a queue has reached its MaxInFlightPerQueue, must be called with mq.mutex locked.
+func (mq *SqlMQ) inFlightFull(queue string) bool {
+	max := mq.MaxInFlightPerQueue[queue]
+	return max > 0 && mq.inFlight[queue] >= max
+}
+
+// InFlight return the number of messages of a queue being handled, it's only counted if
+// MaxInFlightPerQueue is set.
+func (mq *SqlMQ) InFlight(queue string) int {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	return mq.inFlight[queue]
+}
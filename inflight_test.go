@@ -0,0 +1,22 @@
+package sqlmq
+
+import "fmt"
+
+func ExampleSqlMQ_MaxInFlightPerQueue() {
+	var table = &pausableMockTable{MockTable: NewMockTable("mock", 0)}
+	var mq = &SqlMQ{Table: table, MaxInFlightPerQueue: map[string]int{"a": 2}}
+	var a1, a2, b = &StdMessage{Queue: "a"}, &StdMessage{Queue: "a"}, &StdMessage{Queue: "b"}
+	mq.acquireInFlight(a1, b)
+	fmt.Println(table.pausedQueues(), mq.InFlight("a"), mq.InFlight("b"))
+	mq.acquireInFlight(a2)
+	fmt.Println(table.pausedQueues(), mq.InFlight("a"))
+	mq.releaseInFlight(a1)
+	fmt.Println(table.pausedQueues(), mq.InFlight("a"))
+	mq.releaseInFlight(a2, b)
+	fmt.Println(table.pausedQueues(), mq.InFlight("a"), mq.InFlight("b"))
+	// Output:
+	// [] 1 1
+	// [a] 2
+	// [] 1
+	// [] 0 0
+}
@@ -0,0 +1,96 @@
+package sqlmq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Heartbeat extend the deadline of the consuming transaction to TxTimeout from now.
+// It must be called with the ctx (or a derived one) passed to a handler, so that a handler whose
+// processing time varies a lot can keep its message locked as long as it's making progress.
+// It returns false if ctx is not from a handler, or the transaction has already timed out.
+// HandlerTimeout is not extended by Heartbeat.
+func Heartbeat(ctx context.Context) bool {
+	lease, ok := ctx.Value(leaseKey{}).(*txLease)
+	return ok && lease.extend()
+}
+
+type leaseKey struct{}
+
+// txLease is the context of a consuming transaction. It's like a context with timeout,
+// but its deadline can be extended.
+type txLease struct {
+	context.Context // only for Value, it's never done.
+	timeout         time.Duration
+	deadline        time.Time
+	done            chan struct{}
+	err             error
+	timer           *time.Timer
+	release         func() // release resources after the transaction is done, may be nil.
+	mutex           sync.Mutex
+}
+
+func newTxLease(timeout time.Duration) *txLease {
+	lease := &txLease{
+		Context: context.Background(), timeout: timeout, done: make(chan struct{}),
+		deadline: time.Now().Add(timeout),
+	}
+	if time.Until(lease.deadline) <= 0 {
+		lease.finish(context.DeadlineExceeded)
+	} else {
+		lease.timer = time.AfterFunc(timeout, func() {
+			lease.finish(context.DeadlineExceeded)
+		})
+	}
+	return lease
+}
+
+func (lease *txLease) Deadline() (time.Time, bool) {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+	return lease.deadline, true
+}
+
+func (lease *txLease) Done() <-chan struct{} {
+	return lease.done
+}
+
+func (lease *txLease) Err() error {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+	return lease.err
+}
+
+func (lease *txLease) extend() bool {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+	// if the timer is stopped failed, it has fired and the lease is finishing.
+	if lease.err != nil || !lease.timer.Stop() {
+		return false
+	}
+	lease.deadline = time.Now().Add(lease.timeout)
+	lease.timer.Reset(lease.timeout)
+	return true
+}
+
+func (lease *txLease) finish(err error) {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+	if lease.err != nil {
+		return
+	}
+	lease.err = err
+	close(lease.done)
+	if lease.timer != nil {
+		lease.timer.Stop()
+	}
+}
+
+// end must be called after the transaction is committed or rollbacked.
+func (lease *txLease) end() {
+	lease.finish(context.Canceled)
+	if lease.release != nil {
+		lease.release()
+	}
+}
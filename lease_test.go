@@ -0,0 +1,58 @@
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func ExampleHeartbeat() {
+	var mq = recreateSqlMQ()
+	mq.TxTimeout = 50 * time.Millisecond
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		for i := 0; i < 4; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if !Heartbeat(ctx) {
+				return 0, false, fmt.Errorf("heartbeat failed")
+			}
+		}
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.handle(context.Background(), lease, mq.Table, tx, msg))
+	fmt.Println(Heartbeat(context.Background()))
+	// Output:
+	// 0s <nil>
+	// false
+}
+
+func Example_txLease() {
+	lease := newTxLease(20 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	fmt.Println(lease.extend(), lease.Err())
+	time.Sleep(15 * time.Millisecond)
+	fmt.Println(lease.Err())
+	<-lease.Done()
+	fmt.Println(lease.extend(), lease.Err())
+
+	lease = newTxLease(time.Minute)
+	lease.end()
+	fmt.Println(lease.extend(), lease.Err())
+	// Output:
+	// true <nil>
+	// <nil>
+	// false context deadline exceeded
+	// false context canceled
+}
@@ -0,0 +1,58 @@
+package sqlmq
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// listen on mq.ListenChannel, and wake up the consuming loop on notifications.
+// The listener reconnects on connection loss, and wakes up the consuming loop after reconnected,
+// because notifications may be missed during the connection loss.
+func (mq *SqlMQ) listen(ctx context.Context) {
+	listener := pq.NewListener(mq.ListenDSN, time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				mq.log().Error(err)
+			}
+		},
+	)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	if err := listener.Listen(mq.ListenChannel); err != nil {
+		mq.log().Error(err)
+		return
+	}
+
+	for {
+		select {
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				mq.NotifyConsumeAt(time.Now(), "listener reconnected")
+			} else if at, err := time.Parse(time.RFC3339Nano, n.Extra); err == nil {
+				mq.NotifyConsumeAt(at, "notification")
+			} else {
+				mq.NotifyConsumeAt(time.Now(), "notification")
+			}
+		case <-time.After(time.Minute):
+			go listener.Ping()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notify the consuming loops listening on a channel that a message should be consumed at a time.
+// If db is a transaction, the notification is delivered only when it's committed.
+func notifyChannel(db DBOrTx, channel string, consumeAt time.Time) error {
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	_, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, Timestamps.Format(consumeAt))
+	return err
+}
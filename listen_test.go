@@ -0,0 +1,49 @@
+package sqlmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func ExampleSqlMQ_listen() {
+	var mq = recreateSqlMQ()
+	mq.ListenDSN, mq.ListenChannel = testDSN, "sqlmq_test"
+	mq.Table.(*StdTable).SetNotifyChannel("sqlmq_test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mq.listen(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	var at = time.Now().Add(time.Hour)
+	if err := mq.Table.ProduceMessage(mq.DB, &StdMessage{Queue: "test", RetryAt: at}); err != nil {
+		panic(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	fmt.Println(mq.sleep.GetAwakeAt().Format(Rfc3339Micro) == at.Format(Rfc3339Micro))
+	// Output:
+	// true
+}
+
+func ExampleSqlMQ_ConsumeContext_listen() {
+	var mq = &SqlMQ{
+		DB: testDB, Table: NewMockTable("test", 0),
+		ListenDSN: "host=/not_existing", ListenChannel: "sqlmq_test",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var done = make(chan struct{})
+	go func() {
+		mq.ConsumeContext(ctx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+		fmt.Println("returned")
+	case <-time.After(time.Second):
+		fmt.Println("timeout")
+	}
+	// Output:
+	// returned
+}
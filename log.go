@@ -0,0 +1,68 @@
+package sqlmq
+
+import (
+	"context"
+
+	"github.com/lovego/logger"
+)
+
+// Logger is the logger of SqlMQ.Log, to report errors and record the handling of messages.
+// Implement it to use another logger, like zap, zerolog or log/slog. If SqlMQ.Log is nil,
+// SqlMQ.Logger is used by LovegoLogger, which writes to stderr by default.
+type Logger interface {
+	// Error log an error.
+	Error(err error)
+	// Info log an informational message.
+	Info(msg string)
+	// Record run work and log its result, an error if work returns one, otherwise a success entry.
+	// fields is called after work returns to add fields to the entry, it may be nil.
+	// A panic of work should be recovered and logged as an error, and fields must still be called,
+	// because SqlMQ releases resources of the handling in it.
+	Record(work func(ctx context.Context) error, fields func(f LogFields))
+}
+
+// LogFields add fields to a log entry of Logger.Record.
+type LogFields interface {
+	With(key string, value interface{})
+}
+
+// log return the Logger to log by, SqlMQ.Log if it's not nil, otherwise SqlMQ.Logger.
+func (mq *SqlMQ) log() Logger {
+	if mq.Log != nil {
+		return mq.Log
+	}
+	return lovegoLogger{mq.Logger}
+}
+
+// LovegoLogger adapt a github.com/lovego/logger Logger to Logger.
+func LovegoLogger(l *logger.Logger) Logger {
+	return lovegoLogger{l}
+}
+
+type lovegoLogger struct {
+	logger *logger.Logger
+}
+
+func (l lovegoLogger) Error(err error) {
+	l.logger.Error(err)
+}
+
+func (l lovegoLogger) Info(msg string) {
+	l.logger.Info(msg)
+}
+
+func (l lovegoLogger) Record(work func(ctx context.Context) error, fields func(f LogFields)) {
+	l.logger.Record(work, nil, func(f *logger.Fields) {
+		if fields != nil {
+			fields(lovegoFields{f})
+		}
+	})
+}
+
+type lovegoFields struct {
+	fields *logger.Fields
+}
+
+func (f lovegoFields) With(key string, value interface{}) {
+	f.fields.With(key, value)
+}
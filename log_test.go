@@ -0,0 +1,60 @@
+package sqlmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lovego/logger"
+)
+
+func ExampleLovegoLogger() {
+	var buf bytes.Buffer
+	var l = LovegoLogger(logger.New(&buf))
+	l.Record(func(ctx context.Context) error {
+		return errors.New("handle failed")
+	}, func(f LogFields) {
+		f.With("queue", "test")
+	})
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"msg":"handle failed"`)))
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"queue":"test"`)))
+
+	buf.Reset()
+	l.Error(errors.New("fetch failed"))
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"msg":"fetch failed"`)))
+	// Output:
+	// true
+	// true
+	// true
+}
+
+func ExampleSqlMQ_log() {
+	var buf, logBuf bytes.Buffer
+	var mq = &SqlMQ{Logger: logger.New(&buf)}
+	mq.log().Error(errors.New("to Logger"))
+	mq.Log = LovegoLogger(logger.New(&logBuf))
+	mq.log().Error(errors.New("to Log"))
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"msg":"to Logger"`)))
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"msg":"to Log"`)))
+	fmt.Println(bytes.Contains(logBuf.Bytes(), []byte(`"msg":"to Log"`)))
+	// Output:
+	// true
+	// false
+	// true
+}
+
+func Example_txOutcome() {
+	var buf bytes.Buffer
+	var mq = &SqlMQ{Logger: logger.New(&buf)}
+	var outcome txOutcome
+	mq.log().Record(func(ctx context.Context) error {
+		mq.txError(&outcome, errors.New("rollback failed"))
+		return errors.New("handle failed")
+	}, outcome.fields)
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"committed":false`)))
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"txError":"rollback failed"`)))
+	// Output:
+	// true
+	// true
+}
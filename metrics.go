@@ -0,0 +1,57 @@
+package sqlmq
+
+import (
+	"context"
+	"time"
+)
+
+// Metrics collects metrics of message consuming, it can be implemented by prometheus collectors.
+// All methods must be concurrency safe.
+type Metrics interface {
+	// A message has been handled by its handler, err is the error returned by the handler.
+	Handled(queue string, duration time.Duration, err error)
+	// A message has been marked to retry after retryAfter.
+	Retried(queue string, retryAfter time.Duration)
+	// A message has been marked as given up.
+	GivenUp(queue string)
+	// The number of waiting messages of every queue.
+	// It's collected every SqlMQ.MetricsInterval from the tables which are BacklogTables, the
+	// counts of a queue in several tables are summed up.
+	Backlog(backlog map[string]int64)
+}
+
+// BacklogTable is a Table which can count the waiting messages of every queue.
+type BacklogTable interface {
+	Backlog(db DBOrTx) (map[string]int64, error)
+}
+
+func (mq *SqlMQ) collectBacklog(ctx context.Context) {
+	for ctx.Err() == nil {
+		var backlog map[string]int64
+		for _, table := range mq.allTables() {
+			t, ok := table.(BacklogTable)
+			if !ok {
+				continue
+			}
+			b, err := t.Backlog(mq.DB)
+			if err != nil {
+				mq.log().Error(err)
+				continue
+			}
+			if backlog == nil {
+				backlog = make(map[string]int64)
+			}
+			for queue, n := range b {
+				backlog[queue] += n
+			}
+		}
+		if backlog == nil {
+			return // no table is a BacklogTable.
+		}
+		mq.Metrics.Backlog(backlog)
+		select {
+		case <-ctx.Done():
+		case <-time.After(mq.MetricsInterval):
+		}
+	}
+}
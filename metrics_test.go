@@ -0,0 +1,66 @@
+package sqlmq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type testMetrics struct {
+	sync.Mutex
+	events []string
+}
+
+func (m *testMetrics) add(event string) {
+	m.Lock()
+	m.events = append(m.events, event)
+	m.Unlock()
+}
+
+func (m *testMetrics) Handled(queue string, duration time.Duration, err error) {
+	m.add(fmt.Sprint("handled ", queue, " ", err))
+}
+
+func (m *testMetrics) Retried(queue string, retryAfter time.Duration) {
+	m.add(fmt.Sprint("retried ", queue, " ", retryAfter))
+}
+
+func (m *testMetrics) GivenUp(queue string) {
+	m.add("givenUp " + queue)
+}
+
+func (m *testMetrics) Backlog(backlog map[string]int64) {
+	m.add(fmt.Sprint("backlog ", backlog))
+}
+
+func ExampleMetrics() {
+	var mq = recreateSqlMQ()
+	var metrics = &testMetrics{}
+	mq.Metrics = metrics
+	if err := mq.Register("test", failHandler); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	mq.handle(context.Background(), lease, mq.Table, tx, msg)
+
+	mq.MetricsInterval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	mq.collectBacklog(ctx)
+
+	for _, event := range metrics.events {
+		fmt.Println(event)
+	}
+	// Output:
+	// handled test error happened
+	// retried test 0s
+	// backlog map[test:1]
+}
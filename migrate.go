@@ -0,0 +1,88 @@
+package sqlmq
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// MigrateOptions select the optional columns for Migrate to add. StdTable reads and writes all of
+// them, so set All for a StdTable; the others are for tables used by a custom Message.
+type MigrateOptions struct {
+	All          bool // add all the optional columns below.
+	Priority     bool // the priority column and the indexes of fetching, see StdMessage.Priority.
+	TraceContext bool // the trace_context column, see StdMessage.TraceContext.
+	Headers      bool // the headers column, see StdMessage.Headers.
+	DedupKey     bool // the dedup_key column and its unique index, see StdMessage.DedupKey.
+	LockedAt     bool // the locked_at column, see ClaimByUpdate.
+	GroupKey     bool // the group_key column and its index, see StdMessage.GroupKey.
+	ExpiresAt    bool // the expires_at column, see StdMessage.ExpiresAt.
+	Type         bool // the type column, see StdMessage.Type.
+	// If NoIndex is true, indexes are not created, for example for a partitioned table, whose
+	// indexes can't be created CONCURRENTLY, create them by StdTableOptions.ExtraIndexes instead.
+	NoIndex bool
+	// Rename the columns like StdTableOptions.Columns.
+	Columns map[string]string
+}
+
+// Migrate add the optional columns selected by opts to a table created by an earlier version,
+// by "ALTER TABLE ... ADD COLUMN IF NOT EXISTS", and create their indexes if not exist.
+// It's idempotent, so it's safe to run repeatedly. The constructors of StdTable add the columns
+// themselves, so it's for a table opened with StdTableOptions.NoMigrate by a role that can run
+// DDL elsewhere, or for a table used by a custom Message.
+func Migrate(db *sql.DB, name string, opts MigrateOptions) error {
+	if err := checkColumns(opts.Columns); err != nil {
+		return err
+	}
+	var c = newColumnNames(opts.Columns)
+	var columns, indexes []string
+	var prefix = strings.Replace(name, ".", "_", 1)
+	if opts.All || opts.Priority {
+		columns = append(columns, "{priority} smallint NOT NULL DEFAULT 0")
+		// the indexes of fetching, which orders due messages by priority.
+		for _, index := range stdFetchIndexes {
+			indexes = append(indexes, c.sqlf(index, "CONCURRENTLY ", prefix, name))
+		}
+	}
+	if opts.All || opts.TraceContext {
+		columns = append(columns, "{trace_context} jsonb")
+	}
+	if opts.All || opts.Headers {
+		columns = append(columns, "{headers} jsonb")
+	}
+	if opts.All || opts.DedupKey {
+		columns = append(columns, "{dedup_key} text")
+		indexes = append(indexes, c.sqlf(
+			`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS %s_dedup_key ON %s ({dedup_key}) `+
+				dedupKeyCondition,
+			prefix, name,
+		))
+	}
+	if opts.All || opts.LockedAt {
+		columns = append(columns, "{locked_at} timestamptz")
+	}
+	if opts.All || opts.GroupKey {
+		columns = append(columns, "{group_key} text")
+		indexes = append(indexes, c.sqlf(
+			`CREATE INDEX CONCURRENTLY IF NOT EXISTS %s_group_key ON %s ({group_key}, {id}) `+
+				groupKeyCondition,
+			prefix, name,
+		))
+	}
+	if opts.All || opts.ExpiresAt {
+		columns = append(columns, "{expires_at} timestamptz")
+	}
+	if opts.All || opts.Type {
+		columns = append(columns, "{type} text")
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	var sqls = []string{c.sqlf(
+		"ALTER TABLE %s ADD COLUMN IF NOT EXISTS "+strings.Join(columns, ", ADD COLUMN IF NOT EXISTS "),
+		name,
+	)}
+	if !opts.NoIndex {
+		sqls = append(sqls, indexes...)
+	}
+	return execDDL(db, sqls...)
+}
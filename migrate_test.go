@@ -0,0 +1,30 @@
+package sqlmq
+
+import "fmt"
+
+func ExampleMigrate() {
+	if _, err := testDB.Exec(`
+	DROP TABLE IF EXISTS test_migrate;
+	CREATE TABLE test_migrate (
+		id          bigserial    NOT NULL PRIMARY KEY,
+		queue       text         NOT NULL,
+		status      text         NOT NULL,
+		created_at  timestamptz  NOT NULL,
+		tried_count smallint     NOT NULL,
+		retry_at    timestamptz  NOT NULL,
+		data        jsonb        NOT NULL
+	)`); err != nil {
+		panic(err)
+	}
+	fmt.Println(Migrate(testDB, "test_migrate", MigrateOptions{Priority: true}))
+	fmt.Println(Migrate(testDB, "test_migrate", MigrateOptions{All: true}))
+	fmt.Println(Migrate(testDB, "test_migrate", MigrateOptions{All: true}))
+
+	table := NewStdTable(testDB, "test_migrate", 0)
+	fmt.Println(table.ProduceMessageIfNew(testDB, &StdMessage{Queue: "test", DedupKey: "a"}))
+	// Output:
+	// <nil>
+	// <nil>
+	// <nil>
+	// true <nil>
+}
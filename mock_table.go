@@ -0,0 +1,298 @@
+package sqlmq
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var _ Table = (*MockTable)(nil)
+var _ ClaimTable = (*MockTable)(nil)
+var _ MemoryTable = (*MockTable)(nil)
+
+// NewMockTable create an in-memory `sqlmq.Table` instance for tests.
+// name: table name, only returned by Name.
+// keep: keep a successfully consumed message for how long before CleanMessages delete it.
+func NewMockTable(name string, keep time.Duration) *MockTable {
+	if keep < 0 {
+		keep = 24 * time.Hour
+	}
+	return &MockTable{name: name, keep: keep}
+}
+
+// MockTable is an in-memory `sqlmq.Table` implementation for unit tests of handlers and consuming
+// logic without a real database, it uses `*StdMessage` as messages. The db and tx arguments of its
+// methods are ignored, so they can be nil, and changes are applied immediately (not transactional).
+// Like a real table, the Data of a produced message is stored marshaled, so the Data of a fetched
+// message is a []byte.
+// EarliestMessage claims a due message by marking it StatusProcessing, so concurrent consumers
+// never fetch the same message. SqlMQ consumes it without transactions, handlers get a nil tx,
+// and SqlMQ.DB can be nil.
+type MockTable struct {
+	name     string
+	keep     time.Duration
+	queues   []string
+	msgs     []*StdMessage
+	lastId   int64
+	claimed  map[int64]time.Time // claim time of the processing messages.
+	attempts []Attempt
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+func (table *MockTable) Name() string {
+	return table.name
+}
+
+// InMemory return true, so that SqlMQ consumes the table without a DB.
+func (table *MockTable) InMemory() bool {
+	return true
+}
+
+// ClaimsByUpdate return true, since EarliestMessage marks a due message as StatusProcessing.
+func (table *MockTable) ClaimsByUpdate() bool {
+	return true
+}
+
+// ReapStale reset the messages claimed more than olderThan ago but not marked back to be waiting,
+// their tried count is incremented like StdTable.
+func (table *MockTable) ReapStale(db DBOrTx, olderThan time.Duration) (int64, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var now = table.timeNow()
+	var reaped int64
+	for _, msg := range table.msgs {
+		if at, ok := table.claimed[msg.Id]; ok && msg.Status == StatusProcessing &&
+			now.Sub(at) > olderThan {
+			msg.Status, msg.TriedCount, msg.RetryAt = StatusWaiting, msg.TriedCount+1, now
+			delete(table.claimed, msg.Id)
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+func (table *MockTable) SetQueues(queues []string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.queues = queues
+}
+
+// SetNow set the clock of the table, so that tests can advance a fake clock to verify
+// scheduling and retrying without sleeping. If now is nil, time.Now is used.
+func (table *MockTable) SetNow(now func() time.Time) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.now = now
+}
+
+// timeNow must be called with table.mutex locked.
+func (table *MockTable) timeNow() time.Time {
+	if table.now != nil {
+		return table.now()
+	}
+	return time.Now()
+}
+
+// Messages return copies of all the messages in the table, in the order of producing.
+func (table *MockTable) Messages() []StdMessage {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var msgs = make([]StdMessage, len(table.msgs))
+	for i, msg := range table.msgs {
+		msgs[i] = *msg
+	}
+	return msgs
+}
+
+// RecordAttempt keep an attempt in memory, get them by Attempts.
+func (table *MockTable) RecordAttempt(db DBOrTx, msg Message, attempt Attempt) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.attempts = append(table.attempts, attempt)
+	return nil
+}
+
+// Attempts return all the recorded attempts, in the order of recording.
+func (table *MockTable) Attempts() []Attempt {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return append([]Attempt(nil), table.attempts...)
+}
+
+// EarliestMessage return a copy of the earliest waiting message, in the same order as StdTable.
+// If the message is due, it's claimed: both it and the copy are StatusProcessing.
+func (table *MockTable) EarliestMessage(tx DBOrTx) (Message, error) {
+	return table.earliestMessage("")
+}
+
+// EarliestMessageOfQueue is the same as EarliestMessage, except that only messages of the queue
+// are fetched.
+func (table *MockTable) EarliestMessageOfQueue(tx DBOrTx, queue string) (Message, error) {
+	return table.earliestMessage(queue)
+}
+
+// the earliest message of a queue, or of all queues if queue is empty.
+func (table *MockTable) earliestMessage(queue string) (Message, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var now = table.timeNow()
+	var earliest *StdMessage
+	// msgs are in id order, only the first unconsumed message of a group can be fetched.
+	var groups = make(map[string]bool)
+	for _, msg := range table.msgs {
+		if msg.Status != StatusWaiting && msg.Status != StatusProcessing || mockExpired(msg, now) {
+			continue
+		}
+		if msg.GroupKey != "" {
+			if groups[msg.GroupKey] {
+				continue
+			}
+			groups[msg.GroupKey] = true
+		}
+		if queue != "" && msg.Queue != queue {
+			continue
+		}
+		if msg.Status == StatusWaiting && (earliest == nil || mockBefore(msg, earliest, now)) {
+			earliest = msg
+		}
+	}
+	if earliest == nil {
+		return nil, nil
+	}
+	if !earliest.RetryAt.After(now) {
+		earliest.Status = StatusProcessing
+		if table.claimed == nil {
+			table.claimed = make(map[int64]time.Time)
+		}
+		table.claimed[earliest.Id] = now
+	}
+	var msg = *earliest
+	return &msg, nil
+}
+
+func mockExpired(msg *StdMessage, now time.Time) bool {
+	return !msg.ExpiresAt.IsZero() && !msg.ExpiresAt.After(now)
+}
+
+// ExpireMessages set the waiting messages whose ExpiresAt has passed to be StatusExpired.
+func (table *MockTable) ExpireMessages(db DBOrTx) (int64, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var now = table.timeNow()
+	var expired int64
+	for _, msg := range table.msgs {
+		if msg.Status == StatusWaiting && mockExpired(msg, now) {
+			msg.Status, msg.RetryAt = StatusExpired, now
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// due messages first, and then by priority, retry_at and id.
+func mockBefore(a, b *StdMessage, now time.Time) bool {
+	aDue, bDue := !a.RetryAt.After(now), !b.RetryAt.After(now)
+	if aDue != bDue {
+		return aDue
+	}
+	if aDue && a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.RetryAt.Equal(b.RetryAt) {
+		return a.RetryAt.Before(b.RetryAt)
+	}
+	return a.Id < b.Id
+}
+
+func (table *MockTable) MarkSuccess(tx DBOrTx, msg Message) error {
+	return table.update(msg.GetId(), func(m *StdMessage, now time.Time) {
+		m.Status, m.TriedCount, m.RetryAt = StatusDone, m.TriedCount+1, now
+	})
+}
+
+func (table *MockTable) MarkRetry(db DBOrTx, msg Message, retryAfter time.Duration) error {
+	var retryAt time.Time
+	if err := table.update(msg.GetId(), func(m *StdMessage, now time.Time) {
+		retryAt = now.Add(retryAfter)
+		m.Status, m.TriedCount, m.RetryAt = StatusWaiting, m.TriedCount+1, retryAt
+	}); err != nil {
+		return err
+	}
+	setRetryAt(msg, retryAt)
+	return nil
+}
+
+// MarkDeferred reschedule a message like MarkRetry, but its tried count is not incremented.
+func (table *MockTable) MarkDeferred(db DBOrTx, msg Message, retryAfter time.Duration) error {
+	var retryAt time.Time
+	if err := table.update(msg.GetId(), func(m *StdMessage, now time.Time) {
+		retryAt = now.Add(retryAfter)
+		m.Status, m.RetryAt = StatusWaiting, retryAt
+	}); err != nil {
+		return err
+	}
+	setRetryAt(msg, retryAt)
+	return nil
+}
+
+func (table *MockTable) MarkGivenUp(db DBOrTx, msg Message) error {
+	return table.update(msg.GetId(), func(m *StdMessage, now time.Time) {
+		m.Status, m.TriedCount, m.RetryAt = StatusGivenUp, m.TriedCount+1, now
+	})
+}
+
+func (table *MockTable) update(id int64, fn func(*StdMessage, time.Time)) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for _, msg := range table.msgs {
+		if msg.Id == id {
+			fn(msg, table.timeNow())
+			if msg.Status != StatusProcessing {
+				delete(table.claimed, id)
+			}
+			return nil
+		}
+	}
+	return errors.New("affected 0 rows")
+}
+
+// if ProduceMessage runs succussfully, message id is set in message.
+func (table *MockTable) ProduceMessage(db DBOrTx, message Message) error {
+	msg, ok := message.(*StdMessage)
+	if !ok {
+		return fmt.Errorf("MockTable can't produce message of type %T", message)
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = table.timeNow()
+	}
+	data, err := msg.prepare(JSONCodec)
+	if err != nil {
+		return err
+	}
+	table.lastId++
+	msg.SetId(table.lastId)
+	var stored = *msg
+	stored.Data = data
+	table.msgs = append(table.msgs, &stored)
+	return nil
+}
+
+func (table *MockTable) CleanMessages(db *sql.DB) (int64, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var before = table.timeNow().Add(-table.keep)
+	var kept []*StdMessage
+	for _, msg := range table.msgs {
+		if msg.Status != StatusDone || !msg.RetryAt.Before(before) {
+			kept = append(kept, msg)
+		}
+	}
+	var cleaned = int64(len(table.msgs) - len(kept))
+	table.msgs = kept
+	return cleaned, nil
+}
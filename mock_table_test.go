@@ -0,0 +1,321 @@
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+func ExampleMockTable() {
+	table := NewMockTable("mock", 0)
+	var now = time.Now()
+	for _, msg := range []*StdMessage{
+		{Queue: "a", Data: "later", RetryAt: now.Add(time.Hour)},
+		{Queue: "a", Data: "first"},
+		{Queue: "b", Data: "second"},
+	} {
+		if err := table.ProduceMessage(nil, msg); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := table.EarliestMessage(nil)
+		if err != nil {
+			panic(err)
+		}
+		m := msg.(*StdMessage)
+		fmt.Println(m.Id, m.Queue, string(m.Data.([]byte)), m.ConsumeAt().After(now.Add(time.Minute)))
+		if i == 0 {
+			fmt.Println(table.MarkSuccess(nil, msg))
+		} else {
+			fmt.Println(table.MarkGivenUp(nil, msg))
+		}
+	}
+	fmt.Println(table.EarliestMessage(nil))
+	fmt.Println(table.MarkRetry(nil, &StdMessage{Id: 9}, 0))
+	fmt.Println(table.CleanMessages(nil))
+	for _, msg := range table.Messages() {
+		fmt.Println(msg.Id, msg.Status, msg.TriedCount)
+	}
+	// Output:
+	// 2 a "first" false
+	// <nil>
+	// 3 b "second" false
+	// <nil>
+	// 1 a "later" true
+	// <nil>
+	// <nil> <nil>
+	// affected 0 rows
+	// 1 <nil>
+	// 1 givenUp 1
+	// 3 givenUp 1
+}
+
+func ExampleMockTable_consume() {
+	// no DB is needed to consume a MockTable, and the handler is called with a nil tx.
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0), IdleWait: 24 * time.Hour}
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		fmt.Println(tx == nil, msg.(*StdMessage).Status)
+		return time.Hour, false, errors.New("error happened")
+	}); err != nil {
+		panic(err)
+	}
+	if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	// the message is retried an hour later.
+	processed, wait, err := mq.ConsumeOnce(context.Background())
+	fmt.Println(processed, wait > 59*time.Minute, err)
+	var msg = mq.Table.(*MockTable).Messages()[0]
+	fmt.Println(msg.Status, msg.TriedCount)
+	// Output:
+	// true processing
+	// true 0s <nil>
+	// false true <nil>
+	// waiting 1
+}
+
+func ExampleMockTable_drain() {
+	// a BatchSize of 0 or less consumes one message at a time.
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0), IdleWait: 24 * time.Hour, BatchSize: -1}
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.Drain(context.Background(), 2))
+	mq.BatchSize = 0
+	fmt.Println(mq.Drain(context.Background(), 2))
+	// Output:
+	// 2 <nil>
+	// 1 <nil>
+}
+
+func ExampleMockTable_concurrentConsumers() {
+	var table = NewMockTable("mock", 0)
+	for i := 0; i < 100; i++ {
+		if err := table.ProduceMessage(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	var handled = make(map[int64]int)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	// two consumers share the table, each message is claimed by only one of them.
+	for i := 0; i < 2; i++ {
+		var mq = &SqlMQ{Table: table, IdleWait: time.Minute}
+		if err := mq.Register("test", func(
+			ctx context.Context, tx *sql.Tx, msg Message,
+		) (time.Duration, bool, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			handled[msg.GetId()]++
+			return 0, false, nil
+		}); err != nil {
+			panic(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				processed, _, err := mq.ConsumeOnce(context.Background())
+				if err != nil {
+					panic(err)
+				}
+				if !processed {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var twice int
+	for _, n := range handled {
+		if n > 1 {
+			twice++
+		}
+	}
+	fmt.Println(len(handled), twice)
+	// Output:
+	// 100 0
+}
+
+func ExampleMockTable_groupKey() {
+	table := NewMockTable("mock", 0)
+	for _, msg := range []*StdMessage{
+		{Queue: "test", GroupKey: "a"},
+		{Queue: "test", GroupKey: "a"},
+		{Queue: "test", GroupKey: "b"},
+	} {
+		if err := table.ProduceMessage(nil, msg); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := table.EarliestMessage(nil)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(msg.GetId())
+		if err := table.MarkRetry(nil, msg, time.Hour); err != nil {
+			panic(err)
+		}
+	}
+	// Output:
+	// 1
+	// 3
+	// 1
+}
+
+func ExampleMockTable_SetNow() {
+	var now = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	table := NewMockTable("mock", time.Hour)
+	table.SetNow(func() time.Time { return now })
+	if err := table.ProduceMessage(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	msg, err := table.EarliestMessage(nil)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.ConsumeAt())
+	fmt.Println(table.MarkRetry(nil, msg, time.Minute))
+	msg, _ = table.EarliestMessage(nil)
+	fmt.Println(msg.ConsumeAt())
+	fmt.Println(table.MarkSuccess(nil, msg))
+
+	fmt.Println(table.CleanMessages(nil))
+	now = now.Add(2 * time.Hour)
+	fmt.Println(table.CleanMessages(nil))
+	// Output:
+	// 2021-05-01 00:00:00 +0000 UTC
+	// <nil>
+	// 2021-05-01 00:01:00 +0000 UTC
+	// <nil>
+	// 0 <nil>
+	// 1 <nil>
+}
+
+func ExampleSqlMQ_Now() {
+	var now = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	var mq = &SqlMQ{
+		Table: NewMockTable("mock", 0), IdleWait: 24 * time.Hour,
+		Now: func() time.Time { return now },
+	}
+	mq.Table.(*MockTable).SetNow(mq.Now)
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	if err := mq.ProduceDelayed(nil, &StdMessage{Queue: "test"}, time.Hour); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	now = now.Add(time.Hour)
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	fmt.Println(mq.Table.(*MockTable).Messages()[0].Status)
+	// Output:
+	// false 1h0m0s <nil>
+	// true 0s <nil>
+	// done
+}
+
+func ExampleMockTable_MarkRetry() {
+	var now = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	table := NewMockTable("mock", time.Hour)
+	table.SetNow(func() time.Time { return now })
+	var msg = &StdMessage{Queue: "test"}
+	if err := table.ProduceMessage(nil, msg); err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.ConsumeAt())
+	fmt.Println(table.MarkRetry(nil, msg, time.Minute))
+	fmt.Println(msg.ConsumeAt())
+	fmt.Println(table.MarkDeferred(nil, msg, time.Hour))
+	fmt.Println(msg.ConsumeAt(), msg.TriedCount)
+	// Output:
+	// 2021-05-01 00:00:00 +0000 UTC
+	// <nil>
+	// 2021-05-01 00:01:00 +0000 UTC
+	// <nil>
+	// 2021-05-01 01:00:00 +0000 UTC 0
+}
+
+func ExampleMockTable_RecordAttempt() {
+	var now = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	var table = NewMockTable("mock", 0)
+	table.SetNow(func() time.Time { return now })
+	var mq = &SqlMQ{Table: table, MaxRetries: 1, Worker: "worker-1"}
+	if err := mq.Register("test", func(ctx context.Context, tx *sql.Tx, msg Message) (
+		time.Duration, bool, error,
+	) {
+		if string(msg.(*StdMessage).Data.([]byte)) == `"fail"` {
+			return time.Second, false, errors.New("failed")
+		}
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	for _, data := range []string{"fail", "ok"} {
+		if err := table.ProduceMessage(nil, &StdMessage{Queue: "test", Data: data}); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := table.EarliestMessage(nil)
+		if err != nil {
+			panic(err)
+		}
+		mq.handleWithoutTx(context.Background(), table, msg)
+		now = now.Add(time.Minute)
+	}
+	for _, attempt := range table.Attempts() {
+		fmt.Println(attempt.MessageId, attempt.TryCount, attempt.Worker, attempt.Outcome,
+			attempt.Error, !attempt.FinishedAt.Before(attempt.StartedAt))
+	}
+	// Output:
+	// 1 1 worker-1 retry failed true
+	// 2 1 worker-1 success  true
+	// 1 2 worker-1 givenUp failed true
+}
+
+func ExampleMockTable_ExpireMessages() {
+	var now = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	table := NewMockTable("mock", 0)
+	table.SetNow(func() time.Time { return now })
+	for _, msg := range []*StdMessage{
+		{Queue: "otp", Data: "expiring", ExpiresAt: now.Add(30 * time.Second)},
+		{Queue: "otp", Data: "lasting"},
+	} {
+		if err := table.ProduceMessage(nil, msg); err != nil {
+			panic(err)
+		}
+	}
+	// the fetched messages are claimed, release them to be waiting again.
+	msg, _ := table.EarliestMessage(nil)
+	fmt.Println(string(msg.(*StdMessage).Data.([]byte)), table.MarkDeferred(nil, msg, 0))
+
+	now = now.Add(time.Minute)
+	msg, _ = table.EarliestMessage(nil)
+	fmt.Println(string(msg.(*StdMessage).Data.([]byte)), table.MarkDeferred(nil, msg, 0))
+	fmt.Println(table.ExpireMessages(nil))
+	fmt.Println(table.ExpireMessages(nil))
+	for _, msg := range table.Messages() {
+		fmt.Println(msg.Id, msg.Status)
+	}
+	// Output:
+	// "expiring" <nil>
+	// "lasting" <nil>
+	// 1 <nil>
+	// 0 <nil>
+	// 1 expired
+	// 2 waiting
+}
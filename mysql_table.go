@@ -0,0 +1,206 @@
+package sqlmq
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lovego/errs"
+)
+
+var _ Table = (*MySQLTable)(nil)
+
+// NewMySQLTable create a `sqlmq.Table` instance for MySQL 8.0+.
+// The DSN of db must have "parseTime=true", so that DATETIME columns can be scanned into time.Time.
+// The times of messages are the Go time of producers and consumers, not the time of MySQL. DATETIME
+// has no time zone, the driver writes and reads them in the "loc" of the DSN (UTC by default), so
+// all the producers and consumers of a table must use the same loc, UTC is preferred. With UTC,
+// compare the columns with UTC_TIMESTAMP(6) instead of NOW() in custom queries, since NOW() is in
+// the time zone of the session.
+// db: db use to create table and index.
+// name: database table name.
+// keep: keep a successfully consumed message for how long before delete it.
+func NewMySQLTable(db *sql.DB, name string, keep time.Duration) *MySQLTable {
+	table := &MySQLTable{name: name, keep: keep}
+	createTable(db, table.tableSql())
+	if err := table.addFetchIndex(db); err != nil {
+		panic(time.Now().Format(time.RFC3339Nano) + " " + err.Error())
+	}
+	if keep < 0 {
+		table.keep = 24 * time.Hour
+	}
+	return table
+}
+
+// MySQLTable is a `sqlmq.Table` implementation for MySQL 8.0+, it uses `*StdMessage` as messages.
+// It only supports the basic columns of StdTable, optional features like Priority are ignored.
+type MySQLTable struct {
+	name   string
+	keep   time.Duration
+	queues []string
+	mutex  sync.RWMutex
+}
+
+// MySQL has no "CREATE INDEX IF NOT EXISTS", so the index is created within the table.
+// EarliestMessage fetches messages of all queues, so the index to serve it is led by status and
+// ordered by retry_at and id.
+func (table *MySQLTable) tableSql() string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id            bigint        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	queue         varchar(255)  NOT NULL,
+	status        varchar(32)   NOT NULL,
+	created_at    datetime(6)   NOT NULL,
+	tried_count   smallint      NOT NULL,
+	retry_at      datetime(6)   NOT NULL,
+	data          json          NOT NULL,
+	INDEX %s (status, retry_at, id)
+)
+`, table.name, table.fetchIndex())
+}
+
+// the name of the index to fetch messages.
+func (table *MySQLTable) fetchIndex() string {
+	return strings.Replace(table.name, ".", "_", 1) + "_status_retry_at_id"
+}
+
+// addFetchIndex add the index to fetch messages to a table created by an earlier version, whose
+// (queue, status, retry_at) index can't serve EarliestMessage.
+func (table *MySQLTable) addFetchIndex(db *sql.DB) error {
+	var schema, name interface{} = nil, table.name
+	if i := strings.IndexByte(table.name, '.'); i >= 0 {
+		schema, name = table.name[:i], table.name[i+1:]
+	}
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	var exists bool
+	if err := db.QueryRowContext(ctx, `
+	SELECT EXISTS (
+		SELECT 1 FROM information_schema.statistics
+		WHERE table_schema = COALESCE(?, DATABASE()) AND table_name = ? AND index_name = ?
+	)`, schema, name, table.fetchIndex()).Scan(&exists); err != nil {
+		return errs.Trace(err)
+	}
+	if exists {
+		return nil
+	}
+	return execDDL(db, fmt.Sprintf(
+		"ALTER TABLE %s ADD INDEX %s (status, retry_at, id)", table.name, table.fetchIndex(),
+	))
+}
+
+func (table *MySQLTable) Name() string {
+	return table.name
+}
+
+func (table *MySQLTable) SetQueues(queues []string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.queues = queues
+}
+
+func (table *MySQLTable) EarliestMessage(tx DBOrTx) (Message, error) {
+	row := StdMessage{}
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	if err := tx.QueryRowContext(ctx, table.earliestMessageSql()).Scan(
+		&row.Id, &row.Queue, &row.Data, &row.Status, &row.CreatedAt, &row.TriedCount, &row.RetryAt,
+	); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errs.Trace(err)
+	}
+	return &row, nil
+}
+
+func (table *MySQLTable) earliestMessageSql() string {
+	return fmt.Sprintf(`
+	SELECT id, queue, data, status, created_at, tried_count, retry_at
+	FROM %s
+	WHERE status = '%s'
+	ORDER BY retry_at, id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+	`, table.name, StatusWaiting)
+}
+
+func (table *MySQLTable) MarkSuccess(tx DBOrTx, message Message) error {
+	sql := fmt.Sprintf(`
+	UPDATE %s
+	SET status = ?, tried_count = tried_count+1, retry_at = ?
+	WHERE id = ?
+	`, table.name)
+	return execAffectedOne(tx, sql, StatusDone, Timestamps.Normalize(time.Now()), message.GetId())
+}
+
+func (table *MySQLTable) MarkRetry(db DBOrTx, message Message, retryAfter time.Duration) error {
+	sql := fmt.Sprintf(`
+	UPDATE %s
+	SET tried_count = tried_count + 1,  retry_at = ?
+	WHERE id = ?
+	`, table.name)
+	var retryAt = Timestamps.Normalize(time.Now().Add(retryAfter))
+	if err := execAffectedOne(db, sql, retryAt, message.GetId()); err != nil {
+		return err
+	}
+	setRetryAt(message, retryAt)
+	return nil
+}
+
+func (table *MySQLTable) MarkGivenUp(db DBOrTx, message Message) error {
+	sql := fmt.Sprintf(`
+	UPDATE %s
+	SET status = ?, tried_count = tried_count + 1, retry_at = ?
+	WHERE id = ?
+	`, table.name)
+	return execAffectedOne(db, sql, StatusGivenUp, Timestamps.Normalize(time.Now()), message.GetId())
+}
+
+// if ProduceMessage runs succussfully, message id is set in message.
+func (table *MySQLTable) ProduceMessage(db DBOrTx, message Message) error {
+	msg, ok := message.(*StdMessage)
+	if !ok {
+		return fmt.Errorf("MySQLTable can't produce message of type %T", message)
+	}
+	jsonData, err := msg.prepare(JSONCodec)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf(`
+	INSERT INTO %s
+		(queue, data, status, created_at, tried_count, retry_at)
+	VALUES
+	    (?,     ?,    ?,      ?,          ?,           ?)
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, sql,
+		msg.Queue, string(jsonData), msg.Status, msg.CreatedAt, msg.TriedCount, msg.RetryAt,
+	)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errs.Trace(err)
+	}
+	msg.SetId(id)
+	return nil
+}
+
+func (table *MySQLTable) CleanMessages(db *sql.DB) (int64, error) {
+	sql := fmt.Sprintf(`
+	DELETE FROM %s
+	WHERE status = ? AND retry_at < ?
+	`, table.name)
+	var before = Timestamps.Normalize(time.Now().Add(-table.keep))
+	if result, err := db.Exec(sql, StatusDone, before); err != nil {
+		return 0, errs.Trace(err)
+	} else if n, err := result.RowsAffected(); err != nil {
+		return 0, errs.Trace(err)
+	} else {
+		return n, nil
+	}
+}
@@ -0,0 +1,34 @@
+package sqlmq
+
+import "fmt"
+
+func ExampleMySQLTable_ProduceMessage() {
+	var table = &MySQLTable{name: "sqlmq"}
+	fmt.Println(table.ProduceMessage(testDB, nil))
+	// Output:
+	// MySQLTable can't produce message of type <nil>
+}
+
+func ExampleMySQLTable_tableSql() {
+	var table = &MySQLTable{name: "db.sqlmq"}
+	fmt.Print(table.tableSql())
+	fmt.Print(table.earliestMessageSql())
+	// Output:
+	// CREATE TABLE IF NOT EXISTS db.sqlmq (
+	// 	id            bigint        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	// 	queue         varchar(255)  NOT NULL,
+	// 	status        varchar(32)   NOT NULL,
+	// 	created_at    datetime(6)   NOT NULL,
+	// 	tried_count   smallint      NOT NULL,
+	// 	retry_at      datetime(6)   NOT NULL,
+	// 	data          json          NOT NULL,
+	// 	INDEX db_sqlmq_status_retry_at_id (status, retry_at, id)
+	// )
+	//
+	// 	SELECT id, queue, data, status, created_at, tried_count, retry_at
+	// 	FROM db.sqlmq
+	// 	WHERE status = 'waiting'
+	// 	ORDER BY retry_at, id
+	// 	LIMIT 1
+	// 	FOR UPDATE SKIP LOCKED
+}
@@ -0,0 +1,67 @@
+package sqlmq
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows one message per interval, it's shared by all the handling goroutines.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	mutex    sync.Mutex
+}
+
+// reserve return zero if a message can be handled now, otherwise how long to wait.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if l.next.After(now) {
+		return l.next.Sub(now)
+	}
+	l.next = now.Add(l.interval)
+	return 0
+}
+
+// full return whether no message can be handled now.
+func (l *rateLimiter) full() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.next.After(time.Now())
+}
+
+// return how long to wait before a message of the queue can be handled. If the message can be
+// handled now, the queue is excluded from fetching until the limiter frees up, so that messages
+// of the queue don't hold up the consuming loop and the other queues.
+func (mq *SqlMQ) rateLimitWait(queue string) time.Duration {
+	limit := mq.RateLimits[queue]
+	if limit <= 0 {
+		return 0
+	}
+	mq.mutex.Lock()
+	if mq.rateLimiters == nil {
+		mq.rateLimiters = make(map[string]*rateLimiter)
+	}
+	limiter := mq.rateLimiters[queue]
+	if limiter == nil {
+		limiter = &rateLimiter{interval: time.Duration(float64(time.Second) / limit)}
+		mq.rateLimiters[queue] = limiter
+	}
+	wait := limiter.reserve()
+	if wait == 0 {
+		mq.applyPausedQueues()
+	}
+	mq.mutex.Unlock()
+	if wait == 0 {
+		time.AfterFunc(limiter.interval, mq.rateLimitFreed)
+	}
+	return wait
+}
+
+func (mq *SqlMQ) rateLimitFreed() {
+	mq.mutex.Lock()
+	mq.applyPausedQueues()
+	mq.mutex.Unlock()
+	mq.NotifyConsumeAt(time.Now(), "rate limit freed")
+}
@@ -0,0 +1,64 @@
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func ExampleSqlMQ_rateLimitWait() {
+	var mq = SqlMQ{RateLimits: map[string]float64{"limited": 10}}
+	fmt.Println(mq.rateLimitWait("test"), mq.rateLimitWait("test"))
+	fmt.Println(mq.rateLimitWait("limited"))
+	wait := mq.rateLimitWait("limited")
+	fmt.Println(wait > 90*time.Millisecond && wait <= 100*time.Millisecond)
+	time.Sleep(wait)
+	fmt.Println(mq.rateLimitWait("limited"))
+	// Output:
+	// 0s 0s
+	// 0s
+	// true
+	// 0s
+}
+
+func ExampleSqlMQ_rateLimitWait_otherQueues() {
+	var mq = recreateSqlMQ()
+	mq.RateLimits = map[string]float64{"slow": 1}
+	var handled []string
+	var handler = func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+		handled = append(handled, msg.QueueName())
+		return 0, false, nil
+	}
+	for _, queue := range []string{"slow", "fast"} {
+		if err := mq.Register(queue, handler); err != nil {
+			panic(err)
+		}
+	}
+	var now = time.Now()
+	for i, queue := range []string{"slow", "slow", "fast", "fast"} {
+		if err := mq.Produce(nil, &StdMessage{
+			Queue: queue, RetryAt: now.Add(time.Duration(i-10) * time.Second),
+		}); err != nil {
+			panic(err)
+		}
+	}
+	// the second slow message is due, but the limited queue doesn't hold up the fast one.
+	for i := 0; i < 3; i++ {
+		if _, _, err := mq.ConsumeOnce(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(handled)
+	processed, wait, err := mq.ConsumeOnce(context.Background())
+	fmt.Println(processed, wait > time.Second, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	fmt.Println(handled)
+	// Output:
+	// [slow fast fast]
+	// false true <nil>
+	// true 0s <nil>
+	// [slow fast fast slow]
+}
@@ -1,6 +1,9 @@
 package sqlmq
 
-import "time"
+import (
+	"math"
+	"time"
+)
 
 var stdRetryWaits = RetryWait{
 	Waits: []time.Duration{
@@ -26,3 +29,43 @@ func (retry RetryWait) Get(retriedCount uint16) time.Duration {
 	}
 	return retry.Waits[retried]
 }
+
+// ExponentialBackoff compute the retry wait by min(Base * Factor^triedCount, Max), its Get method
+// can be used as SqlMQ.BackoffFunc. For example, with Base one second, Factor 2 and Max one hour,
+// the waits are 1s, 2s, 4s, ... until one hour.
+type ExponentialBackoff struct {
+	Base time.Duration
+	// If Factor <= 1, the default value 2 is used.
+	Factor float64
+	// The ceiling of the waits, the wait never exceeds Max even with Jitter.
+	// If Max <= 0, the waits are only bounded by the max time.Duration.
+	Max time.Duration
+	// If Jitter > 0, a random duration in [-Jitter, Jitter] is added to the wait.
+	Jitter time.Duration
+}
+
+// Get return the wait before the next try of a message which has been tried triedCount times.
+func (backoff ExponentialBackoff) Get(triedCount uint16) time.Duration {
+	var factor = backoff.Factor
+	if factor <= 1 {
+		factor = 2
+	}
+	var max = backoff.Max
+	if max <= 0 {
+		max = math.MaxInt64
+	}
+	var d = max
+	// a big triedCount overflows the float64 to +Inf, which is also capped by max.
+	if f := float64(backoff.Base) * math.Pow(factor, float64(triedCount)); f < float64(max) {
+		d = time.Duration(f)
+	}
+	if d > 0 && backoff.Jitter > 0 {
+		if d = jitter(d, backoff.Jitter); d > max || d < 0 {
+			d = max
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
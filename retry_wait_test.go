@@ -1,6 +1,10 @@
 package sqlmq
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"time"
+)
 
 func ExampleGetRetryWait() {
 	fmt.Println(GetRetryWait(0))
@@ -16,3 +20,32 @@ func ExampleGetRetryWait() {
 	// 24h0m0s
 	// 24h0m0s
 }
+
+func ExampleExponentialBackoff() {
+	var backoff = ExponentialBackoff{Base: time.Second, Max: time.Hour}
+	for _, triedCount := range []uint16{0, 1, 2, 10, 12, 100, 2000, math.MaxUint16} {
+		fmt.Println(backoff.Get(triedCount))
+	}
+	backoff = ExponentialBackoff{Base: time.Second, Factor: 3}
+	fmt.Println(backoff.Get(2), backoff.Get(math.MaxUint16))
+
+	backoff = ExponentialBackoff{Base: time.Minute, Max: time.Hour, Jitter: 10 * time.Second}
+	for i := 0; i < 100; i++ {
+		if d := backoff.Get(1); d < 110*time.Second || d > 130*time.Second {
+			fmt.Println("out of jitter range:", d)
+		}
+		if d := backoff.Get(10); d < time.Hour-10*time.Second || d > time.Hour {
+			fmt.Println("out of jitter range:", d)
+		}
+	}
+	// Output:
+	// 1s
+	// 2s
+	// 4s
+	// 17m4s
+	// 1h0m0s
+	// 1h0m0s
+	// 1h0m0s
+	// 1h0m0s
+	// 9s 2562047h47m16.854775807s
+}
@@ -0,0 +1,86 @@
+package sqlmq
+
+import (
+	"sync"
+	"time"
+)
+
+// sleeper is the sleep of the consuming loop, which can be waken up earlier by other goroutines.
+// The awake time is checked and set atomically, and the signal channel is buffered, so a wakeup
+// arriving while the loop is consuming, or between computing how long to sleep and starting to
+// wait, is never lost: Run returns right away after it. And a burst of wakeups is coalesced into
+// a single re-check, since only an earlier awake time signals and the buffer holds only one.
+type sleeper struct {
+	awakeAt time.Time
+	event   interface{}
+	signal  chan struct{}
+	mutex   sync.Mutex
+}
+
+// Run sleep until the awake time, and return the event that set it. Run must not be called
+// concurrently. It returns right away if the awake time is zero or has passed.
+func (s *sleeper) Run() interface{} {
+	for {
+		s.mutex.Lock()
+		var d, event, signal = time.Until(s.awakeAt), s.event, s.signalChan()
+		s.mutex.Unlock()
+		if d <= 0 {
+			return event
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-signal:
+			timer.Stop()
+		}
+	}
+}
+
+// GetAwakeAt return the awake time, zero if it's cleared.
+func (s *sleeper) GetAwakeAt() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.awakeAt
+}
+
+// ClearAwakeAt set the awake time to zero, so the next AwakeAtEarlier always sets it.
+func (s *sleeper) ClearAwakeAt() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.awakeAt = time.Time{}
+}
+
+// AwakeAtEarlier set the awake time to at if it's zero or later than at, and wake up Run to
+// re-check it.
+func (s *sleeper) AwakeAtEarlier(at time.Time, event interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.awakeAt.IsZero() || at.Before(s.awakeAt) {
+		s.awakeAt, s.event = at, event
+		s.notify()
+	}
+}
+
+// Awake set the awake time to now, and wake up Run.
+func (s *sleeper) Awake(event interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.awakeAt, s.event = time.Now(), event
+	s.notify()
+}
+
+// notify must be called with s.mutex locked.
+func (s *sleeper) notify() {
+	select {
+	case s.signalChan() <- struct{}{}:
+	default: // a signal is pending already.
+	}
+}
+
+// signalChan must be called with s.mutex locked.
+func (s *sleeper) signalChan() chan struct{} {
+	if s.signal == nil {
+		s.signal = make(chan struct{}, 1)
+	}
+	return s.signal
+}
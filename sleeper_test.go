@@ -0,0 +1,35 @@
+package sqlmq
+
+import (
+	"fmt"
+	"time"
+)
+
+func Example_sleeper() {
+	var s sleeper
+	// a wakeup arriving before Run, like a trigger while consuming, is not lost.
+	s.AwakeAtEarlier(time.Now(), "triggered")
+	s.AwakeAtEarlier(time.Now().Add(time.Hour), "idle")
+	fmt.Println(s.Run())
+
+	// a burst of wakeups while sleeping wakes up Run once.
+	s.ClearAwakeAt()
+	s.AwakeAtEarlier(time.Now().Add(time.Hour), "idle")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		for i := 0; i < 100; i++ {
+			s.AwakeAtEarlier(time.Now(), "burst")
+		}
+	}()
+	fmt.Println(s.Run())
+
+	// a pending signal doesn't wake up Run before the awake time.
+	s.ClearAwakeAt()
+	s.AwakeAtEarlier(time.Now().Add(50*time.Millisecond), "timer")
+	var start = time.Now()
+	fmt.Println(s.Run(), time.Since(start) >= 50*time.Millisecond)
+	// Output:
+	// triggered
+	// burst
+	// timer true
+}
@@ -0,0 +1,59 @@
+//go:build go1.21
+// +build go1.21
+
+package sqlmq
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// NewSlogLogger adapt a log/slog Logger to Logger, to be set to SqlMQ.Log (not SqlMQ.Logger,
+// which is a *logger.Logger), like: mq.Log = NewSlogLogger(slog.Default()).
+// Errors are logged at the error level.
+// Record logs the error of work at the error level, or "done" at the info level if work succeeds,
+// with the fields like "message", "retryAfter" and "cleaned" as attributes, and a "duration".
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l slogLogger) Error(err error) {
+	l.logger.Error(err.Error())
+}
+
+func (l slogLogger) Info(msg string) {
+	l.logger.Info(msg)
+}
+
+func (l slogLogger) Record(work func(ctx context.Context) error, fields func(f LogFields)) {
+	var ctx = context.Background()
+	var start = time.Now()
+	var err error
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+		var attrs = slogFields{slog.Duration("duration", time.Since(start))}
+		if fields != nil {
+			fields(&attrs)
+		}
+		if err != nil {
+			l.logger.LogAttrs(ctx, slog.LevelError, err.Error(), attrs...)
+		} else {
+			l.logger.LogAttrs(ctx, slog.LevelInfo, "done", attrs...)
+		}
+	}()
+	err = work(ctx)
+}
+
+type slogFields []slog.Attr
+
+func (f *slogFields) With(key string, value interface{}) {
+	*f = append(*f, slog.Any(key, value))
+}
@@ -0,0 +1,47 @@
+//go:build go1.21
+// +build go1.21
+
+package sqlmq
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+func ExampleNewSlogLogger() {
+	var mq = &SqlMQ{}
+	mq.Log = NewSlogLogger(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == "duration" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+	var l = mq.Log
+	l.Record(func(ctx context.Context) error {
+		return errors.New("handle failed")
+	}, func(f LogFields) {
+		f.With("queue", "test")
+		f.With("retryAfter", time.Minute.String())
+	})
+	l.Record(func(ctx context.Context) error {
+		panic("oops")
+	}, nil)
+	l.Record(func(ctx context.Context) error {
+		return nil
+	}, func(f LogFields) {
+		f.With("cleaned", map[string]int64{"done": 3})
+	})
+	l.Error(errors.New("fetch failed"))
+	l.Info("skip cleaning")
+	// Output:
+	// level=ERROR msg="handle failed" queue=test retryAfter=1m0s
+	// level=ERROR msg="panic: oops"
+	// level=INFO msg=done cleaned=map[done:3]
+	// level=ERROR msg="fetch failed"
+	// level=INFO msg="skip cleaning"
+}
@@ -0,0 +1,191 @@
+package sqlmq
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lovego/errs"
+)
+
+var _ Table = (*SQLiteTable)(nil)
+
+// Times are stored as TEXT in UTC with a fixed width, so that they can be compared as strings.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// NewSQLiteTable create a `sqlmq.Table` instance for SQLite 3.35+, mainly for local development
+// and tests. SQLite has no "FOR UPDATE SKIP LOCKED", a consuming transaction claims the message by
+// an "UPDATE ... RETURNING", which holds the database write lock until commit or rollback.
+// So messages are consumed one by one, other writers are blocked (or get SQLITE_BUSY) meanwhile.
+// For an in-memory database, use a shared cache or call db.SetMaxOpenConns(1).
+// db: db use to create table and index.
+// name: database table name.
+// keep: keep a successfully consumed message for how long before delete it.
+func NewSQLiteTable(db *sql.DB, name string, keep time.Duration) *SQLiteTable {
+	table := &SQLiteTable{name: name, keep: keep}
+	createTable(db, table.tableSql())
+	createIndex(db, table.tableIndexSql())
+	if keep < 0 {
+		table.keep = 24 * time.Hour
+	}
+	return table
+}
+
+// SQLiteTable is a `sqlmq.Table` implementation for SQLite 3.35+, it uses `*StdMessage` as messages.
+// It only supports the basic columns of StdTable, optional features like Priority are ignored.
+type SQLiteTable struct {
+	name   string
+	keep   time.Duration
+	queues []string
+	mutex  sync.RWMutex
+}
+
+func (table *SQLiteTable) tableSql() string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id            integer  NOT NULL PRIMARY KEY AUTOINCREMENT,
+	queue         text     NOT NULL,
+	status        text     NOT NULL,
+	created_at    text     NOT NULL,
+	tried_count   integer  NOT NULL,
+	retry_at      text     NOT NULL,
+	data          text     NOT NULL
+)
+`, table.name)
+}
+
+func (table *SQLiteTable) tableIndexSql() string {
+	return fmt.Sprintf(
+		`CREATE INDEX IF NOT EXISTS %s_queue_status_retry_at ON %s (queue, status, retry_at)`,
+		strings.Replace(table.name, ".", "_", 1), table.name,
+	)
+}
+
+func (table *SQLiteTable) Name() string {
+	return table.name
+}
+
+func (table *SQLiteTable) SetQueues(queues []string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.queues = queues
+}
+
+func (table *SQLiteTable) EarliestMessage(tx DBOrTx) (Message, error) {
+	querySql := fmt.Sprintf(`
+	UPDATE %s SET status = status
+	WHERE id = (
+		SELECT id FROM %s
+		WHERE status = '%s'
+		ORDER BY retry_at, id
+		LIMIT 1
+	)
+	RETURNING id, queue, data, status, created_at, tried_count, retry_at
+	`, table.name, table.name, StatusWaiting)
+
+	row := StdMessage{}
+	var data, createdAt, retryAt string
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	if err := tx.QueryRowContext(ctx, querySql).Scan(
+		&row.Id, &row.Queue, &data, &row.Status, &createdAt, &row.TriedCount, &retryAt,
+	); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errs.Trace(err)
+	}
+	row.Data = []byte(data)
+	var err error
+	if row.CreatedAt, err = time.Parse(sqliteTimeFormat, createdAt); err != nil {
+		return nil, errs.Trace(err)
+	}
+	if row.RetryAt, err = time.Parse(sqliteTimeFormat, retryAt); err != nil {
+		return nil, errs.Trace(err)
+	}
+	return &row, nil
+}
+
+func (table *SQLiteTable) MarkSuccess(tx DBOrTx, message Message) error {
+	sql := fmt.Sprintf(`
+	UPDATE %s
+	SET status = ?, tried_count = tried_count+1, retry_at = ?
+	WHERE id = ?
+	`, table.name)
+	return execAffectedOne(tx, sql, StatusDone, sqliteTime(time.Now()), message.GetId())
+}
+
+func (table *SQLiteTable) MarkRetry(db DBOrTx, message Message, retryAfter time.Duration) error {
+	sql := fmt.Sprintf(`
+	UPDATE %s
+	SET tried_count = tried_count + 1,  retry_at = ?
+	WHERE id = ?
+	`, table.name)
+	var retryAt = time.Now().Add(retryAfter)
+	if err := execAffectedOne(db, sql, sqliteTime(retryAt), message.GetId()); err != nil {
+		return err
+	}
+	setRetryAt(message, retryAt)
+	return nil
+}
+
+func (table *SQLiteTable) MarkGivenUp(db DBOrTx, message Message) error {
+	sql := fmt.Sprintf(`
+	UPDATE %s
+	SET status = ?, tried_count = tried_count + 1, retry_at = ?
+	WHERE id = ?
+	`, table.name)
+	return execAffectedOne(db, sql, StatusGivenUp, sqliteTime(time.Now()), message.GetId())
+}
+
+// if ProduceMessage runs succussfully, message id is set in message.
+func (table *SQLiteTable) ProduceMessage(db DBOrTx, message Message) error {
+	msg, ok := message.(*StdMessage)
+	if !ok {
+		return fmt.Errorf("SQLiteTable can't produce message of type %T", message)
+	}
+	jsonData, err := msg.prepare(JSONCodec)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf(`
+	INSERT INTO %s
+		(queue, data, status, created_at, tried_count, retry_at)
+	VALUES
+	    (?,     ?,    ?,      ?,          ?,           ?)
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, sql,
+		msg.Queue, string(jsonData), msg.Status,
+		sqliteTime(msg.CreatedAt), msg.TriedCount, sqliteTime(msg.RetryAt),
+	)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errs.Trace(err)
+	}
+	msg.SetId(id)
+	return nil
+}
+
+func (table *SQLiteTable) CleanMessages(db *sql.DB) (int64, error) {
+	sql := fmt.Sprintf(`
+	DELETE FROM %s
+	WHERE status = ? AND retry_at < ?
+	`, table.name)
+	if result, err := db.Exec(sql, StatusDone, sqliteTime(time.Now().Add(-table.keep))); err != nil {
+		return 0, errs.Trace(err)
+	} else if n, err := result.RowsAffected(); err != nil {
+		return 0, errs.Trace(err)
+	} else {
+		return n, nil
+	}
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
@@ -0,0 +1,243 @@
+package sqlmq
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+func ExampleSQLiteTable_ProduceMessage() {
+	var table = &SQLiteTable{name: "sqlmq"}
+	fmt.Println(table.ProduceMessage(testDB, nil))
+	// Output:
+	// SQLiteTable can't produce message of type <nil>
+}
+
+func Example_sqliteTime() {
+	var t = time.Date(2021, 5, 1, 8, 0, 0, 100000000, time.FixedZone("CST", 8*3600))
+	fmt.Println(sqliteTime(t))
+	fmt.Println(sqliteTime(t.Add(20*time.Millisecond)) > sqliteTime(t))
+	// Output:
+	// 2021-05-01T00:00:00.100000Z
+	// true
+}
+
+func ExampleSQLiteTable_EarliestMessage() {
+	var table = &SQLiteTable{name: "sqlmq"}
+	db := sqliteFake.open(
+		[][]driver.Value{{
+			int64(1), "test", "{}", StatusWaiting, "2021-05-01T00:00:00.100000Z", int64(2),
+			"2021-05-01T00:00:01.000000Z",
+		}},
+		nil,
+		[][]driver.Value{{int64(3), "test", "{}", StatusWaiting, "2021-05-01", int64(0), ""}},
+	)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	row := msg.(*StdMessage)
+	fmt.Println(row.Id, row.Queue, string(row.Data.([]byte)), row.Status, row.TriedCount)
+	fmt.Println(row.CreatedAt.Format(time.RFC3339Nano), row.RetryAt.Format(time.RFC3339Nano))
+	fmt.Println(table.MarkSuccess(tx, msg), tx.Commit())
+
+	msg, err = table.EarliestMessage(db)
+	fmt.Println(msg, err)
+	msg, err = table.EarliestMessage(db)
+	fmt.Println(msg, err)
+	fmt.Print(sqliteFake.statements())
+	// Output:
+	// 1 test {} waiting 2
+	// 2021-05-01T00:00:00.1Z 2021-05-01T00:00:01Z
+	// <nil> <nil>
+	// <nil> <nil>
+	// <nil> parsing time "2021-05-01" as "2006-01-02T15:04:05.000000Z07:00": cannot parse "" as "T"
+	// BEGIN
+	// UPDATE sqlmq SET status = status WHERE id = ( SELECT id FROM sqlmq WHERE status = 'waiting' ORDER BY retry_at, id LIMIT 1 ) RETURNING id, queue, data, status, created_at, tried_count, retry_at
+	// UPDATE sqlmq SET status = ?, tried_count = tried_count+1, retry_at = ? WHERE id = ? [done <time> 1]
+	// COMMIT
+	// UPDATE sqlmq SET status = status WHERE id = ( SELECT id FROM sqlmq WHERE status = 'waiting' ORDER BY retry_at, id LIMIT 1 ) RETURNING id, queue, data, status, created_at, tried_count, retry_at
+	// UPDATE sqlmq SET status = status WHERE id = ( SELECT id FROM sqlmq WHERE status = 'waiting' ORDER BY retry_at, id LIMIT 1 ) RETURNING id, queue, data, status, created_at, tried_count, retry_at
+}
+
+func ExampleSQLiteTable_MarkRetry() {
+	var table = &SQLiteTable{name: "sqlmq"}
+	db := sqliteFake.open()
+	defer db.Close()
+	var msg = &StdMessage{Id: 1, Queue: "test", Data: []byte("{}")}
+	var before = time.Now()
+	fmt.Println(table.MarkRetry(db, msg, time.Minute), msg.RetryAt.Sub(before) >= time.Minute)
+	fmt.Println(table.MarkGivenUp(db, msg))
+	msg = &StdMessage{
+		Queue: "test", Data: map[string]int{"a": 1},
+		CreatedAt: time.Date(2021, 5, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600)),
+	}
+	fmt.Println(table.ProduceMessage(db, msg), msg.Id)
+	fmt.Print(sqliteFake.statements())
+	// Output:
+	// <nil> true
+	// <nil>
+	// <nil> 7
+	// UPDATE sqlmq SET tried_count = tried_count + 1, retry_at = ? WHERE id = ? [<time> 1]
+	// UPDATE sqlmq SET status = ?, tried_count = tried_count + 1, retry_at = ? WHERE id = ? [givenUp <time> 1]
+	// INSERT INTO sqlmq (queue, data, status, created_at, tried_count, retry_at) VALUES (?, ?, ?, ?, ?, ?) [test {"a":1} waiting 2021-05-01T00:00:00.000000Z 0 2021-05-01T00:00:00.000000Z]
+}
+
+// sqliteFake is a database/sql driver to test the statements of SQLiteTable without SQLite.
+// It records the statements run, and returns the rows given to open for the queries in order.
+var sqliteFake = &fakeDriver{}
+
+func init() {
+	sql.Register("sqlmq_fake", sqliteFake)
+}
+
+type fakeDriver struct {
+	mutex   sync.Mutex
+	log     []string
+	results [][][]driver.Value
+}
+
+// open reset the driver, and return a db whose queries return results one by one.
+func (d *fakeDriver) open(results ...[][]driver.Value) *sql.DB {
+	d.mutex.Lock()
+	d.log, d.results = nil, results
+	d.mutex.Unlock()
+	db, err := sql.Open("sqlmq_fake", "")
+	if err != nil {
+		panic(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+// statements return the statements recorded, one per line.
+func (d *fakeDriver) statements() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return strings.Join(d.log, "\n") + "\n"
+}
+
+// record a statement, and return the rows for it if it's a query.
+func (d *fakeDriver) record(query string, args []driver.Value, isQuery bool) [][]driver.Value {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var line = strings.Join(strings.Fields(query), " ")
+	if len(args) > 0 {
+		var values []string
+		for _, arg := range args {
+			// times around now are hidden, since they vary from run to run.
+			if s, ok := arg.(string); ok {
+				if t, err := time.Parse(sqliteTimeFormat, s); err == nil &&
+					time.Since(t) < time.Hour && time.Until(t) < time.Hour {
+					arg = "<time>"
+				}
+			}
+			values = append(values, fmt.Sprint(arg))
+		}
+		line += " [" + strings.Join(values, " ") + "]"
+	}
+	d.log = append(d.log, line)
+	if !isQuery || len(d.results) == 0 {
+		return nil
+	}
+	rows := d.results[0]
+	d.results = d.results[1:]
+	return rows
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.d, query}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.d.record("BEGIN", nil, false)
+	return fakeTx{c.d}, nil
+}
+
+type fakeTx struct{ d *fakeDriver }
+
+func (tx fakeTx) Commit() error {
+	tx.d.record("COMMIT", nil, false)
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.d.record("ROLLBACK", nil, false)
+	return nil
+}
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record(s.query, args, false)
+	return fakeResult{}, nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{rows: s.d.record(s.query, args, true)}, nil
+}
+
+// fakeResult is the result of every statement executed: one row affected, and the last insert id 7.
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) {
+	return 7, nil
+}
+
+func (fakeResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -3,47 +3,255 @@ package sqlmq
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/lovego/errs"
 	"github.com/lovego/logger"
-	"github.com/lovego/sleep"
 )
 
 type SqlMQ struct {
 	DB     *sql.DB
 	Table  Table
 	Logger *logger.Logger
+	// If Log is not nil, it's used instead of Logger, to log by another logger, like zap, zerolog
+	// or log/slog (see NewSlogLogger).
+	Log Logger
 
 	// The max number of messages to be consumed concurrently.
+	// Messages are fetched one by one by a consuming loop, but each message is handled in its own
+	// goroutine within its own transaction, so up to ConsumeConcurrency handlers run in parallel.
+	// Because of "FOR UPDATE SKIP LOCKED", the same message is never handled concurrently.
 	// If ConsumeConcurrency <= 0, the default value 10 is used.
 	ConsumeConcurrency int
 	consumeConcurrency chan struct{}
+	// The number of workers run by ConsumeContext. Every worker runs its own consuming loop to
+	// fetch and handle messages, and waits IdleWait or ErrorWait independently, so fetching is not
+	// serialized by one loop. Workers never fetch the same message, because of
+	// "FOR UPDATE SKIP LOCKED" or claiming by update. ConsumeConcurrency still limits the messages
+	// being handled by all the workers. If Concurrency <= 1, only one consuming loop is run.
+	Concurrency  int
+	workers      []*sleeper // the sleepers of the workers besides the first one.
+	workersMutex sync.Mutex
+	// MaxInFlightPerQueue limit how many messages of a queue are handled concurrently, so that a
+	// busy queue can't occupy all the ConsumeConcurrency handlers and starve the others. A queue
+	// reaching its limit is excluded from fetching like a paused queue, until one of its messages
+	// is done. The limit is per SqlMQ, not across processes, and a batch may exceed it.
+	// It only works if the Table is a PausableTable. Queues without a positive limit are unlimited.
+	MaxInFlightPerQueue map[string]int
+	inFlight            map[string]int
+	// QueueWeights share the consume cycles among queues by weighted round-robin, regardless of
+	// their backlogs. For example, with {"a": 7, "b": 3}, queue a gets about 70% of the messages
+	// handled and queue b gets 30%, if both have due messages. Queues without a positive weight
+	// have weight 1. Instead of fetching the earliest message of all queues, the registered queues
+	// not paused are fetched one by one in the round-robin order, until a due message is handled.
+	// Messages of unregistered queues are not fetched, even if a default handler is set, and
+	// BatchSize is ignored. It only works if the Table is a QueueTable.
+	QueueWeights  map[string]int
+	weightCredits map[string]int
+	// If BatchSize > 1 and the Table is a BatchTable, up to BatchSize due messages are fetched and
+	// handled one by one in one transaction, to amortize the cost of transactions for fast handlers.
+	// A failed message only rollbacks its own changes by a savepoint, see handleBatch.
+	// Batch consuming isn't used with RateLimits or AtMostOnce, or if the Table claims messages by
+	// update.
+	BatchSize int
 	// If no message is available for consuming, wait how long before try to fetch message again.
 	// If IdleWait <= 0, the default value one minute is used.
 	IdleWait time.Duration
 	// If encounter an error when fetching message, wait how long before try to fetch message again.
 	// If ErrorWait <= 0, the default value one minute is used.
 	ErrorWait time.Duration
+	// IdleWaits and ErrorWaits override IdleWait and ErrorWait for queues, for example a sub-second
+	// IdleWait for a hot queue and five minutes for a low-traffic one. Messages of all queues are
+	// fetched by the same loop, so it waits the shortest of the registered queues not paused;
+	// queues without an override (and the default handler if it's set) use IdleWait or ErrorWait.
+	IdleWaits  map[string]time.Duration
+	ErrorWaits map[string]time.Duration
 	// Transaction timeout for message fecthing and handling.
 	// If TxTimeout <= 0, the default value one minute is used.
+	// A handler can extend the timeout by calling Heartbeat with its ctx.
 	TxTimeout time.Duration
+	// Timeout to acquire a connection from the pool of DB for a transaction, it should be shorter
+	// than TxTimeout. If all the connections are busy, the consuming loop gets an ErrAcquireTimeout
+	// and waits ErrorWait, instead of blocking until TxTimeout.
+	// If AcquireTimeout <= 0, the connection is acquired within TxTimeout.
+	AcquireTimeout time.Duration
+	// Options of the transaction for message fecthing and handling, for example to use the
+	// "serializable" isolation level with the business changes of handlers. It must not be read only.
+	// If TxOptions is nil, the default options of DB are used.
+	// Inspection methods like StdTable.Stats accept a DBOrTx, a read only tx can be passed to them.
+	TxOptions *sql.TxOptions
+
+	// Whether a message may be handled more than once or may be lost, the default is AtLeastOnce.
+	DeliverySemantics DeliverySemantics
+
+	// Compute how long to wait before retry a message when its handler returns a zero retryAfter.
+	// triedCount is how many times the message has been tried before this time.
+	// If BackoffFunc is nil, a zero retryAfter means try again immediately.
+	// The Get method of a RetryWait or an ExponentialBackoff can be used as a BackoffFunc.
+	BackoffFunc func(triedCount uint16) time.Duration
+	// If RetryJitter > 0, a random duration in [-RetryJitter, RetryJitter] is added to the retry
+	// time period of a failed message, so that messages failed at the same time don't retry all at
+	// once. It doesn't apply to a RetryAt error or a retry immediately.
+	RetryJitter time.Duration
+	// Now is the clock to compute whether a message is due, its lag and latency, and retry times.
+	// If Now is nil, time.Now is used. A fake clock is mainly for tests, use it with a table whose
+	// clock is the same, like MockTable.SetNow.
+	Now func() time.Time
+	// The max number of times a failed message can be retried.
+	// A message which has been retried MaxRetries times is given up if it fails again.
+	// If MaxRetries is 0, a message can be retried unlimitedly.
+	MaxRetries uint16
+	// If DeadLetterQueue is not empty, when a StdMessage is given up, a message with a DeadLetter as
+	// data is produced into this queue, so a handler of this queue can inspect or alert on failures.
+	DeadLetterQueue string
+	// The name of this consumer recorded in every Attempt, if the table is an AttemptTable.
+	// If Worker is empty, it's "<hostname>:<pid>".
+	Worker string
+
+	// If ListenDSN and ListenChannel are set, the consuming loop LISTEN on ListenChannel by a
+	// dedicated connection to ListenDSN, so it's waken up by messages produced by other processes
+	// without waiting for IdleWait. Use StdTable.SetNotifyChannel to NOTIFY on producing.
+	ListenDSN     string
+	ListenChannel string
+
+	// If Tracer is not nil, a span is started for handling every message.
+	Tracer Tracer
+
+	// If Metrics is not nil, metrics of consuming are collected into it.
+	Metrics Metrics
+	// The time interval to collect the backlog of queues into Metrics.
+	// If MetricsInterval <= 0, the backlog is not collected.
+	MetricsInterval time.Duration
+
+	// Timeout for a handler to handle a message, the context passed to the handler is cancelled
+	// after it. If a handler doesn't return an error but exceeded its timeout, the transaction is
+	// rollbacked and the message is retried. HandlerTimeouts override HandlerTimeout for queues.
+	// If the timeout <= 0, only TxTimeout applies.
+	HandlerTimeout  time.Duration
+	HandlerTimeouts map[string]time.Duration
+	// When the transaction of a message is rollbacked for exceeding TxTimeout, OnTxTimeout is
+	// called, or an error like "handler exceeded TxTimeout of 1m0s" is logged if it's nil, so that
+	// a slow handler doesn't look like random database errors. The message is retried.
+	OnTxTimeout func(msg Message, timeout time.Duration)
+
+	// If MaxLag > 0, when a message is fetched later than MaxLag after its consume time, OnLag is
+	// called, or an error is logged if OnLag is nil. It helps to alert on backlog buildup.
+	MaxLag time.Duration
+	OnLag  func(msg Message, lag time.Duration)
+
+	// Optional callbacks on message lifecycle events, for metrics, audit log or alerting.
+	// OnSuccess is called after the transaction marked the message as success is committed.
+	// OnRetry and OnGivenUp are called after the message is marked as retry or given up.
+	// In OnRetry, msg.ConsumeAt() of a StdMessage is the next attempt time written to the table.
+	// They are called for messages of all queues, nil callbacks are skipped.
+	OnSuccess func(msg Message)
+	OnRetry   func(msg Message, retryAfter time.Duration)
+	OnGivenUp func(msg Message)
+	// OnConsumed is called along with OnSuccess, latency is the time from the message is produced
+	// to it's consumed (for SLA dashboards), handlerLatency is the time its handler took.
+	OnConsumed func(msg Message, latency, handlerLatency time.Duration)
+	// If PoisonThreshold > 0, OnPoison is called once for a message when its tried count reaches
+	// PoisonThreshold and it's going to be retried, for example 8 with MaxRetries 10, so operators
+	// are alerted on systematic failures before the message is given up.
+	PoisonThreshold uint16
+	OnPoison        func(msg Message, triedCount uint16)
+
+	// The max number of messages of a queue to be handled per second, for example to not exceed the
+	// rate limit of a third-party API. The limit is shared by all the handling goroutines.
+	// When a queue reaches the limit, it's excluded from fetching until the limit frees up, like a
+	// paused queue, so the other queues keep flowing. If the Table is not a PausableTable, the
+	// consuming loop waits until the fetched message can be handled instead.
+	RateLimits   map[string]float64
+	rateLimiters map[string]*rateLimiter
+
+	// If BreakerThreshold > 0, a circuit breaker is used for every queue. After BreakerThreshold
+	// consecutive failures of a queue's handler, the breaker opens: messages of the queue are not
+	// fetched for BreakerCooldown (one minute if <= 0), to stop hammering a downstream which is down.
+	// Then the breaker is half-open: messages are fetched again, if the next one fails, the breaker
+	// opens again, otherwise it's closed. It only works if the Table is a PausableTable.
+	// OnBreakerChange is called when the state of a queue's breaker changes.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	OnBreakerChange  func(queue string, state BreakerState)
+	breakers         map[string]*breaker
 
 	// The time interval to clean successfully consumed messages.
+	// Cleaning starts at a fixed rate, if the previous cleaning is still running, it's skipped.
 	CleanInterval time.Duration
+	// If CleanSchedule is not nil, it's used instead of CleanInterval to compute the next time to
+	// clean after now, for example DailyAt(3, 0) to clean at 3am every day.
+	CleanSchedule func(now time.Time) time.Time
+
+	// If CheckHandlers is true, Consume panics if there are waiting messages of queues without a
+	// registered handler and no default handler is set, instead of retrying them every minute.
+	// The Table must be a BacklogTable, see MissingHandlers.
+	CheckHandlers bool
 
+	// If the Table claims messages by update (see ClaimTable), a message claimed but not marked is
+	// stuck by a crashed consumer or a killed transaction. Every ReapInterval, messages claimed
+	// ReapStaleAfter ago are reset to be waiting. If ReapInterval <= 0, they are not reset.
+	// If ReapStaleAfter <= 0, the default value is twice of TxTimeout.
+	ReapInterval   time.Duration
+	ReapStaleAfter time.Duration
+	// If NoHandlerTx is true and the Table claims messages by update, no transaction is held while
+	// handling: a message is claimed by a short UPDATE ... RETURNING on DB, its handler is called
+	// with a nil tx, and then it's marked by another short statement. Every statement runs in its
+	// own implicit transaction, so it's compatible with PgBouncer in transaction pooling mode.
+	// Since a message is marked after handling without a transaction, it's handled again if the
+	// consumer crashes before marking or the handling takes longer than ReapStaleAfter,
+	// so handlers must be idempotent. Heartbeat and canCommit have no effect.
+	// Tables not claiming by update are still consumed within transactions.
+	NoHandlerTx bool
+
+	tables []Table // tables added by AddTable.
 	queues map[string]Handler
-	mutex  sync.RWMutex
+	// the tables of the queues registered by RegisterOn, other queues are of SqlMQ.Table.
+	queueTables map[string]Table
+	types       map[string]map[string]Handler // handlers by queue and message type, see RegisterType.
+	paused      map[string]bool
+	mutex       sync.RWMutex
+	// serialize setting queues to tables, so that no table is left with the queues set earlier.
+	setQueuesMutex sync.Mutex
 
 	defaultHandler Handler
+	middlewares    []func(Handler) Handler
+	afterCommit    map[*sql.Tx]time.Time // the earliest consume time of messages produced in tx.
+
+	lastWait       time.Duration
+	lastWaitReason WaitReason
 
-	sleep sleep.Sleep // sleep instance for consuming loop.
-	debug bool
+	sleep    sleeper        // sleep instance for consuming loop.
+	handling sync.WaitGroup // messages being handled.
+	debug    bool
 }
 
+var _ DBOrTx = (*sql.DB)(nil)
+var _ DBOrTx = (*sql.Tx)(nil)
+
+// DeliverySemantics is the trade-off between handling a message more than once and losing it.
+type DeliverySemantics int
+
+const (
+	// AtLeastOnce handle a message in the transaction locking it, and mark it as success in the same
+	// transaction. If the process crashes or the transaction fails after the handler's side effects
+	// are done, the message is handled again, so handlers should be idempotent.
+	AtLeastOnce DeliverySemantics = iota
+	// AtMostOnce mark a message as success and commit before handling it, so it's never handled
+	// twice. The handler is called with a nil tx, and its failure is only logged, not retried.
+	// If the process crashes or the handler fails, the message is lost. It suits fire-and-forget
+	// notifications, where a duplicate is worse than a loss. Messages without a handler are
+	// still retried as in AtLeastOnce.
+	AtMostOnce
+)
+
+// DBOrTx is satisfied by both *sql.DB and *sql.Tx.
 type DBOrTx interface {
 	QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error)
 	QueryRowContext(ctx context.Context, sql string, args ...interface{}) *sql.Row
@@ -53,21 +261,27 @@ type DBOrTx interface {
 type Table interface {
 	// return table name
 	Name() string
-	// Set the queues for EarliestMessage. This method must be concurrency safe.
+	// Set the queues for EarliestMessage. This method must be concurrency safe, it may be called
+	// when the queues are changed by Register while EarliestMessage is running: the running
+	// EarliestMessage can use either the old or the new queues, but the following calls must use
+	// the new queues. The queues slice is shared by all tables, it must not be modified.
 	SetQueues(queues []string)
 
 	// Get the earliest message in the "SetQueues" which have not been "MarkSuccess".
 	// The "earliest" means smallest "ConsumeAt".
 	// If no such message, return a nil interface.
 	// The tx must be used to exclusively lock (SELECT FOR UPDATE) the returned message.
-	// Don't commit or rollback the tx.
-	EarliestMessage(tx *sql.Tx) (Message, error)
+	// Don't commit or rollback the tx. SqlMQ always passes a *sql.Tx, the DBOrTx type only makes
+	// the method easier to mock.
+	EarliestMessage(tx DBOrTx) (Message, error)
 
 	// Mark a message as consumed successfully.
 	// The tx must be used to update the message. Don't commit or rollback the tx.
-	MarkSuccess(tx *sql.Tx, msg Message) error
+	// SqlMQ always passes a *sql.Tx.
+	MarkSuccess(tx DBOrTx, msg Message) error
 
-	// mark a message should be retried after a time period
+	// mark a message should be retried after a time period. The built-in tables also set the
+	// written time to msg if it's a StdMessage, so msg.ConsumeAt() is when it will be attempted.
 	MarkRetry(db DBOrTx, msg Message, retryAfter time.Duration) error
 
 	// mark a message as given up
@@ -90,106 +304,801 @@ type Message interface {
 	// At which time the message should be consumed(either first time or retry).
 	ConsumeAt() time.Time
 	EarliestMessageSql(tableName string, queues []string) string
-	EarliestMessage(tx *sql.Tx, querysql string) (Message, error)
+	EarliestMessage(tx DBOrTx, querysql string) (Message, error)
+}
+
+// TriedMessage is a Message which knows how many times it has been tried before, such as
+// StdMessage. MaxRetries, BackoffFunc, PoisonThreshold and attempts rely on it, a Message which
+// isn't a TriedMessage is regarded as never tried.
+type TriedMessage interface {
+	// How many times the message has been tried before.
+	GetTriedCount() uint16
+}
+
+func triedCount(msg Message) uint16 {
+	if m, ok := msg.(TriedMessage); ok {
+		return m.GetTriedCount()
+	}
+	return 0
+}
+
+// ParamMessage is a Message which can be produced by a statement with bound parameters, so that
+// its values needn't be quoted into the SQL. If a Message is a ParamMessage, StdTable produces it
+// by ParamProduceSql instead of ProduceSql.
+type ParamMessage interface {
+	ParamProduceSql(tableName string) (sql string, args []interface{}, err error)
 }
 
 // On successful handling, a nil error should be returned, retryAfter and canCommit is ignored.
 // On failing handling, a non nil error should be returned, and retryAfter means:
 // 1. if retryAfter is positive, means try again that time period later;
-// 2. if retryAfter is zero,     means try again immediately;
+// 2. if retryAfter is zero,     means try again immediately, or after SqlMQ.BackoffFunc if it's set;
 // 3. if retryAfter is negative, means give up this message, don't try again.
+// To retry at an absolute time instead of a time period later, return a RetryAt error.
 // canCommit means when an error is returned, can the transaction be committed or must be rollbacked.
 // If canCommit is false, this transaction is rollbacked, and another statements is executed to update retry time.
 type Handler func(ctx context.Context, tx *sql.Tx, msg Message) (
 	retryAfter time.Duration, canCommit bool, err error,
 )
 
+// RetryAtError is returned by a handler to retry the message at an absolute time, for example the
+// next business hour. The retryAfter returned along with it is ignored.
+type RetryAtError struct {
+	At  time.Time
+	Err error
+}
+
+// RetryAt return a *RetryAtError to retry the message at a time, err is the cause of failure.
+func RetryAt(at time.Time, err error) error {
+	return &RetryAtError{At: at, Err: err}
+}
+
+func (e *RetryAtError) Error() string {
+	if e.Err == nil {
+		return "retry at " + e.At.Format(time.RFC3339)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap return the cause of failure, so that errors.Is and errors.As see through a RetryAt error.
+func (e *RetryAtError) Unwrap() error {
+	return e.Err
+}
+
+// asRetryAt return the *RetryAtError in the chain of err.
+func asRetryAt(err error) (*RetryAtError, bool) {
+	for err != nil {
+		if e, ok := err.(*RetryAtError); ok {
+			return e, true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return nil, false
+}
+
+// DeferError is returned by a handler to reschedule the message without counting it as a failed
+// try, for example when a dependency is not ready yet. If the Table is a DeferTable, the tried
+// count of the message is not incremented, so deferring never exhausts MaxRetries. A deferred
+// message is never given up, and it doesn't open a circuit breaker.
+// The retryAfter returned along with it is ignored.
+type DeferError struct {
+	After time.Duration
+}
+
+// Defer return a *DeferError to reschedule the message after a time period.
+func Defer(after time.Duration) error {
+	return &DeferError{After: after}
+}
+
+func (e *DeferError) Error() string {
+	return "deferred for " + e.After.String()
+}
+
+// asDefer return the *DeferError in the chain of err.
+func asDefer(err error) (*DeferError, bool) {
+	for err != nil {
+		if e, ok := err.(*DeferError); ok {
+			return e, true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return nil, false
+}
+
+// Register a handler for a queue of SqlMQ.Table. It's safe to register queues while consuming,
+// the consuming loop is waked up to fetch messages of the new queue right now.
 func (mq *SqlMQ) Register(queueName string, handler Handler) error {
+	return mq.register(nil, queueName, handler)
+}
+
+// RegisterOn register a handler for a queue of a table added by AddTable (or SqlMQ.Table).
+// The queue belongs to the table: messages of it are produced into the table by Produce, and only
+// the messages of the table are handled by the handler. A queue name can't be registered on two
+// tables, so name the queues of every tenant apart, for example by a prefix.
+func (mq *SqlMQ) RegisterOn(table Table, queueName string, handler Handler) error {
 	mq.mutex.RLock()
-	existingHandler := mq.queues[queueName]
+	var added = table == mq.Table
+	for _, t := range mq.tables {
+		added = added || t == table
+	}
 	mq.mutex.RUnlock()
-	if existingHandler != nil {
-		return fmt.Errorf("queue %s already registered", queueName)
+	if !added {
+		return fmt.Errorf("table %s is not added", table.Name())
 	}
+	return mq.register(table, queueName, handler)
+}
 
+// register a handler for a queue of table, or of SqlMQ.Table if table is nil.
+func (mq *SqlMQ) register(table Table, queueName string, handler Handler) error {
 	mq.mutex.Lock()
+	if table == nil {
+		table = mq.Table
+	}
+	if mq.queues[queueName] != nil {
+		mq.mutex.Unlock()
+		return fmt.Errorf("queue %s already registered", queueName)
+	}
+	if mq.registered(queueName) && mq.queueTable(queueName) != table {
+		mq.mutex.Unlock()
+		return fmt.Errorf("queue %s already registered on another table", queueName)
+	}
 	if mq.queues == nil {
 		mq.queues = make(map[string]Handler)
 	}
 	mq.queues[queueName] = handler
+	if table != mq.Table {
+		if mq.queueTables == nil {
+			mq.queueTables = make(map[string]Table)
+		}
+		mq.queueTables[queueName] = table
+	}
 	mq.mutex.Unlock()
 
-	var queues = make([]string, 0, len(mq.queues))
+	mq.setQueues()
+	mq.NotifyConsumeAt(time.Now(), "queue regitered")
+	return nil
+}
+
+// RegisterType register a handler for messages of a type in a queue, so that several types of
+// messages can be multiplexed onto one queue and handled by separated handlers. The type of a
+// StdMessage is its Type field. The queue is of the table it's registered on by RegisterOn, or
+// of SqlMQ.Table. A message of the queue is handled by the handler of its type, or
+// by the handler registered by Register for the queue if there is none; if neither is
+// registered, it fails with ErrNoHandler, instead of being handled by the default handler.
+func (mq *SqlMQ) RegisterType(queueName, typ string, handler Handler) error {
+	if typ == "" {
+		return errors.New("message type must not be empty")
+	}
+	mq.mutex.Lock()
+	if mq.types[queueName][typ] != nil {
+		mq.mutex.Unlock()
+		return fmt.Errorf("type %s of queue %s already registered", typ, queueName)
+	}
+	if mq.types == nil {
+		mq.types = make(map[string]map[string]Handler)
+	}
+	if mq.types[queueName] == nil {
+		mq.types[queueName] = make(map[string]Handler)
+	}
+	mq.types[queueName][typ] = handler
+	mq.mutex.Unlock()
+
+	mq.setQueues()
+	mq.NotifyConsumeAt(time.Now(), "type registered")
+	return nil
+}
+
+// Subscribe register a simple handler for a queue, which gets the json data of a message and
+// doesn't manage the transaction. If handler returns nil, the message is marked as success.
+// Otherwise the transaction is rollbacked, and the message is retried after BackoffFunc, or after
+// GetRetryWait if BackoffFunc is nil; RetryAt and Defer errors work as for Register.
+// If the message is not a StdMessage or its data is not json, it's given up.
+// Use Register for handlers that change the database in the transaction.
+func (mq *SqlMQ) Subscribe(
+	queue string, handler func(ctx context.Context, payload json.RawMessage) error,
+) error {
+	return mq.Register(queue, func(ctx context.Context, tx *sql.Tx, msg Message) (
+		time.Duration, bool, error,
+	) {
+		var payload json.RawMessage
+		if err := unmarshalData(msg, &payload); err != nil {
+			return -1, true, err
+		}
+		if err := handler(ctx, payload); err != nil {
+			if mq.BackoffFunc != nil {
+				return 0, false, err
+			}
+			return GetRetryWait(triedCount(msg)), false, err
+		}
+		return 0, false, nil
+	})
+}
+
+func unmarshalData(msg Message, v interface{}) error {
+	m, ok := msg.(*StdMessage)
+	if !ok {
+		return fmt.Errorf("can't unmarshal data of message type %T", msg)
+	}
+	return m.DataInto(v)
+}
+
+// setQueues set the registered queues to every table, each table get its own queues.
+func (mq *SqlMQ) setQueues() {
+	mq.setQueuesMutex.Lock()
+	defer mq.setQueuesMutex.Unlock()
+	for _, table := range mq.allTables() {
+		table.SetQueues(mq.queuesOf(table))
+	}
+}
+
+// the queues registered on a table.
+func (mq *SqlMQ) queuesOf(table Table) []string {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	var queues = []string{}
+	for _, queue := range mq.handledQueues() {
+		if mq.queueTable(queue) == table {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
+
+// the table of a queue, must be called with mq.mutex locked.
+func (mq *SqlMQ) queueTable(queue string) Table {
+	if table := mq.queueTables[queue]; table != nil {
+		return table
+	}
+	return mq.Table
+}
+
+// TableOf return the table of a queue: the table it's registered on by RegisterOn, or SqlMQ.Table.
+// Don't confuse it with the function TableOf, which returns the table of a message being handled.
+func (mq *SqlMQ) TableOf(queue string) Table {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	return mq.queueTable(queue)
+}
+
+func (mq *SqlMQ) registeredQueues() []string {
 	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	return mq.handledQueues()
+}
+
+// the queues registered by Register or RegisterType, must be called with mq.mutex locked.
+func (mq *SqlMQ) handledQueues() []string {
+	var queues = make([]string, 0, len(mq.queues)+len(mq.types))
 	for queue, handler := range mq.queues {
 		if handler != nil {
 			queues = append(queues, queue)
 		}
 	}
-	mq.mutex.RUnlock()
+	for queue, types := range mq.types {
+		if len(types) > 0 && mq.queues[queue] == nil {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
 
-	mq.Table.SetQueues(queues)
-	mq.NotifyConsumeAt(time.Now(), "queue regitered")
-	return nil
+// whether a queue is registered by Register or RegisterType, must be called with mq.mutex locked.
+func (mq *SqlMQ) registered(queue string) bool {
+	return mq.queues[queue] != nil || len(mq.types[queue]) > 0
+}
+
+// Queues return the sorted names of the queues registered with a handler.
+func (mq *SqlMQ) Queues() []string {
+	var queues = mq.registeredQueues()
+	sort.Strings(queues)
+	return queues
+}
+
+// HasHandler return whether messages of a queue can be handled, either by handlers registered for
+// the queue, or by the default handler.
+func (mq *SqlMQ) HasHandler(queue string) bool {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	return mq.registered(queue) || mq.defaultHandler != nil
+}
+
+// AddTable add a table to consume messages from besides SqlMQ.Table, for example a table in every
+// tenant schema. The consuming loop fetches messages from all the tables in turn. Each table keeps
+// its own queues and handlers, register them by RegisterOn; Produce, RequeueWhere, MissingHandlers
+// and the backlog of Metrics find the table by the queue, and RequeueOn requeues a message of a
+// table by id. A handler uses TableOf to know which table (tenant) a message is from.
+// Messages of all the tables are cleaned and reaped.
+func (mq *SqlMQ) AddTable(table Table) {
+	mq.setQueuesMutex.Lock()
+	table.SetQueues(mq.queuesOf(table))
+	mq.mutex.Lock()
+	mq.tables = append(mq.tables, table)
+	if t, ok := table.(PausableTable); ok {
+		t.SetPausedQueues(mq.pausedQueues())
+	}
+	mq.mutex.Unlock()
+	mq.setQueuesMutex.Unlock()
+	mq.NotifyConsumeAt(time.Now(), "table added")
+}
+
+// TableOf return the table a message is fetched from, it must be called with the ctx (or a derived
+// one) passed to a handler, otherwise it returns nil.
+func TableOf(ctx context.Context) Table {
+	table, _ := ctx.Value(tableKey{}).(Table)
+	return table
+}
+
+type tableKey struct{}
+
+// SqlMQ.Table and the tables added by AddTable.
+func (mq *SqlMQ) allTables() []Table {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	return append([]Table{mq.Table}, mq.tables...)
 }
 
 func (mq *SqlMQ) SetDefaultHandler(handler Handler) {
 	mq.defaultHandler = handler
 }
 
+// Use add a middleware to wrap all the handlers, including the default handler.
+// Middlewares are applied in the order they are added, the first one is the outermost.
+// It can be called before or after Register.
+func (mq *SqlMQ) Use(middleware func(Handler) Handler) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	mq.middlewares = append(mq.middlewares, middleware)
+}
+
 func (mq *SqlMQ) noQueues() bool {
 	mq.mutex.RLock()
 	defer mq.mutex.RUnlock()
-	return len(mq.queues) == 0
+	return len(mq.handledQueues()) == 0
 }
 
-func (mq *SqlMQ) handlerOf(msg Message) (Handler, error) {
+// the handler of a message of table, a queue registered on another table is unknown to table.
+func (mq *SqlMQ) handlerOf(table Table, msg Message) (Handler, error) {
 	mq.mutex.RLock()
 	defer mq.mutex.RUnlock()
-	handler := mq.queues[msg.QueueName()]
+	var handler Handler
+	var types map[string]Handler
+	if mq.queueTable(msg.QueueName()) == table {
+		handler, types = mq.queues[msg.QueueName()], mq.types[msg.QueueName()]
+	}
+	if len(types) > 0 {
+		if m, ok := msg.(*StdMessage); ok && m.Type != "" {
+			if h := types[m.Type]; h != nil {
+				handler = h
+			} else if handler == nil {
+				return nil, &sentinelError{
+					sentinel: ErrNoHandler,
+					msg:      "unknown type " + m.Type + " of queue: " + msg.QueueName(),
+				}
+			}
+		} else if handler == nil {
+			return nil, &sentinelError{
+				sentinel: ErrNoHandler, msg: "message without type in queue: " + msg.QueueName(),
+			}
+		}
+	}
 	if handler == nil {
-		if mq.defaultHandler != nil {
-			return mq.defaultHandler, nil
+		if handler = mq.defaultHandler; handler == nil {
+			return nil, &sentinelError{sentinel: ErrNoHandler, msg: "unknown queue: " + msg.QueueName()}
 		}
-		return nil, errors.New("unknown queue: " + msg.QueueName())
+	}
+	for i := len(mq.middlewares) - 1; i >= 0; i-- {
+		handler = mq.middlewares[i](handler)
 	}
 	return handler, nil
 }
 
 // notify mq that there are messages to be consumed at a time.
+// It's safe to be called at any time, even before Consume starts: the consuming loop always
+// fetches messages in its first cycle, so messages produced before Consume are not missed.
 func (mq *SqlMQ) NotifyConsumeAt(at time.Time, event interface{}) {
-	mq.sleep.AwakeAtEalier(at, event)
+	mq.sleep.AwakeAtEarlier(at, event)
+	mq.workersMutex.Lock()
+	defer mq.workersMutex.Unlock()
+	for _, s := range mq.workers {
+		s.AwakeAtEarlier(at, event)
+	}
+}
+
+// TriggerConsume wake up the consuming loop to fetch messages right now, for example after
+// messages are produced by other processes without notification. A trigger arriving while the
+// loop is consuming is not lost, the loop re-checks right after the current cycle, and a burst of
+// triggers is coalesced into a single re-check.
+func (mq *SqlMQ) TriggerConsume() {
+	mq.NotifyConsumeAt(time.Now(), "triggered")
 }
 
-// Produce a meesage. tx can be nil.
+// Produce a meesage into the table of its queue, see TableOf. tx can be nil.
+// If tx is nil, the message is produced by mq.DB in its own statement, for fire-and-forget use,
+// see also ProduceInNewTx.
+// Otherwise the message is produced in tx, and committed or rollbacked together with the other
+// changes in tx (the transactional outbox pattern).
+// If Produce runs successfully, the generated message id is set in msg by msg.SetId, and for a
+// StdMessage, RetryAt is set to the time written, so msg.ConsumeAt() is when it will be attempted.
 func (mq *SqlMQ) Produce(tx *sql.Tx, msg Message) error {
-	if _, err := mq.handlerOf(msg); err != nil {
+	return mq.ProduceContext(context.Background(), tx, msg)
+}
+
+// ContextTable is a Table which can produce messages with a context.
+type ContextTable interface {
+	ProduceMessageContext(ctx context.Context, db DBOrTx, msg Message) error
+}
+
+// ProduceContext is the same as Produce, except that producing is cancelled when ctx is done,
+// if the Table is a ContextTable.
+func (mq *SqlMQ) ProduceContext(ctx context.Context, tx *sql.Tx, msg Message) error {
+	if err := mq.produce(ctx, tx, msg); err != nil {
+		return err
+	}
+	mq.NotifyConsumeAt(msg.ConsumeAt(), "produce")
+	return nil
+}
+
+// ProduceInNewTx produce a message in a short transaction of its own: it begins a transaction by
+// db (or by mq.DB if db is nil), produces the message, commits, and then notifies the consuming
+// loop. The transaction is rollbacked if producing fails. It's for enqueuing a message without
+// business data to commit together, use Produce with a tx for the transactional outbox pattern.
+func (mq *SqlMQ) ProduceInNewTx(db *sql.DB, msg Message) error {
+	if db == nil {
+		db = mq.DB
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return errs.Trace(err)
+	}
+	if err := mq.produce(context.Background(), tx, msg); err != nil {
+		if err2 := tx.Rollback(); err2 != nil {
+			mq.log().Error(err2)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Trace(err)
+	}
+	mq.NotifyConsumeAt(msg.ConsumeAt(), "produce")
+	return nil
+}
+
+// ProduceInTx produce a message in tx like Produce, it's for handlers to chain follow-up messages.
+// If tx is the transaction passed to a handler, the consuming loop is notified after tx is
+// committed, instead of right now when the message is not visible yet.
+// For other transactions, it's the same as Produce.
+func (mq *SqlMQ) ProduceInTx(tx *sql.Tx, msg Message) error {
+	if err := mq.produce(context.Background(), tx, msg); err != nil {
+		return err
+	}
+	mq.mutex.Lock()
+	if at, ok := mq.afterCommit[tx]; ok && tx != nil {
+		if at.IsZero() || msg.ConsumeAt().Before(at) {
+			mq.afterCommit[tx] = msg.ConsumeAt()
+		}
+		mq.mutex.Unlock()
+		return nil
+	}
+	mq.mutex.Unlock()
+	mq.NotifyConsumeAt(msg.ConsumeAt(), "produce")
+	return nil
+}
+
+func (mq *SqlMQ) produce(ctx context.Context, tx *sql.Tx, msg Message) error {
+	var table = mq.TableOf(msg.QueueName())
+	if _, err := mq.handlerOf(table, msg); err != nil {
 		return err
 	}
 	var db DBOrTx = mq.DB
 	if tx != nil {
 		db = tx
 	}
-	if err := mq.Table.ProduceMessage(db, msg); err != nil {
+	if t, ok := table.(ContextTable); ok {
+		return t.ProduceMessageContext(ctx, db, msg)
+	}
+	return table.ProduceMessage(db, msg)
+}
+
+// track a handling transaction, to notify the consuming loop after it's committed if messages
+// are produced in it by ProduceInTx.
+func (mq *SqlMQ) trackTx(tx *sql.Tx) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	if mq.afterCommit == nil {
+		mq.afterCommit = make(map[*sql.Tx]time.Time)
+	}
+	mq.afterCommit[tx] = time.Time{}
+}
+
+func (mq *SqlMQ) untrackTx(tx *sql.Tx, committed bool) {
+	mq.mutex.Lock()
+	at := mq.afterCommit[tx]
+	delete(mq.afterCommit, tx)
+	mq.mutex.Unlock()
+	if committed && !at.IsZero() {
+		mq.NotifyConsumeAt(at, "produced in tx")
+	}
+}
+
+// ProduceDelayed produce a message which should be consumed after a delay. tx can be nil.
+// The consuming loop is notified to wake up at the message's consume time, if it's earlier than
+// the time the loop is going to wake up.
+func (mq *SqlMQ) ProduceDelayed(tx *sql.Tx, msg *StdMessage, delay time.Duration) error {
+	msg.RetryAt = mq.now().Add(delay)
+	return mq.Produce(tx, msg)
+}
+
+func (mq *SqlMQ) now() time.Time {
+	if mq.Now != nil {
+		return mq.Now()
+	}
+	return time.Now()
+}
+
+// RequeueTable is a Table which can requeue messages.
+type RequeueTable interface {
+	Requeue(db DBOrTx, id int64, resetTriedCount bool) error
+	RequeueWhere(db DBOrTx, queue, status string, before time.Time) (int64, error)
+}
+
+// Requeue reset a message of SqlMQ.Table to be waiting and consumed right now,
+// see StdTable.Requeue.
+func (mq *SqlMQ) Requeue(id int64, resetTriedCount bool) error {
+	return mq.RequeueOn(mq.Table, id, resetTriedCount)
+}
+
+// RequeueOn is the same as Requeue, except that the message is of table, such as a table added by
+// AddTable. Ids are unique only in a table, so the table must be given.
+func (mq *SqlMQ) RequeueOn(table Table, id int64, resetTriedCount bool) error {
+	t, ok := table.(RequeueTable)
+	if !ok {
+		return fmt.Errorf("table %s doesn't support requeue", table.Name())
+	}
+	if err := t.Requeue(mq.DB, id, resetTriedCount); err != nil {
 		return err
 	}
-	mq.NotifyConsumeAt(msg.ConsumeAt(), "produce")
+	mq.NotifyConsumeAt(time.Now(), "requeue")
 	return nil
 }
 
+// RequeueWhere reset all the matched messages to be waiting and consumed right now,
+// see StdTable.RequeueWhere. The messages are of the table of queue, see TableOf,
+// or of all the tables if queue is empty.
+func (mq *SqlMQ) RequeueWhere(queue, status string, before time.Time) (int64, error) {
+	var tables = mq.allTables()
+	if queue != "" {
+		tables = []Table{mq.TableOf(queue)}
+	}
+	var total int64
+	var err error
+	for _, table := range tables {
+		t, ok := table.(RequeueTable)
+		if !ok {
+			err = fmt.Errorf("table %s doesn't support requeue", table.Name())
+			break
+		}
+		var n int64
+		n, err = t.RequeueWhere(mq.DB, queue, status, before)
+		if total += n; err != nil {
+			break
+		}
+	}
+	if total > 0 {
+		mq.NotifyConsumeAt(time.Now(), "requeue")
+	}
+	return total, err
+}
+
+// BatchTable is a Table which can fetch a batch of due messages.
+type BatchTable interface {
+	// Get at most limit due messages in the order of consuming, and lock them by tx.
+	// If there is no due message, return an empty slice, the caller falls back to EarliestMessage.
+	EarliestMessages(tx *sql.Tx, limit int) ([]Message, error)
+}
+
+// QueueTable is a Table which can fetch the earliest message of a queue, for QueueWeights.
+type QueueTable interface {
+	// The same as EarliestMessage, except that only messages of the queue are fetched.
+	EarliestMessageOfQueue(tx DBOrTx, queue string) (Message, error)
+}
+
+// DeferTable is a Table which can reschedule a message without incrementing its tried count.
+// If the Table is not a DeferTable, a deferred message is marked by MarkRetry.
+type DeferTable interface {
+	MarkDeferred(db DBOrTx, msg Message, retryAfter time.Duration) error
+}
+
+// AttemptTable is a Table which can record every attempt to process a message, for an audit
+// trail of messages. Attempts are recorded by the same db or transaction marking the message.
+type AttemptTable interface {
+	RecordAttempt(db DBOrTx, msg Message, attempt Attempt) error
+}
+
+// ExpireTable is a Table which can mark expired messages, see StdMessage.ExpiresAt.
+type ExpireTable interface {
+	// mark the waiting messages which are expired, and return the number of them.
+	ExpireMessages(db DBOrTx) (int64, error)
+}
+
+// ClaimTable is a Table which may claim messages by updating them in EarliestMessage, instead of
+// locking them in the transaction. If ClaimsByUpdate returns true, the transaction of
+// EarliestMessage is committed before handling, and the handler runs in a new transaction.
+type ClaimTable interface {
+	ClaimsByUpdate() bool
+	// reset messages claimed before olderThan ago but not marked back to be waiting.
+	ReapStale(db DBOrTx, olderThan time.Duration) (int64, error)
+}
+
+// MemoryTable is a Table which keeps messages in memory, such as MockTable. If InMemory returns
+// true, the table must claim messages by update, and SqlMQ consumes it without transactions like
+// NoHandlerTx. SqlMQ.DB can be nil if all the tables are in memory.
+type MemoryTable interface {
+	InMemory() bool
+}
+
+func inMemory(table Table) bool {
+	t, ok := table.(MemoryTable)
+	return ok && t.InMemory()
+}
+
+// PausableTable is a Table which can exclude paused queues from EarliestMessage.
+type PausableTable interface {
+	SetPausedQueues(queues []string)
+}
+
+// PauseQueue stop consuming messages of a queue, the messages accumulate until ResumeQueue.
+func (mq *SqlMQ) PauseQueue(name string) error {
+	return mq.setPaused(name, true)
+}
+
+// ResumeQueue resume consuming messages of a paused queue.
+func (mq *SqlMQ) ResumeQueue(name string) error {
+	if err := mq.setPaused(name, false); err != nil {
+		return err
+	}
+	mq.NotifyConsumeAt(time.Now(), "queue resumed")
+	return nil
+}
+
+func (mq *SqlMQ) setPaused(name string, paused bool) error {
+	if _, ok := mq.Table.(PausableTable); !ok {
+		return fmt.Errorf("table %s doesn't support pausing queues", mq.Table.Name())
+	}
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	if paused {
+		if mq.paused == nil {
+			mq.paused = make(map[string]bool)
+		}
+		mq.paused[name] = true
+	} else {
+		delete(mq.paused, name)
+	}
+	mq.applyPausedQueues()
+	return nil
+}
+
+// set the paused queues of all the PausableTables, must be called with mq.mutex locked.
+func (mq *SqlMQ) applyPausedQueues() {
+	var queues = mq.pausedQueues()
+	for _, t := range append([]Table{mq.Table}, mq.tables...) {
+		if t, ok := t.(PausableTable); ok {
+			t.SetPausedQueues(queues)
+		}
+	}
+}
+
+// the queues paused by PauseQueue, by an open breaker, by reaching MaxInFlightPerQueue or by
+// exceeding RateLimits, must be called with mq.mutex locked.
+func (mq *SqlMQ) pausedQueues() []string {
+	var queues = make([]string, 0, len(mq.paused))
+	var paused = make(map[string]bool)
+	var add = func(queue string) {
+		if !paused[queue] {
+			paused[queue] = true
+			queues = append(queues, queue)
+		}
+	}
+	for queue := range mq.paused {
+		add(queue)
+	}
+	for queue, b := range mq.breakers {
+		if b.state == BreakerOpen {
+			add(queue)
+		}
+	}
+	for queue := range mq.inFlight {
+		if mq.inFlightFull(queue) {
+			add(queue)
+		}
+	}
+	for queue, limiter := range mq.rateLimiters {
+		if limiter.full() {
+			add(queue)
+		}
+	}
+	return queues
+}
+
 func (mq *SqlMQ) Debug(debug bool) {
 	mq.debug = debug
 }
 
 func (mq *SqlMQ) validate() error {
-	if mq.DB == nil {
+	if mq.DB == nil && !mq.allInMemory() {
 		return errors.New("SqlMQ.DB must not be nil")
 	}
 	if mq.Table == nil {
 		return errors.New("SqlMQ.Table must not be nil")
 	}
-	if mq.Logger == nil {
+	if mq.TxOptions != nil && mq.TxOptions.ReadOnly {
+		return errors.New("SqlMQ.TxOptions must not be read only")
+	}
+	if mq.Log == nil && mq.Logger == nil {
 		mq.Logger = logger.New(os.Stderr)
 	}
+	if mq.CheckHandlers {
+		if queues, err := mq.MissingHandlers(); err != nil {
+			return err
+		} else if len(queues) > 0 {
+			return errors.New("no handler registered for queues: " + strings.Join(queues, ", "))
+		}
+	}
 	return nil
 }
+
+// whether all the tables are in memory, so that no DB is needed.
+func (mq *SqlMQ) allInMemory() bool {
+	for _, table := range mq.allTables() {
+		if !inMemory(table) {
+			return false
+		}
+	}
+	return true
+}
+
+// MissingHandlers return the queues which have waiting messages but no registered handler, in
+// any of the tables. A queue registered on another table has no handler in a table.
+// If a default handler is set, no queue is missing handler.
+func (mq *SqlMQ) MissingHandlers() ([]string, error) {
+	var tables = mq.allTables()
+	var backlogs = make([]map[string]int64, len(tables))
+	for i, table := range tables {
+		t, ok := table.(BacklogTable)
+		if !ok {
+			return nil, fmt.Errorf("table %s doesn't support backlog", table.Name())
+		}
+		backlog, err := t.Backlog(mq.DB)
+		if err != nil {
+			return nil, err
+		}
+		backlogs[i] = backlog
+	}
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	if mq.defaultHandler != nil {
+		return nil, nil
+	}
+	var missing = make(map[string]bool)
+	for i, backlog := range backlogs {
+		for queue := range backlog {
+			if !mq.registered(queue) || mq.queueTable(queue) != tables[i] {
+				missing[queue] = true
+			}
+		}
+	}
+	var queues []string
+	for queue := range missing {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues, nil
+}
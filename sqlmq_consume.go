@@ -3,183 +3,1136 @@ package sqlmq
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/lovego/logger"
+	"github.com/lovego/errs"
 )
 
+// Consume messages forever.
 func (mq *SqlMQ) Consume() {
+	mq.ConsumeContext(context.Background())
+}
+
+// ConsumeContext consume messages until ctx is done.
+// When ctx is done, no more messages are fetched, the messages being handled are allowed to
+// commit or rollback, and the background goroutines are stopped before it returns.
+// It's safe to call ConsumeContext again after it returned.
+func (mq *SqlMQ) ConsumeContext(ctx context.Context) {
 	if err := mq.validate(); err != nil {
 		panic(time.Now().Format(time.RFC3339Nano) + " " + err.Error())
 	}
-	if mq.CleanInterval > 0 {
-		go mq.clean()
+	if ctx.Err() != nil {
+		return
+	}
+	var background sync.WaitGroup
+	if mq.CleanInterval > 0 || mq.CleanSchedule != nil {
+		background.Add(1)
+		go func() {
+			mq.clean(ctx)
+			background.Done()
+		}()
+	}
+	if mq.ReapInterval > 0 {
+		background.Add(1)
+		go func() {
+			mq.reapStale(ctx)
+			background.Done()
+		}()
+	}
+	if mq.Metrics != nil && mq.MetricsInterval > 0 {
+		background.Add(1)
+		go func() {
+			mq.collectBacklog(ctx)
+			background.Done()
+		}()
+	}
+	if mq.ListenDSN != "" && mq.ListenChannel != "" {
+		background.Add(1)
+		go func() {
+			mq.listen(ctx)
+			background.Done()
+		}()
+	}
+	mq.concurrencyLimit() // created before the workers share it.
+	var sleepers = []*sleeper{&mq.sleep}
+	for i := 1; i < mq.Concurrency; i++ {
+		sleepers = append(sleepers, &sleeper{})
+	}
+	mq.workersMutex.Lock()
+	mq.workers = sleepers[1:]
+	mq.workersMutex.Unlock()
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			for _, s := range sleepers {
+				s.Awake("context done")
+			}
+		}()
+	}
+	var workers sync.WaitGroup
+	for _, s := range sleepers[1:] {
+		workers.Add(1)
+		go func(s *sleeper) {
+			mq.work(ctx, s)
+			workers.Done()
+		}(s)
 	}
+	mq.work(ctx, &mq.sleep)
+	workers.Wait()
+	mq.workersMutex.Lock()
+	mq.workers = nil
+	mq.workersMutex.Unlock()
+
+	mq.handling.Wait()
+	background.Wait()
+}
 
-	idleWait, errorWait := mq.getWaitTime()
+// work is the consuming loop of a worker, it sleeps by its own sleeper, see SqlMQ.Concurrency.
+func (mq *SqlMQ) work(ctx context.Context, sleep *sleeper) {
 	if mq.debug {
-		for {
-			mq.sleep.ClearAwakeAt() // for subsequent sleep.AwakeAtEalier() calls.
-			var wait = mq.consume(idleWait, errorWait)
+		for ctx.Err() == nil {
+			sleep.ClearAwakeAt() // for subsequent sleep.AwakeAtEarlier() calls.
+			idleWait, errorWait := mq.getWaitTime()
+			var wait = mq.consume(ctx, idleWait, errorWait)
 			logf("consumed.")
-			mq.NotifyConsumeAt(time.Now().Add(wait), "sleep "+wait.String())
-			logf("awaken for %v", mq.sleep.Run())
+			sleep.AwakeAtEarlier(time.Now().Add(wait), "sleep "+wait.String())
+			if ctx.Err() != nil {
+				break
+			}
+			logf("awaken for %v", sleep.Run())
 		}
 	} else {
-		for {
-			mq.sleep.ClearAwakeAt() // for subsequent sleep.AwakeAtEalier() calls.
-			var wait = mq.consume(idleWait, errorWait)
-			mq.NotifyConsumeAt(time.Now().Add(wait), nil)
-			mq.sleep.Run()
+		for ctx.Err() == nil {
+			sleep.ClearAwakeAt() // for subsequent sleep.AwakeAtEarlier() calls.
+			idleWait, errorWait := mq.getWaitTime()
+			var wait = mq.consume(ctx, idleWait, errorWait)
+			sleep.AwakeAtEarlier(time.Now().Add(wait), nil)
+			if ctx.Err() != nil {
+				break
+			}
+			sleep.Run()
 		}
 	}
 }
 
-func (mq *SqlMQ) consume(idleWait, errorWait time.Duration) time.Duration {
+// ConsumeOnce fetch and handle at most one due message (or one batch if BatchSize > 1), and wait
+// until the handling is done. It's for tests and cron-style jobs driven by an external scheduler.
+// If no message is due, processed is false and wait is how long until the earliest message is due.
+// Errors of handling are reported by Logger and the hooks as in Consume, err is only the error
+// of fetching messages. Don't call it while Consume is running.
+func (mq *SqlMQ) ConsumeOnce(ctx context.Context) (processed bool, wait time.Duration, err error) {
+	handled, wait, err := mq.consumeOnce(ctx, mq.BatchSize)
+	return handled > 0, wait, err
+}
+
+// Drain consume at most max due messages one after another (or batch by batch if BatchSize > 1)
+// until no message is due, and return how many messages are processed. It's for Lambda-style
+// invocations or an admin action to consume the backlog in bounded work.
+// ctx is checked before fetching every message, the processed number so far and ctx.Err() are
+// returned if it's done. Handling errors are reported like ConsumeOnce.
+// Don't call it while Consume is running.
+func (mq *SqlMQ) Drain(ctx context.Context, max int) (int, error) {
+	// a BatchSize of 0 or less means no batching, so one message is consumed at a time.
+	var batch = mq.BatchSize
+	if batch < 1 {
+		batch = 1
+	}
+	var n int
+	for n < max {
+		var limit = max - n
+		if batch < limit {
+			limit = batch
+		}
+		handled, _, err := mq.consumeOnce(ctx, limit)
+		if err != nil {
+			return n, err
+		}
+		if handled == 0 {
+			break
+		}
+		n += handled
+	}
+	return n, nil
+}
+
+// consumeOnce fetch and handle a due message or a batch of at most batchSize messages, and
+// return how many messages are handled.
+func (mq *SqlMQ) consumeOnce(ctx context.Context, batchSize int) (
+	handled int, wait time.Duration, err error,
+) {
+	if err = mq.validate(); err != nil {
+		return
+	}
+	idleWait, _ := mq.getWaitTime()
+	if err = ctx.Err(); err != nil || mq.noQueues() {
+		return 0, idleWait, err
+	}
+	wait = -1
+	for _, table := range mq.allTables() {
+		tableWait, _, handled, err := mq.consumeOne(table, idleWait, batchSize)
+		if err != nil {
+			return 0, 0, err
+		}
+		if tableWait <= 0 {
+			mq.handling.Wait()
+			return handled, 0, nil
+		}
+		if tableWait > idleWait {
+			tableWait = idleWait
+		}
+		if wait < 0 || tableWait < wait {
+			wait = tableWait
+		}
+	}
+	return 0, wait, nil
+}
+
+func (mq *SqlMQ) consume(ctx context.Context, idleWait, errorWait time.Duration) time.Duration {
 	if mq.noQueues() {
+		mq.setLastWait(idleWait, WaitIdle)
 		return idleWait
 	}
-	for {
-		if wait, err := mq.consumeOne(idleWait); err != nil {
-			mq.Logger.Error(err)
-			return errorWait
-		} else if wait > 0 {
-			if wait > idleWait {
-				wait = idleWait
+	// consume the tables in turn, until every table has no due message.
+	var tables = mq.allTables()
+	var minWait time.Duration = -1
+	var minReason WaitReason
+	for len(tables) > 0 && ctx.Err() == nil {
+		var active []Table
+		for _, table := range tables {
+			var reason WaitReason
+			wait, idle, _, err := mq.consumeOne(table, idleWait, mq.BatchSize)
+			if err != nil {
+				mq.log().Error(err)
+				wait, reason = errorWait, WaitError
+			} else if wait > 0 {
+				if wait > idleWait {
+					wait = idleWait
+				}
+				if idle {
+					reason = WaitIdle
+				} else {
+					reason = WaitMessage
+				}
+			} else {
+				active = append(active, table)
+				continue
+			}
+			if minWait < 0 || wait < minWait {
+				minWait, minReason = wait, reason
 			}
-			return wait
 		}
+		tables = active
 	}
+	if minWait < 0 {
+		return 0
+	}
+	mq.setLastWait(minWait, minReason)
+	return minWait
+}
+
+// WaitReason is the reason why the consuming loop waits.
+type WaitReason string
+
+const (
+	WaitIdle    WaitReason = "idle"    // no message to consume, or no queue registered.
+	WaitError   WaitReason = "error"   // an error happened when fetching message.
+	WaitMessage WaitReason = "message" // the earliest message is not due yet, or is rate limited.
+)
+
+// LastWait return the wait duration and its reason computed by the latest consuming cycle.
+// The consuming loop may be waken up earlier by NotifyConsumeAt.
+// It's mainly for tests and monitoring, a zero duration is returned if no cycle has completed.
+func (mq *SqlMQ) LastWait() (time.Duration, WaitReason) {
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	return mq.lastWait, mq.lastWaitReason
+}
+
+func (mq *SqlMQ) setLastWait(wait time.Duration, reason WaitReason) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	mq.lastWait, mq.lastWaitReason = wait, reason
+}
+
+// consumeOne fetch a message, or a batch of at most batchSize messages, of table and handle them in
+// the background. If wait > 0, nothing is handled, and it's how long to wait until the earliest
+// message can be consumed (it's due and allowed by the rate limit of its queue), or it's idleWait
+// and idle is true if there is no message to consume. Otherwise handled is the number of messages
+// being handled.
+func (mq *SqlMQ) consumeOne(table Table, idleWait time.Duration, batchSize int) (
+	wait time.Duration, idle bool, handled int, err error,
+) {
+	if queues, ok := mq.weightedQueues(table); ok {
+		return mq.consumeWeighted(table, idleWait, queues)
+	}
+	return mq.consumeQueue(table, "", idleWait, batchSize)
 }
 
-func (mq *SqlMQ) consumeOne(idleWait time.Duration) (wait time.Duration, err error) {
+// consumeQueue is the same as consumeOne, except that only messages of the queue are fetched if
+// queue is not empty, and they are not fetched in batch.
+func (mq *SqlMQ) consumeQueue(table Table, queue string, idleWait time.Duration, batchSize int) (
+	wait time.Duration, idle bool, handled int, err error,
+) {
+	if mq.noHandlerTx(table) {
+		return mq.consumeWithoutTx(table, queue, idleWait)
+	}
 	mq.concurrencyLimit() <- struct{}{}
-	tx, cancel, err := mq.beginTx()
+	tx, lease, err := mq.beginTx()
 	if err != nil {
 		<-mq.concurrencyLimit()
 		return
 	}
 
-	msg, err := mq.Table.EarliestMessage(tx)
+	if batch := mq.batchTable(table); batch != nil && batchSize > 1 && queue == "" {
+		var msgs []Message
+		if msgs, err = batch.EarliestMessages(tx, batchSize); err == nil && len(msgs) > 0 {
+			handled = len(msgs)
+			for _, msg := range msgs {
+				mq.checkLag(msg)
+			}
+			mq.acquireInFlight(msgs...)
+			mq.handling.Add(1)
+			var outcome txOutcome
+			go mq.log().Record(func(ctx context.Context) error {
+				return mq.handleBatch(ctx, lease, table, tx, msgs, &outcome)
+			}, func(f LogFields) {
+				f.With("messages", len(msgs))
+				outcome.fields(f)
+				mq.releaseInFlight(msgs...)
+				<-mq.concurrencyLimit()
+				mq.handling.Done()
+			})
+			return
+		}
+		if err != nil {
+			if err2 := tx.Rollback(); err2 != nil {
+				mq.log().Error(err2)
+			}
+			lease.end()
+			<-mq.concurrencyLimit()
+			return
+		}
+		// no due message, fetch the earliest message to compute how long to wait.
+	}
+
+	msg, err := earliestMessage(table, tx, queue)
 	if msg != nil {
-		wait = time.Until(msg.ConsumeAt())
+		if wait = msg.ConsumeAt().Sub(mq.now()); wait <= 0 {
+			wait = mq.rateLimitWait(msg.QueueName())
+		}
 	} else {
-		wait = idleWait
+		wait, idle = idleWait, true
 	}
 	if wait > 0 || err != nil {
 		if err2 := tx.Rollback(); err2 != nil {
-			mq.Logger.Error(err2)
+			mq.log().Error(err2)
 		}
-		cancel()
+		lease.end()
 		<-mq.concurrencyLimit()
 		return
 	}
 
+	mq.checkLag(msg)
+
+	if t, ok := table.(ClaimTable); ok && t.ClaimsByUpdate() {
+		// commit the claim, so the message isn't locked while handling.
+		err = tx.Commit()
+		lease.end()
+		if err == nil {
+			tx, lease, err = mq.beginTx()
+		}
+		if err != nil {
+			<-mq.concurrencyLimit()
+			return
+		}
+	}
+
 	var retryAfter time.Duration
 	var handleErr error
+	var outcome txOutcome
 
-	go mq.Logger.Record(func(ctx context.Context) error {
-		retryAfter, handleErr = mq.handle(ctx, cancel, tx, msg)
+	handled = 1
+	mq.acquireInFlight(msg)
+	mq.handling.Add(1)
+	go mq.log().Record(func(ctx context.Context) error {
+		retryAfter, handleErr = mq.handleTx(ctx, lease, table, tx, msg, &outcome)
 		return handleErr
-	}, nil, func(f *logger.Fields) {
+	}, func(f LogFields) {
 		f.With("message", msg)
 		if handleErr != nil {
 			f.With("retryAfter", retryAfter.String())
+			f.With("failStage", FailStageOf(handleErr))
 		}
+		outcome.fields(f)
+		mq.releaseInFlight(msg)
 		<-mq.concurrencyLimit()
+		mq.handling.Done()
 	})
 
 	return
 }
 
-func (mq *SqlMQ) handle(ctx context.Context, cancel func(), tx *sql.Tx, msg Message) (
+// whether the table's messages are handled without a transaction, see SqlMQ.NoHandlerTx and
+// MemoryTable.
+func (mq *SqlMQ) noHandlerTx(table Table) bool {
+	if inMemory(table) {
+		return true
+	}
+	if !mq.NoHandlerTx {
+		return false
+	}
+	t, ok := table.(ClaimTable)
+	return ok && t.ClaimsByUpdate()
+}
+
+// consumeWithoutTx is the same as consumeQueue, except that the message is claimed by DB and
+// handled without a transaction.
+func (mq *SqlMQ) consumeWithoutTx(table Table, queue string, idleWait time.Duration) (
+	wait time.Duration, idle bool, handled int, err error,
+) {
+	mq.concurrencyLimit() <- struct{}{}
+	msg, err := earliestMessage(table, mq.DB, queue)
+	if msg != nil {
+		if !claimed(msg, mq.now()) {
+			// not due by the clock of DB yet, poll it again soon even if it's due by mq.Now.
+			if wait = msg.ConsumeAt().Sub(mq.now()); wait <= 0 {
+				wait = 100 * time.Millisecond
+			}
+		} else if wait = mq.rateLimitWait(msg.QueueName()); wait > 0 {
+			// release the claim, or the message stays claimed until reaped.
+			mq.markDeferred(table, mq.DB, msg, wait, false)
+		}
+	} else {
+		wait, idle = idleWait, true
+	}
+	if wait > 0 || err != nil {
+		<-mq.concurrencyLimit()
+		return
+	}
+	mq.checkLag(msg)
+
+	var retryAfter time.Duration
+	var handleErr error
+
+	handled = 1
+	mq.acquireInFlight(msg)
+	mq.handling.Add(1)
+	go mq.log().Record(func(ctx context.Context) error {
+		retryAfter, handleErr = mq.handleWithoutTx(ctx, table, msg)
+		return handleErr
+	}, func(f LogFields) {
+		f.With("message", msg)
+		if handleErr != nil {
+			f.With("retryAfter", retryAfter.String())
+			f.With("failStage", FailStageOf(handleErr))
+		}
+		mq.releaseInFlight(msg)
+		<-mq.concurrencyLimit()
+		mq.handling.Done()
+	})
+	return
+}
+
+// claimed return whether msg is claimed by the EarliestMessage of a table claiming by update.
+// A claimed StdMessage is StatusProcessing, which is decided by the clock of DB, other messages
+// are regarded as claimed if they are due at now.
+func claimed(msg Message, now time.Time) bool {
+	if m, ok := msg.(*StdMessage); ok {
+		return m.Status == StatusProcessing
+	}
+	return !msg.ConsumeAt().After(now)
+}
+
+// handleWithoutTx call the handler of a claimed message with a nil tx, and then mark the message
+// by DB. Under AtMostOnce, the message is marked as success before calling its handler.
+func (mq *SqlMQ) handleWithoutTx(ctx context.Context, table Table, msg Message) (
+	retryAfter time.Duration, err error,
+) {
+	ctx = context.WithValue(ctx, tableKey{}, table) // for TableOf.
+	if mq.Tracer != nil {
+		var end func(time.Duration, error)
+		ctx, end = mq.Tracer.StartSpan(ctx, msg)
+		defer func() {
+			end(retryAfter, err)
+		}()
+	}
+	var start = time.Now()
+	handler, err := mq.handlerOf(table, msg)
+	if err != nil {
+		mq.markFail(table, mq.DB, msg, time.Minute, true)
+		mq.recordAttempt(table, mq.DB, msg, start, time.Minute, err)
+		return time.Minute, &stageError{stage: FailHandler, error: err}
+	}
+	var atMostOnce = mq.DeliverySemantics == AtMostOnce
+	if atMostOnce {
+		if err = table.MarkSuccess(mq.DB, msg); err != nil {
+			return 0, &stageError{stage: FailMark, error: err}
+		}
+	}
+
+	retryAfter, _, err = mq.callHandler(ctx, handler, nil, msg)
+	handlerLatency := time.Since(start)
+	if mq.Metrics != nil {
+		mq.Metrics.Handled(msg.QueueName(), handlerLatency, err)
+	}
+	mq.recordBreaker(msg.QueueName(), err)
+	if err == nil {
+		if !atMostOnce {
+			if err = table.MarkSuccess(mq.DB, msg); err != nil {
+				return 0, &stageError{stage: FailMark, error: err}
+			}
+		}
+		mq.recordAttempt(table, mq.DB, msg, start, 0, nil)
+		if mq.OnSuccess != nil {
+			mq.OnSuccess(msg)
+		}
+		if mq.OnConsumed != nil {
+			mq.OnConsumed(msg, mq.now().Sub(createdAt(msg)), handlerLatency)
+		}
+		return 0, nil
+	}
+	if atMostOnce {
+		mq.recordAttempt(table, mq.DB, msg, start, -1, err)
+		return retryAfter, &stageError{stage: FailHandler, error: err}
+	}
+	retryAfter = mq.retryAfter(msg, retryAfter, err)
+	var mark = mq.markFail
+	if _, deferred := asDefer(err); deferred {
+		mark = mq.markDeferred
+	} else if retryAfter < 0 || mq.retriesExhausted(msg) {
+		err = &sentinelError{sentinel: ErrGivenUp, cause: err}
+	}
+	mark(table, mq.DB, msg, retryAfter, true)
+	mq.recordAttempt(table, mq.DB, msg, start, retryAfter, err)
+	return retryAfter, &stageError{stage: FailHandler, error: err}
+}
+
+// return the table as a BatchTable if batch consuming is enabled and applicable.
+func (mq *SqlMQ) batchTable(table Table) BatchTable {
+	if mq.BatchSize <= 1 || len(mq.RateLimits) > 0 || mq.DeliverySemantics == AtMostOnce {
+		return nil
+	}
+	if t, ok := table.(ClaimTable); ok && t.ClaimsByUpdate() {
+		return nil
+	}
+	batch, _ := table.(BatchTable)
+	return batch
+}
+
+// the time a message is produced, or its consume time if it's not a StdMessage.
+func createdAt(msg Message) time.Time {
+	if m, ok := msg.(*StdMessage); ok {
+		return m.CreatedAt
+	}
+	return msg.ConsumeAt()
+}
+
+func (mq *SqlMQ) checkLag(msg Message) {
+	if mq.MaxLag <= 0 {
+		return
+	}
+	lag := mq.now().Sub(msg.ConsumeAt())
+	if lag <= mq.MaxLag {
+		return
+	}
+	if mq.OnLag != nil {
+		mq.OnLag(msg, lag)
+	} else {
+		mq.log().Record(func(context.Context) error {
+			return errors.New("consume lag exceeded")
+		}, func(f LogFields) {
+			f.With("queue", msg.QueueName())
+			f.With("lag", lag.String())
+		})
+	}
+}
+
+func (mq *SqlMQ) handle(ctx context.Context, lease *txLease, table Table, tx *sql.Tx, msg Message) (
 	retryAfter time.Duration, err error,
 ) {
-	var canCommit bool
+	return mq.handleTx(ctx, lease, table, tx, msg, nil)
+}
+
+// handleTx is the same as handle, except that how the transaction ended is recorded into outcome
+// if it's not nil, instead of logging the error of committing or rollbacking separately.
+func (mq *SqlMQ) handleTx(
+	ctx context.Context, lease *txLease, table Table, tx *sql.Tx, msg Message, outcome *txOutcome,
+) (retryAfter time.Duration, err error) {
+	ctx = context.WithValue(ctx, leaseKey{}, lease) // for Heartbeat.
+	ctx = context.WithValue(ctx, tableKey{}, table) // for TableOf.
+	if mq.Tracer != nil {
+		var end func(time.Duration, error)
+		ctx, end = mq.Tracer.StartSpan(ctx, msg)
+		defer func() {
+			end(retryAfter, err)
+		}()
+	}
+
+	if mq.DeliverySemantics == AtMostOnce {
+		if handler, err := mq.handlerOf(table, msg); err == nil {
+			return mq.handleAtMostOnce(ctx, lease, table, tx, msg, handler, outcome)
+		}
+	}
+
+	var canCommit, committed bool
 	var notifyConsumeAt time.Time
+	var handlerLatency time.Duration
+	var stage FailStage
+	mq.trackTx(tx)
 	defer func() {
 		if err == nil {
-			err = tx.Commit()
+			if err = tx.Commit(); err == nil {
+				committed = true
+				if mq.OnSuccess != nil {
+					mq.OnSuccess(msg)
+				}
+				if mq.OnConsumed != nil {
+					mq.OnConsumed(msg, mq.now().Sub(createdAt(msg)), handlerLatency)
+				}
+			} else {
+				stage = FailCommit
+			}
 		} else {
 			if canCommit {
 				if err2 := tx.Commit(); err2 != nil {
-					mq.Logger.Error(err2)
-				} else if !notifyConsumeAt.IsZero() {
-					mq.NotifyConsumeAt(notifyConsumeAt, "retry") // must be after released lock.
+					mq.txError(outcome, err2)
+				} else {
+					committed = true
+					if !notifyConsumeAt.IsZero() {
+						mq.NotifyConsumeAt(notifyConsumeAt, "retry") // must be after released lock.
+					}
 				}
 			} else {
 				if err2 := tx.Rollback(); err2 != nil {
-					mq.Logger.Error(err2)
+					mq.txError(outcome, err2)
 				}
 			}
 		}
-		cancel()
+		if outcome != nil {
+			outcome.committed = committed
+		}
+		mq.untrackTx(tx, committed)
+		if !committed && lease.Err() == context.DeadlineExceeded {
+			// the transaction is rollbacked by database/sql when its context is done.
+			if err != nil && stage != FailHandler {
+				err = &sentinelError{sentinel: ErrTxTimeout, cause: err}
+			}
+			mq.txTimedOut(msg)
+		}
+		lease.end()
+		if err != nil {
+			err = &stageError{stage: stage, error: err}
+		}
 	}()
 
-	handler, err := mq.handlerOf(msg)
+	var start = time.Now()
+	handler, err := mq.handlerOf(table, msg)
 	if err == nil {
-		if retryAfter, canCommit, err = handler(ctx, tx, msg); err == nil {
-			err = mq.Table.MarkSuccess(tx, msg)
-		} else if canCommit {
-			notifyConsumeAt = mq.markFail(tx, msg, retryAfter, false)
+		retryAfter, canCommit, err = mq.callHandler(ctx, handler, tx, msg)
+		handlerLatency = time.Since(start)
+		if mq.Metrics != nil {
+			mq.Metrics.Handled(msg.QueueName(), handlerLatency, err)
+		}
+		mq.recordBreaker(msg.QueueName(), err)
+		if err == nil {
+			if err = table.MarkSuccess(tx, msg); err != nil {
+				stage = FailMark
+			} else {
+				mq.recordAttempt(table, tx, msg, start, 0, nil)
+			}
 		} else {
-			// Do this before transaction released the "FOR UPDATE" lock.
-			go mq.markFail(mq.DB, msg, retryAfter, true)
-			// Wait the goroutine above to be ready to preempt the lock before rollback release the lock.
-			// Reduce the rate that `EarliestMessage` got the lock and consume this message again.
-			time.Sleep(100 * time.Millisecond)
+			stage = FailHandler
+			retryAfter = mq.retryAfter(msg, retryAfter, err)
+			var mark = mq.markFail
+			if _, deferred := asDefer(err); deferred {
+				mark = mq.markDeferred
+			} else if retryAfter < 0 || mq.retriesExhausted(msg) {
+				err = &sentinelError{sentinel: ErrGivenUp, cause: err}
+			}
+			if canCommit {
+				notifyConsumeAt = mark(table, tx, msg, retryAfter, false)
+				mq.recordAttempt(table, tx, msg, start, retryAfter, err)
+			} else {
+				// Do this before transaction released the "FOR UPDATE" lock.
+				go func(retryAfter time.Duration, err error) {
+					mark(table, mq.DB, msg, retryAfter, true)
+					mq.recordAttempt(table, mq.DB, msg, start, retryAfter, err)
+				}(retryAfter, err)
+				// Wait the goroutine above to be ready to preempt the lock before rollback release the lock.
+				// Reduce the rate that `EarliestMessage` got the lock and consume this message again.
+				time.Sleep(100 * time.Millisecond)
+			}
 		}
 	} else {
-		retryAfter, canCommit = time.Minute, true
-		notifyConsumeAt = mq.markFail(tx, msg, retryAfter, false)
+		stage, retryAfter, canCommit = FailHandler, time.Minute, true
+		notifyConsumeAt = mq.markFail(table, tx, msg, retryAfter, false)
+		mq.recordAttempt(table, tx, msg, start, retryAfter, err)
 	}
 	return
 }
 
+// handleAtMostOnce mark the message as success and commit, then call its handler with a nil tx.
+func (mq *SqlMQ) handleAtMostOnce(
+	ctx context.Context, lease *txLease, table Table, tx *sql.Tx, msg Message, handler Handler,
+	outcome *txOutcome,
+) (retryAfter time.Duration, err error) {
+	var stage = FailMark
+	if err = table.MarkSuccess(tx, msg); err == nil {
+		stage, err = FailCommit, tx.Commit()
+		if outcome != nil {
+			outcome.committed = err == nil
+		}
+	} else if err2 := tx.Rollback(); err2 != nil {
+		mq.txError(outcome, err2)
+	}
+	if err != nil && lease.Err() == context.DeadlineExceeded {
+		err = &sentinelError{sentinel: ErrTxTimeout, cause: err}
+	}
+	lease.end()
+	if err != nil {
+		return 0, &stageError{stage: stage, error: err}
+	}
+
+	var start = time.Now()
+	retryAfter, _, err = mq.callHandler(ctx, handler, nil, msg)
+	handlerLatency := time.Since(start)
+	if mq.Metrics != nil {
+		mq.Metrics.Handled(msg.QueueName(), handlerLatency, err)
+	}
+	mq.recordBreaker(msg.QueueName(), err)
+	// the message is already marked as success, so a failed one is never retried.
+	mq.recordAttempt(table, mq.DB, msg, start, -1, err)
+	if err != nil {
+		return retryAfter, &stageError{stage: FailHandler, error: err}
+	}
+	if mq.OnSuccess != nil {
+		mq.OnSuccess(msg)
+	}
+	if mq.OnConsumed != nil {
+		mq.OnConsumed(msg, mq.now().Sub(createdAt(msg)), handlerLatency)
+	}
+	return 0, nil
+}
+
+// txOutcome is how the transaction of handling a message or a batch ended, it's logged with the
+// message, so a log entry has the handler error, the retryAfter and the commit result together.
+type txOutcome struct {
+	committed bool
+	// the error of committing or rollbacking, which isn't the error returned by handling.
+	err error
+}
+
+func (outcome *txOutcome) fields(f LogFields) {
+	f.With("committed", outcome.committed)
+	if outcome.err != nil {
+		f.With("txError", outcome.err.Error())
+	}
+}
+
+// record the error of committing or rollbacking into outcome, or log it if outcome is nil.
+func (mq *SqlMQ) txError(outcome *txOutcome, err error) {
+	if outcome != nil {
+		outcome.err = err
+	} else {
+		mq.log().Error(err)
+	}
+}
+
+// adjust the retryAfter returned by a handler by its error and BackoffFunc.
+func (mq *SqlMQ) retryAfter(msg Message, retryAfter time.Duration, err error) time.Duration {
+	if e, ok := asRetryAt(err); ok {
+		// a past time means retry immediately, but a non-positive retryAfter doesn't.
+		if retryAfter = e.At.Sub(mq.now()); retryAfter <= 0 {
+			retryAfter = time.Nanosecond
+		}
+	} else if e, ok := asDefer(err); ok {
+		if retryAfter = e.After; retryAfter < 0 {
+			retryAfter = 0
+		}
+	} else {
+		if retryAfter == 0 && mq.BackoffFunc != nil {
+			retryAfter = mq.BackoffFunc(triedCount(msg))
+		}
+		if retryAfter > 0 && mq.RetryJitter > 0 {
+			retryAfter = jitter(retryAfter, mq.RetryJitter)
+		}
+	}
+	return retryAfter
+}
+
+// add a random duration in [-max, max] to d, the result is not negative.
+func jitter(d, max time.Duration) time.Duration {
+	if d += time.Duration(rand.Int63n(int64(2*max)+1)) - max; d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// handleBatch handle a batch of messages in one transaction. Every message is handled after a
+// savepoint, if its handler fails and the transaction can't be committed, only the changes after
+// the savepoint are rollbacked, and the message is marked to retry in the same transaction.
+// The transaction is committed after all the messages are handled.
+func (mq *SqlMQ) handleBatch(
+	ctx context.Context, lease *txLease, table Table, tx *sql.Tx, msgs []Message, outcome *txOutcome,
+) (err error) {
+	ctx = context.WithValue(ctx, leaseKey{}, lease) // for Heartbeat.
+	ctx = context.WithValue(ctx, tableKey{}, table) // for TableOf.
+	var succeeded []Message
+	var handlerLatencies []time.Duration
+	var notifyConsumeAt time.Time
+	mq.trackTx(tx)
+	defer func() {
+		if err == nil {
+			if err = tx.Commit(); err != nil {
+				err = &stageError{stage: FailCommit, error: err}
+			} else {
+				for i, msg := range succeeded {
+					if mq.OnSuccess != nil {
+						mq.OnSuccess(msg)
+					}
+					if mq.OnConsumed != nil {
+						mq.OnConsumed(msg, mq.now().Sub(createdAt(msg)), handlerLatencies[i])
+					}
+				}
+				if !notifyConsumeAt.IsZero() {
+					mq.NotifyConsumeAt(notifyConsumeAt, "retry")
+				}
+			}
+		} else if err2 := tx.Rollback(); err2 != nil {
+			mq.txError(outcome, err2)
+		}
+		outcome.committed = err == nil
+		mq.untrackTx(tx, err == nil)
+		if err != nil && lease.Err() == context.DeadlineExceeded {
+			mq.txTimedOut(msgs...)
+		}
+		lease.end()
+	}()
+
+	for _, msg := range msgs {
+		if _, err = tx.ExecContext(ctx, "SAVEPOINT sqlmq_message"); err != nil {
+			return errs.Trace(err)
+		}
+		var handlerLatency time.Duration
+		var start = time.Now()
+		retryAfter, canCommit, handleErr := mq.handleInBatch(ctx, table, tx, msg, &handlerLatency)
+		if handleErr == nil {
+			mq.recordAttempt(table, tx, msg, start, 0, nil)
+			succeeded = append(succeeded, msg)
+			handlerLatencies = append(handlerLatencies, handlerLatency)
+			continue
+		}
+		mq.log().Record(func(context.Context) error {
+			return handleErr
+		}, func(f LogFields) {
+			f.With("message", msg)
+			f.With("retryAfter", retryAfter.String())
+			f.With("failStage", FailStageOf(handleErr))
+		})
+		if !canCommit {
+			if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT sqlmq_message"); err != nil {
+				return errs.Trace(err)
+			}
+		}
+		var mark = mq.markFail
+		if _, deferred := asDefer(handleErr); deferred {
+			mark = mq.markDeferred
+		}
+		at := mark(table, tx, msg, retryAfter, false)
+		mq.recordAttempt(table, tx, msg, start, retryAfter, handleErr)
+		if !at.IsZero() && (notifyConsumeAt.IsZero() || at.Before(notifyConsumeAt)) {
+			notifyConsumeAt = at
+		}
+	}
+	return nil
+}
+
+func (mq *SqlMQ) handleInBatch(
+	ctx context.Context, table Table, tx *sql.Tx, msg Message, handlerLatency *time.Duration,
+) (retryAfter time.Duration, canCommit bool, err error) {
+	if mq.Tracer != nil {
+		var end func(time.Duration, error)
+		ctx, end = mq.Tracer.StartSpan(ctx, msg)
+		defer func() {
+			end(retryAfter, err)
+		}()
+	}
+	handler, err := mq.handlerOf(table, msg)
+	if err != nil {
+		return time.Minute, true, &stageError{stage: FailHandler, error: err}
+	}
+	var start = time.Now()
+	retryAfter, canCommit, err = mq.callHandler(ctx, handler, tx, msg)
+	*handlerLatency = time.Since(start)
+	if mq.Metrics != nil {
+		mq.Metrics.Handled(msg.QueueName(), *handlerLatency, err)
+	}
+	mq.recordBreaker(msg.QueueName(), err)
+	if err == nil {
+		if err = table.MarkSuccess(tx, msg); err != nil {
+			return 0, false, &stageError{stage: FailMark, error: err}
+		}
+		return 0, true, nil
+	}
+	return mq.retryAfter(msg, retryAfter, err), canCommit, &stageError{stage: FailHandler, error: err}
+}
+
+// call handler with its timeout, and convert a panic into an error, so a panicking handler is
+// treated like a failed one: the transaction is rollbacked, and the message is retried after one minute.
+func (mq *SqlMQ) callHandler(ctx context.Context, handler Handler, tx *sql.Tx, msg Message) (
+	retryAfter time.Duration, canCommit bool, err error,
+) {
+	defer func() {
+		if p := recover(); p != nil {
+			retryAfter, canCommit, err = time.Minute, false, errs.Tracef("handler panic: %v", p)
+		}
+	}()
+	if timeout := mq.handlerTimeout(msg.QueueName()); timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		defer func() {
+			if err == nil && ctx.Err() == context.DeadlineExceeded {
+				retryAfter, canCommit = 0, false
+				err = errs.Tracef("handler exceeded timeout %v", timeout)
+			}
+		}()
+	}
+	return handler(ctx, tx, msg)
+}
+
+// report messages whose transaction is rollbacked for exceeding TxTimeout.
+func (mq *SqlMQ) txTimedOut(msgs ...Message) {
+	var timeout = mq.txTimeout()
+	for _, msg := range msgs {
+		if mq.OnTxTimeout != nil {
+			mq.OnTxTimeout(msg, timeout)
+			continue
+		}
+		mq.log().Record(func(context.Context) error {
+			return fmt.Errorf(
+				"handler exceeded TxTimeout of %v, the transaction is rollbacked, message retried",
+				timeout,
+			)
+		}, func(f LogFields) {
+			f.With("queue", msg.QueueName())
+			f.With("message", msg)
+		})
+	}
+}
+
+func (mq *SqlMQ) handlerTimeout(queue string) time.Duration {
+	if timeout, ok := mq.HandlerTimeouts[queue]; ok {
+		return timeout
+	}
+	return mq.HandlerTimeout
+}
+
 func (mq *SqlMQ) markFail(
-	db DBOrTx, msg Message, retryAfter time.Duration, notifyConsume bool,
+	table Table, db DBOrTx, msg Message, retryAfter time.Duration, notifyConsume bool,
 ) time.Time {
-	if retryAfter >= 0 {
-		if err := mq.Table.MarkRetry(db, msg, retryAfter); err != nil {
-			mq.Logger.Error(err)
-		} else if notifyConsume {
+	if retryAfter >= 0 && !mq.retriesExhausted(msg) {
+		if err := table.MarkRetry(db, msg, retryAfter); err != nil {
+			mq.log().Error(err)
+			return time.Time{}
+		}
+		if mq.Metrics != nil {
+			mq.Metrics.Retried(msg.QueueName(), retryAfter)
+		}
+		if mq.OnRetry != nil {
+			mq.OnRetry(msg, retryAfter)
+		}
+		if triedCount := triedCount(msg) + 1; mq.OnPoison != nil &&
+			mq.PoisonThreshold > 0 && triedCount == mq.PoisonThreshold {
+			mq.OnPoison(msg, triedCount)
+		}
+		if notifyConsume {
 			mq.NotifyConsumeAt(time.Now().Add(retryAfter), "retry") // must be after released lock.
 		} else {
 			return time.Now().Add(retryAfter)
 		}
 	} else {
-		if err := mq.Table.MarkGivenUp(db, msg); err != nil {
-			mq.Logger.Error(err)
+		if err := table.MarkGivenUp(db, msg); err != nil {
+			mq.log().Error(err)
+			return time.Time{}
+		}
+		if mq.Metrics != nil {
+			mq.Metrics.GivenUp(msg.QueueName())
+		}
+		if mq.OnGivenUp != nil {
+			mq.OnGivenUp(msg)
+		}
+		if mq.DeadLetterQueue != "" {
+			if err := mq.produceDeadLetter(table, db, msg); err != nil {
+				mq.log().Error(err)
+			} else if notifyConsume {
+				mq.NotifyConsumeAt(time.Now(), "dead letter")
+			} else {
+				return time.Now()
+			}
 		}
 	}
 	return time.Time{}
 }
 
-func (mq *SqlMQ) beginTx() (*sql.Tx, func(), error) {
-	txTimeout := mq.TxTimeout
-	if txTimeout <= 0 {
-		txTimeout = time.Minute
+// markDeferred reschedule a deferred message, without counting it as a try if the table is a
+// DeferTable. It returns the time to notify the consuming loop like markFail.
+func (mq *SqlMQ) markDeferred(
+	table Table, db DBOrTx, msg Message, retryAfter time.Duration, notifyConsume bool,
+) time.Time {
+	var err error
+	if t, ok := table.(DeferTable); ok {
+		err = t.MarkDeferred(db, msg, retryAfter)
+	} else {
+		err = table.MarkRetry(db, msg, retryAfter)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), txTimeout)
-	tx, err := mq.DB.BeginTx(ctx, nil)
 	if err != nil {
-		cancel()
+		mq.log().Error(err)
+		return time.Time{}
+	}
+	if notifyConsume {
+		mq.NotifyConsumeAt(time.Now().Add(retryAfter), "deferred") // must be after released lock.
+		return time.Time{}
+	}
+	return time.Now().Add(retryAfter)
+}
+
+// DeadLetter is the data of messages produced into SqlMQ.DeadLetterQueue.
+type DeadLetter struct {
+	Id    int64       // id of the given up message.
+	UUID  string      `json:",omitempty"` // uuid of the given up message, see StdTableOptions.UUID.
+	Queue string      // queue of the given up message.
+	Data  interface{} // data of the given up message.
+}
+
+func (mq *SqlMQ) produceDeadLetter(table Table, db DBOrTx, msg Message) error {
+	m, ok := msg.(*StdMessage)
+	if !ok {
+		return fmt.Errorf("can't produce dead letter for message of type %T", msg)
+	}
+	var data = m.Data
+	if b, ok := data.([]byte); ok {
+		data = json.RawMessage(b)
+	}
+	return table.ProduceMessage(db, &StdMessage{
+		Queue: mq.DeadLetterQueue,
+		Data:  DeadLetter{Id: m.Id, UUID: m.UUID, Queue: m.Queue, Data: data},
+	})
+}
+
+// The message has been retried MaxRetries times.
+func (mq *SqlMQ) retriesExhausted(msg Message) bool {
+	return mq.MaxRetries > 0 && triedCount(msg) >= mq.MaxRetries
+}
+
+func (mq *SqlMQ) reapStale(ctx context.Context) {
+	olderThan := mq.ReapStaleAfter
+	if olderThan <= 0 {
+		olderThan = 2 * mq.txTimeout()
+	}
+	for ctx.Err() == nil {
+		for _, table := range mq.allTables() {
+			if table, ok := table.(ClaimTable); ok && table.ClaimsByUpdate() {
+				if n, err := table.ReapStale(mq.DB, olderThan); err != nil {
+					mq.log().Error(err)
+				} else if n > 0 {
+					mq.NotifyConsumeAt(time.Now(), "stale reaped")
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(mq.ReapInterval):
+		}
+	}
+}
+
+func (mq *SqlMQ) beginTx() (*sql.Tx, *txLease, error) {
+	if mq.AcquireTimeout > 0 {
+		return mq.acquireAndBeginTx()
+	}
+	lease := newTxLease(mq.txTimeout())
+	tx, err := mq.DB.BeginTx(lease, mq.TxOptions)
+	if err != nil {
+		lease.end()
 		return nil, nil, err
 	}
-	return tx, cancel, err
+	return tx, lease, err
 }
 
+// acquire a connection from the pool within AcquireTimeout, then begin a transaction on it.
+// The connection is returned to the pool when the lease ends.
+func (mq *SqlMQ) acquireAndBeginTx() (*sql.Tx, *txLease, error) {
+	acquireCtx, acquireCancel := context.WithTimeout(context.Background(), mq.AcquireTimeout)
+	conn, err := mq.DB.Conn(acquireCtx)
+	acquireCancel()
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return nil, nil, &sentinelError{sentinel: ErrAcquireTimeout, cause: err}
+		}
+		return nil, nil, err
+	}
+	lease := newTxLease(mq.txTimeout())
+	lease.release = func() {
+		conn.Close() // return the connection to the pool.
+	}
+	tx, err := conn.BeginTx(lease, mq.TxOptions)
+	if err != nil {
+		lease.end()
+		return nil, nil, err
+	}
+	return tx, lease, nil
+}
+
+func (mq *SqlMQ) txTimeout() time.Duration {
+	if mq.TxTimeout <= 0 {
+		return time.Minute
+	}
+	return mq.TxTimeout
+}
+
+// getWaitTime return the idle wait and error wait of the consuming loop, they are the shortest
+// waits of the registered queues not paused, see SqlMQ.IdleWaits.
 func (mq *SqlMQ) getWaitTime() (idleWait, errorWait time.Duration) {
-	idleWait, errorWait = mq.IdleWait, mq.ErrorWait
-	if idleWait <= 0 {
-		idleWait = time.Minute
+	return mq.queuesWait(mq.IdleWait, mq.IdleWaits), mq.queuesWait(mq.ErrorWait, mq.ErrorWaits)
+}
+
+func (mq *SqlMQ) queuesWait(defaultWait time.Duration, waits map[string]time.Duration) time.Duration {
+	if defaultWait <= 0 {
+		defaultWait = time.Minute
 	}
-	if errorWait <= 0 {
-		errorWait = time.Minute
+	if len(waits) == 0 {
+		return defaultWait
 	}
-	return
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	var wait time.Duration = -1
+	if mq.defaultHandler != nil {
+		wait = defaultWait
+	}
+	for _, queue := range mq.handledQueues() {
+		if mq.paused[queue] {
+			continue
+		}
+		queueWait, ok := waits[queue]
+		if !ok || queueWait <= 0 {
+			queueWait = defaultWait
+		}
+		if wait < 0 || queueWait < wait {
+			wait = queueWait
+		}
+	}
+	if wait < 0 {
+		return defaultWait
+	}
+	return wait
 }
 
 func (mq *SqlMQ) concurrencyLimit() chan struct{} {
@@ -193,19 +1146,86 @@ func (mq *SqlMQ) concurrencyLimit() chan struct{} {
 	return mq.consumeConcurrency
 }
 
-func (mq *SqlMQ) clean() {
-	for {
-		var cleaned int64
-		var err error
-		mq.Logger.Record(func(ctx context.Context) error {
-			cleaned, err = mq.Table.CleanMessages(mq.DB)
+// clean the tables at CleanInterval or by CleanSchedule until ctx is done.
+func (mq *SqlMQ) clean(ctx context.Context) {
+	var running sync.WaitGroup
+	var cleaning int32
+	var start = func() {
+		if !atomic.CompareAndSwapInt32(&cleaning, 0, 1) {
+			mq.log().Info("skip cleaning, the previous cleaning is still running.")
+			return
+		}
+		running.Add(1)
+		go func() {
+			for _, table := range mq.allTables() {
+				mq.cleanTable(table)
+			}
+			atomic.StoreInt32(&cleaning, 0)
+			running.Done()
+		}()
+	}
+
+	if mq.CleanSchedule != nil {
+		for ctx.Err() == nil {
+			timer := time.NewTimer(time.Until(mq.CleanSchedule(time.Now())))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+				start()
+			}
+		}
+	} else {
+		start()
+		ticker := time.NewTicker(mq.CleanInterval)
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+				start()
+			}
+		}
+		ticker.Stop()
+	}
+	running.Wait()
+}
+
+// DailyAt return a SqlMQ.CleanSchedule to clean at hour:minute of local time every day.
+func DailyAt(hour, minute int) func(now time.Time) time.Time {
+	return func(now time.Time) time.Time {
+		next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next
+	}
+}
+
+func (mq *SqlMQ) cleanTable(table Table) {
+	if t, ok := table.(ExpireTable); ok {
+		var expired int64
+		mq.log().Record(func(ctx context.Context) (err error) {
+			expired, err = t.ExpireMessages(mq.DB)
 			return err
-		}, nil, func(f *logger.Fields) {
-			f.With("table name", mq.Table.Name())
-			f.With("cleaned", cleaned)
+		}, func(f LogFields) {
+			f.With("table name", table.Name())
+			f.With("expired", expired)
 		})
-		time.Sleep(mq.CleanInterval)
 	}
+	var cleaned interface{}
+	mq.log().Record(func(ctx context.Context) (err error) {
+		if t, ok := table.(interface {
+			CleanMessagesByStatus(*sql.DB) (map[string]int64, error)
+		}); ok {
+			cleaned, err = t.CleanMessagesByStatus(mq.DB)
+		} else {
+			cleaned, err = table.CleanMessages(mq.DB)
+		}
+		return err
+	}, func(f LogFields) {
+		f.With("table name", table.Name())
+		f.With("cleaned", cleaned)
+	})
 }
 
 func logf(msg string, args ...interface{}) {
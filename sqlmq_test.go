@@ -5,8 +5,13 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lovego/logger"
@@ -20,6 +25,81 @@ func ExampleSqlMQ_Register() {
 	// queue test3 already registered
 }
 
+func ExampleSqlMQ_RegisterType() {
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0)}
+	var typeHandler = func(typ string) Handler {
+		return func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+			fmt.Println("handle", typ)
+			return 0, false, nil
+		}
+	}
+	fmt.Println(mq.RegisterType("events", "created", typeHandler("created")))
+	fmt.Println(mq.RegisterType("events", "deleted", typeHandler("deleted")))
+	fmt.Println(mq.RegisterType("events", "deleted", typeHandler("deleted")))
+	fmt.Println(mq.RegisterType("events", "", typeHandler("")))
+	fmt.Println(mq.Queues(), mq.HasHandler("events"))
+
+	for _, typ := range []string{"created", "deleted", "updated", ""} {
+		_, err := mq.handlerOf(mq.Table, &StdMessage{Queue: "events", Type: typ})
+		fmt.Println(err, errors.Is(err, ErrNoHandler))
+	}
+	// the handler registered for the queue handles the other types.
+	mq.SetDefaultHandler(typeHandler("default"))
+	fmt.Println(mq.Register("events", typeHandler("queue")))
+	for _, typ := range []string{"created", "updated", ""} {
+		msg := &StdMessage{Queue: "events", Type: typ}
+		handler, err := mq.handlerOf(mq.Table, msg)
+		if err != nil {
+			panic(err)
+		}
+		handler(context.Background(), nil, msg)
+	}
+	// Output:
+	// <nil>
+	// <nil>
+	// type deleted of queue events already registered
+	// message type must not be empty
+	// [events] true
+	// <nil> false
+	// <nil> false
+	// unknown type updated of queue: events true
+	// message without type in queue: events true
+	// <nil>
+	// handle created
+	// handle queue
+	// handle queue
+}
+
+func ExampleSqlMQ_Subscribe() {
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0)}
+	if err := mq.Subscribe("subscribe", func(ctx context.Context, payload json.RawMessage) error {
+		fmt.Println(string(payload))
+		if string(payload) == `"fail"` {
+			return errors.New("failed")
+		}
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	msg := &StdMessage{Queue: "subscribe", Data: []byte(`{"name":"sqlmq"}`)}
+	handler, err := mq.handlerOf(mq.Table, msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(handler(context.Background(), nil, msg))
+	msg.Data = []byte(`"fail"`)
+	fmt.Println(handler(context.Background(), nil, msg))
+	msg.Data = []byte(`not json`)
+	retryAfter, canCommit, err := handler(context.Background(), nil, msg)
+	fmt.Println(retryAfter, canCommit, err != nil)
+	// Output:
+	// {"name":"sqlmq"}
+	// 0s false <nil>
+	// "fail"
+	// 1s false failed
+	// -1ns true true
+}
+
 func ExampleSqlMQ_Produce() {
 	fmt.Println(testMQ.Produce(nil, &StdMessage{Queue: "test2"}))
 
@@ -41,16 +121,180 @@ func ExampleSqlMQ_Produce() {
 
 	fmt.Println(testMQ.Produce(tx, &StdMessage{Queue: "test2", Data: make(chan int)}))
 
+	var msg = &StdMessage{Queue: "test2"}
+	if err := testMQ.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.Id > 0)
+
 	// Output:
 	// unknown queue: test2
 	// <nil>
 	// json: unsupported type: chan int
+	// true
+}
+
+func ExampleSqlMQ_ProduceDelayed() {
+	var mq = recreateSqlMQ()
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	mq.sleep.ClearAwakeAt()
+	if err := mq.ProduceDelayed(nil, &StdMessage{Queue: "test"}, time.Hour); err != nil {
+		panic(err)
+	}
+	fmt.Println(time.Until(mq.sleep.GetAwakeAt()).Round(time.Minute))
+	if err := mq.ProduceDelayed(nil, &StdMessage{Queue: "test"}, time.Minute); err != nil {
+		panic(err)
+	}
+	fmt.Println(time.Until(mq.sleep.GetAwakeAt()).Round(time.Minute))
+	if err := mq.ProduceDelayed(nil, &StdMessage{Queue: "test"}, 2*time.Hour); err != nil {
+		panic(err)
+	}
+	fmt.Println(time.Until(mq.sleep.GetAwakeAt()).Round(time.Minute))
+	fmt.Println(mq.consume(context.Background(), 2*time.Hour, time.Hour).Round(time.Minute))
+	// Output:
+	// 1h0m0s
+	// 1m0s
+	// 1m0s
+	// 1m0s
+}
+
+func ExampleSqlMQ_Requeue() {
+	var mq = recreateSqlMQ()
+	var msg = &StdMessage{Queue: "test", Status: StatusGivenUp, TriedCount: 3}
+	if err := mq.Table.ProduceMessage(mq.DB, msg); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.Requeue(msg.Id, true))
+	fmt.Println(mq.Requeue(msg.Id, true))
+	fmt.Println(mq.Requeue(msg.Id+1, true))
+
+	var status string
+	var triedCount int
+	if err := mq.DB.QueryRow(
+		`SELECT status, tried_count FROM sqlmq WHERE id = $1`, msg.Id,
+	).Scan(&status, &triedCount); err != nil {
+		panic(err)
+	}
+	fmt.Println(status, triedCount)
+	// Output:
+	// <nil>
+	// <nil>
+	// message 2 not found
+	// waiting 0
+}
+
+func ExampleSqlMQ_Requeue_processing() {
+	var mq = recreateSqlMQ()
+	// a message claimed by ClaimByUpdate and being handled by a consumer.
+	var msg = &StdMessage{Queue: "test", Status: StatusProcessing}
+	if err := mq.Table.ProduceMessage(mq.DB, msg); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.Requeue(msg.Id, true))
+	fmt.Println(mq.RequeueWhere("test", "", time.Time{}))
+
+	var status string
+	if err := mq.DB.QueryRow(
+		`SELECT status FROM sqlmq WHERE id = $1`, msg.Id,
+	).Scan(&status); err != nil {
+		panic(err)
+	}
+	fmt.Println(status)
+	// Output:
+	// message 1 is being consumed
+	// 0 <nil>
+	// processing
+}
+
+func ExampleSqlMQ_RequeueWhere() {
+	var mq = recreateSqlMQ()
+	var now = time.Now()
+	for _, msg := range []*StdMessage{
+		{Queue: "a", Status: StatusGivenUp, RetryAt: now.Add(-time.Hour)},
+		{Queue: "a", Status: StatusGivenUp, RetryAt: now.Add(time.Hour)},
+		{Queue: "a", Status: StatusDone, RetryAt: now.Add(-time.Hour)},
+		{Queue: "b", Status: StatusGivenUp, RetryAt: now.Add(-time.Hour)},
+	} {
+		if err := mq.Table.ProduceMessage(mq.DB, msg); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.RequeueWhere("", "", time.Time{}))
+	fmt.Println(mq.RequeueWhere("a", StatusGivenUp, now))
+	fmt.Println(mq.RequeueWhere("", StatusGivenUp, time.Time{}))
+	// Output:
+	// 0 RequeueWhere: queue and status must not be both empty
+	// 1 <nil>
+	// 2 <nil>
 }
 
 func noopHandler(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
 	return 0, true, nil
 }
 
+func ExampleSqlMQ_PauseQueue() {
+	var mq = recreateSqlMQ()
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.PauseQueue("test"))
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	var earliest = func() Message {
+		tx, err := mq.DB.Begin()
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback()
+		msg, err := mq.Table.EarliestMessage(tx)
+		if err != nil {
+			panic(err)
+		}
+		return msg
+	}
+	fmt.Println(earliest() == nil)
+	fmt.Println(mq.ResumeQueue("test"))
+	fmt.Println(earliest().GetId() == msg.Id)
+	// Output:
+	// <nil>
+	// true
+	// <nil>
+	// true
+}
+
+func ExampleSqlMQ_IdleWaits() {
+	var mq = &SqlMQ{
+		Table:     &pausableMockTable{MockTable: NewMockTable("mock", 0)},
+		IdleWaits: map[string]time.Duration{"hot": time.Second, "cold": 5 * time.Minute},
+		ErrorWait: 10 * time.Second, ErrorWaits: map[string]time.Duration{"cold": time.Hour},
+	}
+	fmt.Println(mq.getWaitTime())
+	if err := mq.Register("cold", noopHandler); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.getWaitTime())
+	if err := mq.Register("hot", noopHandler); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.getWaitTime())
+	if err := mq.PauseQueue("hot"); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.getWaitTime())
+	mq.SetDefaultHandler(noopHandler)
+	fmt.Println(mq.getWaitTime())
+	// Output:
+	// 1m0s 10s
+	// 5m0s 1h0m0s
+	// 1s 10s
+	// 5m0s 1h0m0s
+	// 1m0s 10s
+}
+
 func ExampleSqlMQ_validate() {
 	var mq SqlMQ
 	fmt.Println(mq.validate())
@@ -58,10 +302,36 @@ func ExampleSqlMQ_validate() {
 	fmt.Println(mq.validate())
 	mq.Table = testMQ.Table
 	fmt.Println(mq.validate())
+	// no DB is needed if all the tables are in memory.
+	fmt.Println((&SqlMQ{Table: NewMockTable("mock", 0)}).validate())
 	// Output:
 	// SqlMQ.DB must not be nil
 	// SqlMQ.Table must not be nil
 	// <nil>
+	// <nil>
+}
+
+func ExampleSqlMQ_MissingHandlers() {
+	var mq = recreateSqlMQ()
+	mq.CheckHandlers = true
+	if err := mq.Register("a", noopHandler); err != nil {
+		panic(err)
+	}
+	for _, queue := range []string{"a", "c", "b"} {
+		if err := mq.Table.ProduceMessage(mq.DB, &StdMessage{Queue: queue}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.MissingHandlers())
+	fmt.Println(mq.validate())
+	mq.SetDefaultHandler(noopHandler)
+	fmt.Println(mq.MissingHandlers())
+	fmt.Println(mq.validate())
+	// Output:
+	// [b c] <nil>
+	// no handler registered for queues: b, c
+	// [] <nil>
+	// <nil>
 }
 
 func ExampleSqlMQ_Consume_panic() {
@@ -81,44 +351,1172 @@ func ExampleSqlMQ_Consume() {
 	// Output:
 }
 
+func ExampleSqlMQ_ConsumeContext() {
+	var mq = getSqlMQ()
+	ctx, cancel := context.WithCancel(context.Background())
+	var done = make(chan struct{})
+	go func() {
+		mq.ConsumeContext(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+	mq.ConsumeContext(ctx) // return immediately when ctx is done.
+	fmt.Println("stopped")
+	// Output:
+	// stopped
+}
+
+func ExampleSqlMQ_NotifyConsumeAt() {
+	var mq = recreateSqlMQ()
+	var consumed = make(chan struct{})
+	mq.OnSuccess = func(msg Message) { close(consumed) }
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	// produce and notify before Consume starts.
+	if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	mq.NotifyConsumeAt(time.Now(), "before consume")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go mq.ConsumeContext(ctx)
+	select {
+	case <-consumed:
+		fmt.Println("consumed")
+	case <-time.After(5 * time.Second):
+		fmt.Println("timeout")
+	}
+	cancel()
+	// Output:
+	// consumed
+}
+
+// run with -race to check that triggers arriving while consuming are not lost.
+func ExampleSqlMQ_TriggerConsume() {
+	var mq = recreateSqlMQ()
+	mq.IdleWait = time.Hour
+	var consumed int32
+	var done = make(chan struct{})
+	mq.OnSuccess = func(msg Message) {
+		if atomic.AddInt32(&consumed, 1) == 100 {
+			close(done)
+		}
+	}
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go mq.ConsumeContext(ctx)
+	time.Sleep(100 * time.Millisecond) // the consuming loop is sleeping for IdleWait.
+
+	var producing sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		producing.Add(1)
+		go func() {
+			defer producing.Done()
+			// produce without notification, like other processes do.
+			if err := mq.Table.ProduceMessage(testDB, &StdMessage{Queue: "test"}); err != nil {
+				panic(err)
+			}
+			mq.TriggerConsume()
+		}()
+	}
+	producing.Wait()
+	select {
+	case <-done:
+		fmt.Println("consumed", atomic.LoadInt32(&consumed))
+	case <-time.After(10 * time.Second):
+		fmt.Println("timeout", atomic.LoadInt32(&consumed))
+	}
+	cancel()
+	// Output:
+	// consumed 100
+}
+
+// run with -race to check that queues can be changed safely while consuming.
+func ExampleSqlMQ_Register_consuming() {
+	var mq = recreateSqlMQ()
+	mq.IdleWait = time.Hour
+	var consumed = make(chan string, 10)
+	mq.OnSuccess = func(msg Message) { consumed <- msg.QueueName() }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var done = make(chan struct{})
+	go func() {
+		mq.ConsumeContext(ctx)
+		close(done)
+	}()
+	var flipping = make(chan struct{})
+	go func() {
+		defer close(flipping)
+		table := mq.Table.(*StdTable)
+		for ctx.Err() == nil {
+			table.SetQueues([]string{"x"})
+			table.SetPausedQueues([]string{"y"})
+			table.SetPausedQueues(nil)
+			mq.TriggerConsume()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for _, queue := range []string{"a", "b", "c"} {
+		if err := mq.Register(queue, noopHandler); err != nil {
+			panic(err)
+		}
+		// produced as by another process, without notification.
+		if err := mq.Table.ProduceMessage(testDB, &StdMessage{Queue: queue}); err != nil {
+			panic(err)
+		}
+		mq.TriggerConsume()
+		select {
+		case q := <-consumed:
+			fmt.Println(q)
+		case <-time.After(5 * time.Second):
+			fmt.Println("timeout")
+		}
+	}
+	fmt.Println(mq.Queues())
+	cancel()
+	<-flipping
+	<-done
+	// Output:
+	// a
+	// b
+	// c
+	// [a b c]
+}
+
+func ExampleSqlMQ_ConsumeConcurrency() {
+	var mq = recreateSqlMQ()
+	mq.ConsumeConcurrency = 3
+	var running, maxRunning int32
+	if err := mq.Register("concurrency", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return 0, true, nil
+	}); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "concurrency"}); err != nil {
+			panic(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	mq.ConsumeContext(ctx)
+	fmt.Println(atomic.LoadInt32(&maxRunning))
+	// Output:
+	// 3
+}
+
+func ExampleSqlMQ_Concurrency() {
+	// 3 workers fetch and handle messages in their own consuming loops.
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0), Concurrency: 3, ConsumeConcurrency: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	var handled = make(map[int64]int)
+	var running, maxRunning int32
+	var mutex sync.Mutex
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		n := atomic.AddInt32(&running, 1)
+		mutex.Lock()
+		if handled[msg.GetId()]++; len(handled) == 6 {
+			cancel()
+		}
+		if n > maxRunning {
+			maxRunning = n
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	mq.ConsumeContext(ctx)
+	var twice int
+	for _, n := range handled {
+		if n > 1 {
+			twice++
+		}
+	}
+	fmt.Println(len(handled), twice, maxRunning)
+	// Output:
+	// 6 0 3
+}
+
 func ExampleSqlMQ_consume() {
 	var mq = recreateSqlMQ()
 	if err := mq.Register("test3", noopHandler); err != nil {
 		panic(err)
 	}
+	wait, reason := mq.LastWait()
+	fmt.Println(wait, reason == "")
 	mq.TxTimeout = time.Nanosecond // set smallest time to make it timeout
-	fmt.Println(mq.consume(2*time.Minute, 3*time.Minute))
+	fmt.Println(mq.consume(context.Background(), 2*time.Minute, 3*time.Minute))
+	fmt.Println(mq.LastWait())
 	mq.TxTimeout = 0
 
-	fmt.Println(mq.consume(2*time.Minute, 3*time.Minute))
+	fmt.Println(mq.consume(context.Background(), 2*time.Minute, 3*time.Minute))
+	fmt.Println(mq.LastWait())
 
 	mq.Produce(nil, &StdMessage{Queue: "test3", RetryAt: time.Now().Add(time.Hour)})
-	fmt.Println(mq.consume(2*time.Minute, 3*time.Minute))
+	fmt.Println(mq.consume(context.Background(), 2*time.Minute, 3*time.Minute))
+	fmt.Println(mq.LastWait())
 
 	// Output:
+	// 0s true
 	// 3m0s
+	// 3m0s error
 	// 2m0s
+	// 2m0s idle
 	// 2m0s
+	// 2m0s message
+}
+
+func ExampleSqlMQ_AddTable() {
+	var mq = recreateSqlMQ()
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS sqlmq_tenant"); err != nil {
+		panic(err)
+	}
+	var tenant = NewStdTable(testDB, "sqlmq_tenant", time.Hour)
+	mq.AddTable(tenant)
+	var handled = make(chan string, 2)
+	var handler = func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+		handled <- TableOf(ctx).Name() + ":" + string(msg.(*StdMessage).Data.([]byte))
+		return 0, true, nil
+	}
+	if err := mq.Register("test", handler); err != nil {
+		panic(err)
+	}
+	if err := mq.RegisterOn(tenant, "tenant_test", handler); err != nil {
+		panic(err)
+	}
+	// messages are produced into the table of their queues.
+	if err := mq.Produce(nil, &StdMessage{Queue: "test", Data: "default"}); err != nil {
+		panic(err)
+	}
+	if err := mq.Produce(nil, &StdMessage{Queue: "tenant_test", Data: "tenant"}); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.consume(context.Background(), time.Minute, time.Minute))
+	var data = []string{<-handled, <-handled}
+	sort.Strings(data)
+	fmt.Println(data)
+	// Output:
+	// 1m0s
+	// [sqlmq:"default" sqlmq_tenant:"tenant"]
+}
+
+func ExampleTableOf() {
+	var mq = &SqlMQ{DB: testDB, Table: NewMockTable("mock", 0), NoHandlerTx: true}
+	var tenant = NewMockTable("tenant", 0)
+	mq.AddTable(tenant)
+	if err := mq.RegisterOn(tenant, "test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		fmt.Println(TableOf(ctx).Name())
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := tenant.ProduceMessage(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	fmt.Println(TableOf(context.Background()))
+	// Output:
+	// tenant
+	// true 0s <nil>
+	// <nil>
+}
+
+func ExampleSqlMQ_RegisterOn() {
+	var mq = &SqlMQ{Table: NewMockTable("default", 0)}
+	var tenant = NewMockTable("tenant", 0)
+	mq.AddTable(tenant)
+	var handler = func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+		fmt.Println("handled", msg.QueueName(), "of", TableOf(ctx).Name())
+		return 0, false, nil
+	}
+	fmt.Println(mq.RegisterOn(NewMockTable("other", 0), "orders", handler))
+	fmt.Println(mq.Register("orders", handler))
+	fmt.Println(mq.RegisterOn(tenant, "reports", handler))
+	fmt.Println(mq.RegisterOn(tenant, "orders", handler))
+	fmt.Println(mq.TableOf("orders").Name(), mq.TableOf("reports").Name())
+
+	for _, queue := range []string{"orders", "reports"} {
+		if err := mq.Produce(nil, &StdMessage{Queue: queue}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(len(mq.Table.(*MockTable).Messages()), len(tenant.Messages()))
+	// a message of the queue of another table has no handler.
+	if err := mq.Table.ProduceMessage(nil, &StdMessage{Queue: "reports"}); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := mq.ConsumeOnce(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+	for _, msg := range mq.Table.(*MockTable).Messages() {
+		fmt.Println(msg.Queue, msg.Status)
+	}
+	// Output:
+	// table other is not added
+	// <nil>
+	// <nil>
+	// queue orders already registered
+	// default tenant
+	// 1 1
+	// handled orders of default
+	// handled reports of tenant
+	// orders done
+	// reports waiting
+}
+
+func ExampleSqlMQ_BatchSize() {
+	var mq = recreateSqlMQ()
+	mq.BatchSize = 10
+	var consumed = make(chan string, 3)
+	mq.OnSuccess = func(msg Message) {
+		consumed <- string(msg.(*StdMessage).Data.([]byte))
+	}
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		var data string
+		if err := msg.(*StdMessage).DataInto(&data); err != nil {
+			return 0, false, err
+		}
+		if _, err := tx.Exec(`UPDATE sqlmq SET queue = 'changed' WHERE id = $1`, msg.GetId()); err != nil {
+			return 0, false, err
+		}
+		if data == "fail" {
+			return time.Hour, false, errors.New("failed")
+		}
+		return 0, true, nil
+	}); err != nil {
+		panic(err)
+	}
+	for _, data := range []string{"a", "fail", "b"} {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test", Data: data}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.consume(context.Background(), time.Minute, time.Minute))
+	fmt.Println(<-consumed, <-consumed)
+
+	rows, err := mq.DB.Query(`SELECT queue, status, tried_count FROM sqlmq ORDER BY id`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var queue, status string
+		var triedCount int
+		if err := rows.Scan(&queue, &status, &triedCount); err != nil {
+			panic(err)
+		}
+		fmt.Println(queue, status, triedCount)
+	}
+	// Output:
+	// 1m0s
+	// "a" "b"
+	// changed done 1
+	// test waiting 1
+	// changed done 1
 }
 
 func ExampleSqlMQ_handle() {
 	var mq = getSqlMQ()
-	tx, cancel, err := mq.beginTx()
+	tx, lease, err := mq.beginTx()
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println(mq.handle(context.Background(), cancel, tx, &StdMessage{Queue: "test"}))
+	fmt.Println(mq.handle(context.Background(), lease, mq.Table, tx, &StdMessage{Queue: "test"}))
 
 	// Output:
 	// 1m0s unknown queue: test
 }
 
+func ExampleSqlMQ_handle_backoff() {
+	var mq = recreateSqlMQ()
+	mq.BackoffFunc = RetryWait{Waits: []time.Duration{time.Second, time.Minute}}.Get
+	if err := mq.Register("test", failHandler); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test", TriedCount: 1}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.handle(context.Background(), lease, mq.Table, tx, msg))
+
+	// Output:
+	// 1m0s error happened
+}
+
+func ExampleRetryAt() {
+	var mq = recreateSqlMQ()
+	var at = time.Now().Add(3 * time.Hour)
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		return -1, true, RetryAt(at, errors.New("not business hour"))
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	_, err = mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	fmt.Println(err)
+
+	var status string
+	var retryAt time.Time
+	if err := mq.DB.QueryRow(
+		`SELECT status, retry_at FROM sqlmq WHERE id = $1`, msg.Id,
+	).Scan(&status, &retryAt); err != nil {
+		panic(err)
+	}
+	fmt.Println(status, retryAt.Sub(at).Round(time.Second))
+	fmt.Println(RetryAt(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), nil))
+	// Output:
+	// not business hour
+	// waiting 0s
+	// retry at 2021-01-01T00:00:00Z
+}
+
+func ExampleDefer() {
+	var mq = recreateSqlMQ()
+	mq.MaxRetries = 1
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		return -1, true, Defer(time.Hour)
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test", TriedCount: 1}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	retryAfter, err := mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	fmt.Println(retryAfter, err, FailStageOf(err))
+
+	var status string
+	var triedCount int
+	var retryAt time.Time
+	if err := mq.DB.QueryRow(
+		`SELECT status, tried_count, retry_at FROM sqlmq WHERE id = $1`, msg.Id,
+	).Scan(&status, &triedCount, &retryAt); err != nil {
+		panic(err)
+	}
+	fmt.Println(status, triedCount, time.Until(retryAt).Round(time.Minute))
+	// Output:
+	// 1h0m0s deferred for 1h0m0s handler
+	// waiting 1 1h0m0s
+}
+
+func ExampleSqlMQ_handleTx() {
+	var mq = recreateSqlMQ()
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		if string(msg.(*StdMessage).Data.([]byte)) == `"abort"` {
+			_, err := tx.Exec("SELECT 1/0") // the transaction is aborted.
+			return 0, true, err
+		}
+		return 0, true, errors.New("failed")
+	}); err != nil {
+		panic(err)
+	}
+	for _, data := range []string{"fail", "abort"} {
+		var msg = &StdMessage{Queue: "test", Data: data}
+		if err := mq.Produce(nil, msg); err != nil {
+			panic(err)
+		}
+		tx, lease, err := mq.beginTx()
+		if err != nil {
+			panic(err)
+		}
+		var outcome txOutcome
+		_, err = mq.handleTx(context.Background(), lease, mq.Table, tx, msg, &outcome)
+		fmt.Println(err != nil, outcome.committed, outcome.err)
+	}
+	// Output:
+	// true true <nil>
+	// true false pq: Could not complete operation in a failed transaction
+}
+
+func ExampleSqlMQ_markDeferred() {
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0), BreakerThreshold: 1}
+	if err := mq.Table.ProduceMessage(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	msg, err := mq.Table.EarliestMessage(nil)
+	if err != nil {
+		panic(err)
+	}
+	var err2 = Defer(-time.Second)
+	var retryAfter = mq.retryAfter(msg, time.Hour, err2)
+	fmt.Println(retryAfter, mq.markDeferred(mq.Table, nil, msg, retryAfter, false).IsZero())
+	mq.recordBreaker("test", err2)
+	fmt.Println(mq.BreakerState("test"), mq.Table.(*MockTable).Messages()[0].TriedCount)
+	// Output:
+	// 0s false
+	// closed 0
+}
+
+func failHandler(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+	return 0, true, errors.New("error happened")
+}
+
+func ExampleSqlMQ_retriesExhausted() {
+	var mq SqlMQ
+	fmt.Println(mq.retriesExhausted(&StdMessage{TriedCount: 100}))
+	mq.MaxRetries = 3
+	fmt.Println(mq.retriesExhausted(&StdMessage{TriedCount: 2}))
+	fmt.Println(mq.retriesExhausted(&StdMessage{TriedCount: 3}))
+	// a Message which isn't a TriedMessage is regarded as never tried.
+	fmt.Println(mq.retriesExhausted(struct{ Message }{&StdMessage{TriedCount: 3}}))
+	// Output:
+	// false
+	// false
+	// true
+	// false
+}
+
+func ExampleSqlMQ_markFail_deadLetter() {
+	var mq = recreateSqlMQ()
+	mq.DeadLetterQueue = "dead"
+	var msg = &StdMessage{Queue: "test", Data: map[string]int{"a": 1}}
+	if err := mq.Table.ProduceMessage(mq.DB, msg); err != nil {
+		panic(err)
+	}
+	msg.Data = []byte(`{"a": 1}`)
+	fmt.Println(mq.markFail(mq.Table, mq.DB, msg, -1, false).IsZero())
+
+	var data string
+	if err := mq.DB.QueryRow(
+		`SELECT data FROM sqlmq WHERE queue = 'dead'`,
+	).Scan(&data); err != nil {
+		panic(err)
+	}
+	fmt.Println(data == fmt.Sprintf(`{"Id": %d, "Data": {"a": 1}, "Queue": "test"}`, msg.Id))
+	// Output:
+	// false
+	// true
+}
+
+func ExampleSqlMQ_handle_panic() {
+	var mq = recreateSqlMQ()
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		panic("boom")
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.handle(context.Background(), lease, mq.Table, tx, msg))
+	time.Sleep(200 * time.Millisecond) // wait for markFail goroutine
+
+	var triedCount int
+	var retryAt time.Time
+	if err := mq.DB.QueryRow(
+		`SELECT tried_count, retry_at FROM sqlmq WHERE id = $1`, msg.Id,
+	).Scan(&triedCount, &retryAt); err != nil {
+		panic(err)
+	}
+	fmt.Println(triedCount, time.Until(retryAt).Round(time.Minute))
+	// Output:
+	// 1m0s handler panic: boom
+	// 1 1m0s
+}
+
+func ExampleSqlMQ_OnTxTimeout() {
+	var mq = recreateSqlMQ()
+	mq.TxTimeout = 100 * time.Millisecond
+	mq.OnTxTimeout = func(msg Message, timeout time.Duration) {
+		fmt.Println(msg.QueueName(), timeout)
+	}
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		time.Sleep(200 * time.Millisecond)
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	_, err = mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	fmt.Println(FailStageOf(err))
+	// Output:
+	// test 100ms
+	// mark
+}
+
+func ExampleSqlMQ_callHandler_timeout() {
+	var mq = getSqlMQ()
+	mq.HandlerTimeout = time.Hour
+	mq.HandlerTimeouts = map[string]time.Duration{"slow": 10 * time.Millisecond}
+	var handler = func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+		deadline, _ := ctx.Deadline()
+		if time.Until(deadline) < time.Second {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return 0, true, nil
+	}
+	fmt.Println(mq.callHandler(context.Background(), handler, nil, &StdMessage{Queue: "test"}))
+	fmt.Println(mq.callHandler(context.Background(), handler, nil, &StdMessage{Queue: "slow"}))
+	// Output:
+	// 0s true <nil>
+	// 0s false handler exceeded timeout 10ms
+}
+
+func ExampleSqlMQ_OnSuccess() {
+	var mq = recreateSqlMQ()
+	var events []string
+	mq.OnSuccess = func(msg Message) { events = append(events, "success "+msg.QueueName()) }
+	mq.OnRetry = func(msg Message, retryAfter time.Duration) {
+		events = append(events, "retry "+msg.QueueName()+" "+retryAfter.String())
+	}
+	mq.OnGivenUp = func(msg Message) { events = append(events, "givenUp "+msg.QueueName()) }
+	if err := mq.Register("ok", noopHandler); err != nil {
+		panic(err)
+	}
+	if err := mq.Register("fail", failHandler); err != nil {
+		panic(err)
+	}
+	var msgs = []*StdMessage{{Queue: "ok"}, {Queue: "fail"}}
+	for _, msg := range msgs {
+		if err := mq.Produce(nil, msg); err != nil {
+			panic(err)
+		}
+		tx, lease, err := mq.beginTx()
+		if err != nil {
+			panic(err)
+		}
+		mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	}
+	mq.markFail(mq.Table, mq.DB, msgs[1], -1, false)
+	fmt.Println(strings.Join(events, "\n"))
+	// Output:
+	// success ok
+	// retry fail 0s
+	// givenUp fail
+}
+
+func ExampleSqlMQ_OnConsumed() {
+	var mq = recreateSqlMQ()
+	mq.OnConsumed = func(msg Message, latency, handlerLatency time.Duration) {
+		fmt.Println(msg.QueueName(), latency.Round(time.Hour), handlerLatency.Round(time.Hour))
+	}
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test", CreatedAt: time.Now().Add(-time.Hour)}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.handle(context.Background(), lease, mq.Table, tx, msg))
+	// Output:
+	// test 1h0m0s 0s
+	// 0s <nil>
+}
+
+func ExampleSqlMQ_checkLag() {
+	var mq = getSqlMQ()
+	var buf bytes.Buffer
+	mq.Logger = logger.New(&buf)
+	mq.checkLag(&StdMessage{Queue: "test", RetryAt: time.Now().Add(-time.Hour)})
+	fmt.Println(buf.Len())
+
+	mq.MaxLag = time.Minute
+	mq.checkLag(&StdMessage{Queue: "test", RetryAt: time.Now()})
+	mq.checkLag(&StdMessage{Queue: "test", RetryAt: time.Now().Add(-time.Hour)})
+	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"msg":"consume lag exceeded"`)))
+
+	mq.OnLag = func(msg Message, lag time.Duration) {
+		fmt.Println(msg.QueueName(), lag.Round(time.Hour))
+	}
+	mq.checkLag(&StdMessage{Queue: "test", RetryAt: time.Now().Add(-time.Hour)})
+	// Output:
+	// 0
+	// true
+	// test 1h0m0s
+}
+
 func ExampleSqlMQ_markFail() {
 	var mq = getSqlMQ()
 	var buf bytes.Buffer
 	mq.Logger = logger.New(&buf)
-	mq.markFail(mq.DB, &StdMessage{}, -1, false)
+	mq.markFail(mq.Table, mq.DB, &StdMessage{}, -1, false)
 	fmt.Println(bytes.Contains(buf.Bytes(), []byte(`"msg":"affected 0 rows"`)))
 	// Output:
 	// true
 }
+
+func ExampleSqlMQ_ConsumeOnce() {
+	var mq = recreateSqlMQ()
+	var handled []string
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		handled = append(handled, string(msg.(*StdMessage).Data.([]byte)))
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+
+	if err := mq.Produce(nil, &StdMessage{Queue: "test", Data: "now"}); err != nil {
+		panic(err)
+	}
+	if err := mq.Produce(nil, &StdMessage{
+		Queue: "test", Data: "later", RetryAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	fmt.Println(handled)
+
+	processed, wait, err := mq.ConsumeOnce(context.Background())
+	fmt.Println(processed, wait > 59*time.Minute, err)
+	// Output:
+	// false 1m0s <nil>
+	// true 0s <nil>
+	// ["now"]
+	// false true <nil>
+}
+
+func ExampleSqlMQ_ConsumeOnce_registerType() {
+	var mq = recreateSqlMQ()
+	if err := mq.RegisterType("events", "created", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		fmt.Println("handle", msg.(*StdMessage).Type)
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := mq.Produce(nil, &StdMessage{Queue: "events", Type: "created"}); err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	// Output:
+	// handle created
+	// true 0s <nil>
+}
+
+func ExampleSqlMQ_Drain() {
+	var mq = recreateSqlMQ()
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.Drain(context.Background(), 3))
+	fmt.Println(mq.Drain(context.Background(), 3))
+
+	mq.BatchSize = 10
+	for i := 0; i < 5; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.Drain(context.Background(), 4))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fmt.Println(mq.Drain(ctx, 3))
+	// Output:
+	// 3 <nil>
+	// 2 <nil>
+	// 4 <nil>
+	// 0 context canceled
+}
+
+func ExampleSqlMQ_RetryJitter() {
+	var mq = &SqlMQ{RetryJitter: time.Second}
+	var err = errors.New("error happened")
+	var min, max = time.Hour, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := mq.retryAfter(&StdMessage{}, 10*time.Second, err)
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	fmt.Println(min >= 9*time.Second, max <= 11*time.Second, min < max)
+	fmt.Println(mq.retryAfter(&StdMessage{}, 0, err), mq.retryAfter(&StdMessage{}, -1, err))
+	for i := 0; i < 100; i++ {
+		if d := mq.retryAfter(&StdMessage{}, time.Millisecond, err); d < 0 {
+			fmt.Println(d)
+		}
+	}
+	d := mq.retryAfter(&StdMessage{}, 0, RetryAt(time.Now().Add(time.Hour), err))
+	fmt.Println(d > 59*time.Minute && d <= time.Hour)
+	wrapped := fmt.Errorf("wrapped: %w", RetryAt(time.Now().Add(time.Hour), err))
+	d = mq.retryAfter(&StdMessage{}, 0, wrapped)
+	fmt.Println(d > 59*time.Minute && d <= time.Hour, errors.Is(RetryAt(time.Now(), err), err))
+	// Output:
+	// true true true
+	// 0s -1ns
+	// true
+	// true true
+}
+
+func ExampleDailyAt() {
+	var schedule = DailyAt(3, 0)
+	var loc = time.FixedZone("CST", 8*3600)
+	for _, now := range []time.Time{
+		time.Date(2021, 5, 1, 1, 0, 0, 0, loc),
+		time.Date(2021, 5, 1, 3, 0, 0, 0, loc),
+		time.Date(2021, 5, 31, 23, 0, 0, 0, loc),
+	} {
+		fmt.Println(schedule(now))
+	}
+	// Output:
+	// 2021-05-01 03:00:00 +0800 CST
+	// 2021-05-02 03:00:00 +0800 CST
+	// 2021-06-01 03:00:00 +0800 CST
+}
+
+func ExampleSqlMQ_CleanSchedule() {
+	var mq = getSqlMQ()
+	mq.CleanInterval = 0
+	var scheduled = make(chan time.Time, 10)
+	mq.CleanSchedule = func(now time.Time) time.Time {
+		scheduled <- now
+		return now.Add(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 35*time.Millisecond)
+	defer cancel()
+	mq.clean(ctx)
+	fmt.Println(len(scheduled) >= 3)
+	// Output:
+	// true
+}
+
+func ExampleSqlMQ_Use() {
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0)}
+	var trace = func(name string) func(Handler) Handler {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+				fmt.Println(name, "before", msg.QueueName())
+				defer fmt.Println(name, "after", msg.QueueName())
+				return next(ctx, tx, msg)
+			}
+		}
+	}
+	mq.Use(trace("first"))
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		fmt.Println("handle", msg.QueueName())
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	mq.Use(trace("second"))
+
+	handler, err := mq.handlerOf(mq.Table, &StdMessage{Queue: "test"})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(handler(context.Background(), nil, &StdMessage{Queue: "test"}))
+	_, err = mq.handlerOf(mq.Table, &StdMessage{Queue: "unknown"})
+	fmt.Println(err)
+	// Output:
+	// first before test
+	// second before test
+	// handle test
+	// second after test
+	// first after test
+	// 0s false <nil>
+	// unknown queue: unknown
+}
+
+func ExampleSqlMQ_Queues() {
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0)}
+	fmt.Println(mq.Queues(), mq.HasHandler("a"))
+	for _, queue := range []string{"b", "a"} {
+		if err := mq.Register(queue, noopHandler); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.Queues(), mq.HasHandler("a"), mq.HasHandler("c"))
+	mq.SetDefaultHandler(noopHandler)
+	fmt.Println(mq.HasHandler("c"))
+	// Output:
+	// [] false
+	// [a b] true false
+	// true
+}
+
+func ExampleSqlMQ_TxOptions() {
+	var mq = getSqlMQ()
+	mq.TxOptions = &sql.TxOptions{Isolation: sql.LevelSerializable}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	var level string
+	if err := tx.QueryRow("SHOW transaction_isolation").Scan(&level); err != nil {
+		panic(err)
+	}
+	fmt.Println(level)
+	tx.Rollback()
+	lease.end()
+
+	mq.TxOptions.ReadOnly = true
+	fmt.Println(mq.validate())
+	// Output:
+	// serializable
+	// SqlMQ.TxOptions must not be read only
+}
+
+func ExampleSqlMQ_NoHandlerTx() {
+	var table = NewMockTable("mock", 0)
+	// no transaction is began, so the DB is never connected in this example.
+	var mq = &SqlMQ{DB: testDB, Table: table, NoHandlerTx: true}
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		fmt.Println(tx == nil, Heartbeat(ctx))
+		if msg.GetId() == 1 {
+			return 0, false, nil
+		}
+		return time.Hour, false, errors.New("error happened")
+	}); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	for _, msg := range table.Messages() {
+		fmt.Println(msg.Id, msg.Status, msg.TriedCount)
+	}
+	// Output:
+	// true false
+	// true 0s <nil>
+	// true false
+	// true 0s <nil>
+	// 1 done 1
+	// 2 waiting 1
+}
+
+func ExampleSqlMQ_NoHandlerTx_rateLimits() {
+	var table = NewMockTable("mock", 0)
+	var mq = &SqlMQ{
+		DB: testDB, Table: table, NoHandlerTx: true, RateLimits: map[string]float64{"test": 1},
+	}
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	// the second message is claimed but exceeds the limit, so it's released to be waiting.
+	processed, wait, err := mq.ConsumeOnce(context.Background())
+	fmt.Println(processed, wait > 0 && wait <= time.Second, err)
+	for _, msg := range table.Messages() {
+		fmt.Println(msg.Id, msg.Status, msg.TriedCount, msg.RetryAt.After(time.Now()))
+	}
+	// Output:
+	// true 0s <nil>
+	// false true <nil>
+	// 1 done 1 false
+	// 2 waiting 0 true
+}
+
+func ExampleSqlMQ_OnPoison() {
+	var mq = &SqlMQ{Table: NewMockTable("mock", 0), MaxRetries: 3, PoisonThreshold: 2}
+	mq.OnPoison = func(msg Message, triedCount uint16) {
+		fmt.Println("poison", msg.GetId(), triedCount)
+	}
+	mq.OnGivenUp = func(msg Message) { fmt.Println("givenUp", msg.GetId()) }
+	if err := mq.Table.ProduceMessage(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 4; i++ {
+		msg, err := mq.Table.EarliestMessage(nil)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("tried", msg.(*StdMessage).TriedCount)
+		mq.markFail(mq.Table, nil, msg, 0, false)
+	}
+	// Output:
+	// tried 0
+	// tried 1
+	// poison 1 2
+	// tried 2
+	// tried 3
+	// givenUp 1
+}
+
+func ExampleAtMostOnce() {
+	var mq = recreateSqlMQ()
+	mq.DeliverySemantics = AtMostOnce
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		var status string
+		if err := testDB.QueryRow(
+			"SELECT status FROM sqlmq WHERE id = $1", msg.GetId(),
+		).Scan(&status); err != nil {
+			return 0, false, err
+		}
+		fmt.Println(tx == nil, status)
+		return 0, false, errors.New("error happened")
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	_, err = mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	fmt.Println(err, FailStageOf(err))
+	var status string
+	if err := testDB.QueryRow("SELECT status FROM sqlmq WHERE id = $1", msg.Id).Scan(&status); err != nil {
+		panic(err)
+	}
+	fmt.Println(status)
+	// Output:
+	// true done
+	// error happened handler
+	// done
+}
+
+func ExampleSqlMQ_ProduceInNewTx() {
+	db := sqliteFake.open()
+	defer db.Close()
+	var mq = &SqlMQ{DB: db, Table: &SQLiteTable{name: "sqlmq"}}
+	if err := mq.Register("test", noopHandler); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test", Data: "hello"}
+	fmt.Println(mq.ProduceInNewTx(nil, msg), msg.Id, !mq.sleep.GetAwakeAt().IsZero())
+	// the transaction is rollbacked if producing fails.
+	fmt.Println(mq.ProduceInNewTx(db, &StdMessage{Queue: "unknown"}))
+	fmt.Print(sqliteFake.statements())
+	// Output:
+	// <nil> 7 true
+	// unknown queue: unknown
+	// BEGIN
+	// INSERT INTO sqlmq (queue, data, status, created_at, tried_count, retry_at) VALUES (?, ?, ?, ?, ?, ?) [test "hello" waiting <time> 0 <time>]
+	// COMMIT
+	// BEGIN
+	// ROLLBACK
+}
+
+func ExampleSqlMQ_ProduceInTx() {
+	var mq = recreateSqlMQ()
+	if err := mq.Register("next", noopHandler); err != nil {
+		panic(err)
+	}
+	if err := mq.Register("test", func(
+		ctx context.Context, tx *sql.Tx, msg Message,
+	) (time.Duration, bool, error) {
+		if err := mq.ProduceInTx(tx, &StdMessage{Queue: "next"}); err != nil {
+			return 0, false, err
+		}
+		mq.mutex.RLock()
+		fmt.Println("notify after commit:", !mq.afterCommit[tx].IsZero())
+		mq.mutex.RUnlock()
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test"}
+	if err := mq.Produce(nil, msg); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(mq.handle(context.Background(), lease, mq.Table, tx, msg))
+	fmt.Println(len(mq.afterCommit))
+	var count int
+	if err := testDB.QueryRow(`SELECT count(*) FROM sqlmq WHERE queue = 'next'`).Scan(&count); err != nil {
+		panic(err)
+	}
+	fmt.Println(count)
+	// Output:
+	// notify after commit: true
+	// 0s <nil>
+	// 0
+	// 1
+}
@@ -1,11 +1,14 @@
 package sqlmq
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,18 +20,49 @@ const (
 	StatusWaiting = "waiting"
 	StatusDone    = "done"
 	StatusGivenUp = "givenUp"
+	// a message claimed by a consumer, only used by the ClaimByUpdate mode.
+	StatusProcessing = "processing"
+	// a message cancelled before consumed, see StdTable.Cancel.
+	StatusCancelled = "cancelled"
+	// a message not consumed before its ExpiresAt, see StdMessage.ExpiresAt.
+	StatusExpired = "expired"
 
 	Rfc3339Micro = "2006-01-02T15:04:05.999999Z07:00"
 )
 
 type StdMessage struct {
-	Id         int64
-	Queue      string      // quene name
-	Data       interface{} // data of any type
+	Id    int64
+	Queue string // quene name
+	// Data of any type when producing. After fetched by EarliestMessage, it's always a []byte of the
+	// data column: the JSON text by default, or the bytes marshaled by the table's Codec.
+	// Use DataInto to unmarshal JSON data.
+	Data       interface{}
 	Status     string
 	CreatedAt  time.Time
 	TriedCount uint16    // how many times have tried already.
-	RetryAt    time.Time // next retry at when.
+	RetryAt    time.Time // next retry at when, set it to a future time to produce a delayed message.
+	Priority   int16     // messages with higher priority are consumed first when they are due.
+	// Trace context propagated from the producer to the consumer, such as W3C "traceparent".
+	// It can be injected and extracted by an OpenTelemetry TextMapPropagator with a MapCarrier.
+	TraceContext map[string]string
+	// Transport-level metadata which isn't part of Data, such as correlation ids.
+	Headers map[string]string
+	// If DedupKey is not empty, it must be unique in the table, see StdTable.ProduceMessageIfNew.
+	DedupKey string
+	// The id of a message in a table created with StdTableOptions.UUID, Id is not used then.
+	// If it's empty when producing, a time-ordered UUID (version 7) is generated.
+	UUID string
+	// Messages with the same non empty GroupKey (for example a user id) are consumed one by one in
+	// the order of producing: a message is not fetched until all the earlier messages of its group
+	// are consumed successfully or given up. Messages of different groups are consumed concurrently.
+	GroupKey string
+	// If ExpiresAt is not zero, the message is only valuable before it, such as sending a one-time
+	// password: it's not fetched since ExpiresAt, and is marked as StatusExpired instead of being
+	// consumed late, by StdTable.ExpireMessages when SqlMQ cleans.
+	ExpiresAt time.Time
+	// The type of the message in its queue, for dispatching it to the handler registered by
+	// SqlMQ.RegisterType, so that several types of messages can share a queue.
+	Type string
 }
 
 func (msg *StdMessage) QueueName() string {
@@ -43,38 +77,253 @@ func (msg *StdMessage) SetId(id int64) {
 	msg.Id = id
 }
 
+func (msg *StdMessage) GetTriedCount() uint16 {
+	return msg.TriedCount
+}
+
 func (msg *StdMessage) ConsumeAt() time.Time {
 	return msg.RetryAt
 }
 
+// DataInto unmarshal the JSON Data into v. Numbers unmarshaled into an interface{} are json.Number,
+// so that big integers in jsonb keep their precision.
+// If Data is not a []byte or string (a message not fetched from table), it's marshaled first.
+func (msg *StdMessage) DataInto(v interface{}) error {
+	var data []byte
+	switch d := msg.Data.(type) {
+	case []byte:
+		data = d
+	case string:
+		data = []byte(d)
+	default:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		data = b
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
 func (msg *StdMessage) TableSql(tableName string) string {
-	return fmt.Sprintf(`
+	return stdTableSql(stdColumnNames, tableName, "bigserial", "jsonb", "", "")
+}
+
+// idType is the type of id column, bigserial by default, or uuid.
+// dataType is the type of data column, jsonb for JSONCodec, bytea for binary codecs.
+// partitionBy is the partition strategy and key, such as "RANGE (created_at)", or empty.
+// suffix is appended after the column definitions, such as "WITH (...)" and "TABLESPACE ...".
+func stdTableSql(c columnNames, tableName, idType, dataType, partitionBy, suffix string) string {
+	var idColumn, primaryKey = fmt.Sprintf("%-12s NOT NULL PRIMARY KEY", idType), ""
+	if partitionBy != "" {
+		// the primary key of a partitioned table must include all the partition key columns.
+		idColumn = fmt.Sprintf("%-12s NOT NULL", idType)
+		primaryKey = c.sqlf(",\n\tPRIMARY KEY ({id}, %s)", partitionColumns(partitionBy))
+		suffix = " PARTITION BY " + partitionBy + suffix
+	}
+	return c.sqlf(`
 CREATE TABLE IF NOT EXISTS %s (
-	id            bigserial    NOT NULL PRIMARY KEY,
-	queue         text         NOT NULL,
-	status        text         NOT NULL,
-	created_at    timestamptz  NOT NULL,
-	tried_count   smallint     NOT NULL,
-	retry_at      timestamptz  NOT NULL,
-	data          jsonb        NOT NULL
-);
-`, tableName)
+	{id}            %s,
+	{queue}         text         NOT NULL,
+	{status}        text         NOT NULL,
+	{created_at}    timestamptz  NOT NULL,
+	{tried_count}   smallint     NOT NULL,
+	{retry_at}      timestamptz  NOT NULL,
+	{data}          %-12s NOT NULL,
+	{priority}      smallint     NOT NULL DEFAULT 0,
+	{trace_context} jsonb,
+	{headers}       jsonb,
+	{dedup_key}     text,
+	{locked_at}     timestamptz,
+	{group_key}     text,
+	{expires_at}    timestamptz,
+	{type}          text%s
+)%s;
+`, tableName, idColumn, dataType, primaryKey, suffix)
+}
+
+// partitionColumns return the columns of a partition key, for example "created_at, queue" for
+// "RANGE (created_at, queue)".
+func partitionColumns(partitionBy string) string {
+	start, end := strings.Index(partitionBy, "("), strings.LastIndex(partitionBy, ")")
+	if start < 0 || end < start {
+		return partitionBy
+	}
+	return strings.TrimSpace(partitionBy[start+1 : end])
 }
 
 func (msg *StdMessage) TableIndexSql(tableName string) []string {
-	return []string{fmt.Sprintf(
-		`CREATE INDEX CONCURRENTLY IF NOT EXISTS %s_queue_status_retry_at ON %s (queue, status, retry_at)`,
-		strings.Replace(tableName, ".", "_", 1), tableName,
-	)}
+	return stdTableIndexSql(stdColumnNames, tableName)
+}
+
+func stdTableIndexSql(c columnNames, tableName string) []string {
+	var prefix = strings.Replace(tableName, ".", "_", 1)
+	return []string{
+		c.sqlf(
+			`CREATE INDEX CONCURRENTLY IF NOT EXISTS %s_queue_status_retry_at ON %s `+
+				`({queue}, {status}, {retry_at})`,
+			prefix, tableName,
+		),
+		c.sqlf(stdFetchIndexes[0], "CONCURRENTLY ", prefix, tableName),
+		c.sqlf(stdFetchIndexes[1], "CONCURRENTLY ", prefix, tableName),
+		c.sqlf(
+			`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS %s_dedup_key ON %s ({dedup_key}) `+
+				dedupKeyCondition,
+			prefix, tableName,
+		),
+		c.sqlf(
+			`CREATE INDEX CONCURRENTLY IF NOT EXISTS %s_group_key ON %s ({group_key}, {id}) `+
+				groupKeyCondition,
+			prefix, tableName,
+		),
+	}
+}
+
+// the indexes serving the queries of EarliestMessage, see stdEarliestMessageSql.
+var stdFetchIndexes = []string{
+	`CREATE INDEX %sIF NOT EXISTS %s_status_priority_retry_at ON %s ` +
+		`({status}, {priority} DESC, {retry_at}, {id})`,
+	`CREATE INDEX %sIF NOT EXISTS %s_status_retry_at ON %s ({status}, {retry_at}, {id})`,
+}
+
+const dedupKeyCondition = "WHERE {dedup_key} IS NOT NULL"
+const groupKeyCondition = "WHERE {group_key} IS NOT NULL"
+
+// stdGroupCond is the condition to fetch only the earliest unconsumed message of a group.
+func stdGroupCond(c columnNames, tableName string) string {
+	return c.sqlf(` AND (%s.{group_key} IS NULL OR NOT EXISTS (
+		SELECT 1 FROM %s AS earlier
+		WHERE earlier.{group_key} = %s.{group_key} AND earlier.{id} < %s.{id}
+		AND earlier.{status} IN ('%s', '%s')`+
+		strings.Replace(stdNotExpiredCond, "{expires_at}", "earlier.{expires_at}", 2)+`
+	))`, tableName, tableName, tableName, tableName, StatusWaiting, StatusProcessing)
 }
 
+// stdNotExpiredCond is the condition to skip expired messages when fetching.
+const stdNotExpiredCond = " AND ({expires_at} IS NULL OR {expires_at} > now())"
+
+// ProduceSql return the INSERT statement with the values quoted in it,
+// StdTable uses ParamProduceSql instead.
 func (msg *StdMessage) ProduceSql(tableName string) (string, error) {
-	jsonData, ok := msg.Data.([]byte)
+	args, err := msg.produceArgs(JSONCodec, false)
+	if err != nil {
+		return "", err
+	}
+	var values = make([]string, len(args))
+	for i, arg := range args {
+		values[i] = literal(arg)
+	}
+	return stdColumnNames.sqlf(`
+	INSERT INTO %s
+		(`+stdProduceColumns+`)
+	VALUES
+		(%s)
+	RETURNING {id}
+	`, tableName, strings.Join(values, ", ")), nil
+}
+
+// literal format an arg of produceArgs as a SQL literal.
+func literal(arg interface{}) string {
+	switch v := arg.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return Quote(v)
+	case time.Time:
+		return Quote(v.Format(Rfc3339Micro))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ParamProduceSql return the INSERT statement and its args.
+func (msg *StdMessage) ParamProduceSql(tableName string) (string, []interface{}, error) {
+	args, err := msg.produceArgs(JSONCodec, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return stdProduceSql(stdColumnNames, tableName, stdProduceColumns, args), args, nil
+}
+
+func stdProduceSql(c columnNames, tableName, columns string, args []interface{}) string {
+	return c.sqlf(`
+	INSERT INTO %s
+		(`+columns+`)
+	VALUES
+		%s
+	RETURNING {id}
+	`, tableName, placeholders(0, len(args)))
+}
+
+// the columns to insert when producing a StdMessage, in the order of produceArgs.
+const stdProduceColumns = "{queue}, {data}, {status}, {created_at}, {tried_count}, {retry_at}, " +
+	"{priority}, {trace_context}, {headers}, {dedup_key}, {group_key}, {expires_at}, {type}"
+
+// produceArgs set default values for a message to produce, and return the values to insert.
+// If binary is true, the marshaled data is inserted as bytes, otherwise as a string.
+func (msg *StdMessage) produceArgs(codec Codec, binary bool) ([]interface{}, error) {
+	marshaled, err := msg.prepare(codec)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{} = string(marshaled)
+	if binary {
+		data = marshaled
+	}
+	traceContext, err := jsonMap(msg.TraceContext)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := jsonMap(msg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		msg.Queue, data, msg.Status, msg.CreatedAt, msg.TriedCount, msg.RetryAt,
+		msg.Priority, traceContext, headers, nullString(msg.DedupKey), nullString(msg.GroupKey),
+		nullTime(msg.ExpiresAt), nullString(msg.Type),
+	}, nil
+}
+
+// empty string is stored as NULL.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// zero time is stored as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// jsonMap return a map in json, or nil(NULL) if the map is empty.
+func jsonMap(m map[string]string) (interface{}, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// prepare set default values for a message to produce, and return its data marshaled by codec.
+// If Data is a []byte, it's regarded as already marshaled.
+func (msg *StdMessage) prepare(codec Codec) ([]byte, error) {
+	marshaled, ok := msg.Data.([]byte)
 	if !ok {
-		if data, err := json.Marshal(msg.Data); err != nil {
-			return "", err
+		if data, err := codec.Marshal(msg.Data); err != nil {
+			return nil, err
 		} else {
-			jsonData = []byte(data)
+			marshaled = data
 		}
 	}
 
@@ -84,50 +333,200 @@ func (msg *StdMessage) ProduceSql(tableName string) (string, error) {
 	if msg.CreatedAt.IsZero() {
 		msg.CreatedAt = time.Now()
 	}
+	msg.CreatedAt = Timestamps.Normalize(msg.CreatedAt)
 	if msg.RetryAt.IsZero() {
 		msg.RetryAt = msg.CreatedAt
+	} else {
+		msg.RetryAt = Timestamps.Normalize(msg.RetryAt)
 	}
+	if !msg.ExpiresAt.IsZero() {
+		msg.ExpiresAt = Timestamps.Normalize(msg.ExpiresAt)
+	}
+	return marshaled, nil
+}
 
-	return fmt.Sprintf(`
-	INSERT INTO %s
-		(queue, data, status, created_at, tried_count, retry_at)
-	VALUES
-	    (%s,    %s,   %s,     '%s',       %d,        '%s')
-	RETURNING id
-	`,
-		tableName,
-		Quote(msg.Queue), Quote(string(jsonData)), Quote(msg.Status),
-		msg.CreatedAt.Format(Rfc3339Micro), msg.TriedCount, msg.RetryAt.Format(Rfc3339Micro),
-	), nil
+// placeholders return "($start+1, $start+2, ..., $start+n)".
+func placeholders(start, n int) string {
+	var list = make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", start+i+1)
+	}
+	return "(" + strings.Join(list, ", ") + ")"
 }
 
 func (msg *StdMessage) EarliestMessageSql(tableName string, queues []string) string {
 	var cond string
 	if len(queues) > 0 {
 		sort.Strings(queues)
-		cond = fmt.Sprintf(" AND queue IN (%s)", strings.Join(queues, ","))
+		cond = stdColumnNames.sqlf(" AND {queue} IN (%s)", strings.Join(queues, ","))
 	}
-	return fmt.Sprintf(`
-	SELECT id, queue, data, status, created_at, tried_count, retry_at
-	FROM %s
-	WHERE status = '%s' %s
-	ORDER BY retry_at
+	return stdEarliestMessageSql(
+		stdColumnNames, tableName, cond+stdColumnNames.sqlf(stdNotExpiredCond), ClaimSkipLocked,
+		LockForUpdate, false,
+	)
+}
+
+// LockStrength is the row-level lock taken on the messages fetched, see StdTable.SetLockStrength.
+type LockStrength string
+
+const (
+	// Lock by "FOR UPDATE", the default.
+	LockForUpdate LockStrength = "FOR UPDATE"
+	// Lock by "FOR NO KEY UPDATE", which is enough since the id of a message is never updated.
+	// It doesn't conflict with the "FOR KEY SHARE" locks taken by foreign key checks, so rows of
+	// other tables referencing the messages can be inserted or updated while they are consumed.
+	LockForNoKeyUpdate LockStrength = "FOR NO KEY UPDATE"
+)
+
+// ClaimMode is how EarliestMessage exclusively claims a message among concurrent consumers.
+type ClaimMode int
+
+const (
+	// Claim by "FOR UPDATE SKIP LOCKED", which requires PostgreSQL 9.5+.
+	// Messages locked by other consumers are skipped, the earliest unlocked message is returned.
+	ClaimSkipLocked ClaimMode = iota
+	// Claim by "pg_try_advisory_xact_lock(id)" and "FOR UPDATE", for PostgreSQL before 9.5 or forks
+	// without "SKIP LOCKED". Messages claimed by other consumers are also skipped, but:
+	// 1. PostgreSQL may try the advisory lock on more rows than returned, these messages stay locked
+	// until the transaction ends, and are skipped by other consumers meanwhile;
+	// 2. a message being updated by others without the advisory lock (for example by Requeue)
+	// blocks the query until that update is committed or rollbacked, instead of being skipped;
+	// 3. the advisory lock keys are message ids, which may collide with other advisory lock users.
+	ClaimAdvisoryLock
+	// Claim by updating the message's status to StatusProcessing and locked_at to now() in a short
+	// transaction, which is committed before handling, so the message isn't locked by a long
+	// transaction while its handler runs. The handler still gets a transaction, the message is
+	// marked in it after the handler returns. But the claim and the handling are not atomic any
+	// more: if a consumer crashes after claiming, the message stays StatusProcessing until reaped.
+	ClaimByUpdate
+)
+
+// Due messages are ordered by priority, and then by retry_at, or by id if fifo is true.
+// The id breaks ties, so messages with the same retry_at are consumed in the order of producing.
+// The order only compares the ids of existing messages, so it holds after any number of messages
+// are cleaned or archived: gaps left in ids don't matter, and ids are never reused, because a
+// bigserial sequence doesn't wrap around (and a uuid v7 id, see StdTableOptions.UUID, also
+// increases with time).
+// The earliest due message is locked and returned, or if there is none, the next message to be
+// due is returned without locking to compute how long to wait. They are fetched by two queries
+// ordered by plain columns, so that they are served by the indexes
+// (status, priority DESC, retry_at, id) and (status, retry_at, id) respectively.
+// cond is appended as it is, so its columns must be resolved by c already.
+func stdEarliestMessageSql(
+	c columnNames, tableName, cond string, mode ClaimMode, strength LockStrength, fifo bool,
+) string {
+	if mode == ClaimByUpdate {
+		return stdClaimMessageSql(c, tableName, cond, strength, fifo)
+	}
+	var order = "{retry_at}, {id}"
+	if fifo {
+		order = "{id}"
+	}
+	var dueCond, lock = cond, string(strength) + " SKIP LOCKED"
+	if mode == ClaimAdvisoryLock {
+		dueCond += c.sqlf(" AND pg_try_advisory_xact_lock({id})")
+		lock = string(strength)
+	}
+	return c.sqlf(`
+	WITH due AS (
+		SELECT `+stdSelectColumns+` FROM %s
+		WHERE {status} = '%s' AND {retry_at} <= now() %s
+		ORDER BY {priority} DESC, `+order+`
+		LIMIT 1
+		%s
+	)
+	SELECT * FROM due
+	UNION ALL
+	(
+		SELECT `+stdSelectColumns+` FROM %s
+		WHERE {status} = '%s' AND {retry_at} > now() %s
+		ORDER BY {retry_at}, {id}
+		LIMIT 1
+	)
 	LIMIT 1
-	FOR UPDATE SKIP LOCKED
-	`, tableName, StatusWaiting, cond)
+	`, tableName, StatusWaiting, dueCond, lock, tableName, StatusWaiting, cond)
 }
 
-func (msg *StdMessage) EarliestMessage(tx *sql.Tx, querysql string) (Message, error) {
-	row := StdMessage{}
+// claim the earliest due message, or if there is none, return the next message to be due to
+// compute how long to wait.
+func stdClaimMessageSql(
+	c columnNames, tableName, cond string, strength LockStrength, fifo bool,
+) string {
+	var order = "{retry_at}, {id}"
+	if fifo {
+		order = "{id}"
+	}
+	return c.sqlf(`
+	WITH claimed AS (
+		UPDATE %s SET {status} = '%s', {locked_at} = now()
+		WHERE {id} = (
+			SELECT {id} FROM %s
+			WHERE {status} = '%s' AND {retry_at} <= now() %s
+			ORDER BY {priority} DESC, `+order+`
+			LIMIT 1
+			%s SKIP LOCKED
+		)
+		RETURNING `+stdSelectColumns+`
+	)
+	SELECT * FROM claimed
+	UNION ALL
+	(
+		SELECT `+stdSelectColumns+` FROM %s
+		WHERE {status} = '%s' AND {retry_at} > now() %s
+		ORDER BY {retry_at}, {id}
+		LIMIT 1
+	)
+	LIMIT 1
+	`, tableName, StatusProcessing, tableName, StatusWaiting, cond, strength,
+		tableName, StatusWaiting, cond)
+}
+
+func (msg *StdMessage) EarliestMessage(tx DBOrTx, querysql string) (Message, error) {
+	return queryStdMessage(tx, querysql)
+}
+
+// queryStdMessage query a StdMessage by querysql and its args, nil is returned if there is none.
+func queryStdMessage(tx DBOrTx, querysql string, args ...interface{}) (Message, error) {
 	ctx, cancel := sqlTimeout()
 	defer cancel()
-	if err := tx.QueryRowContext(ctx, querysql).Scan(
-		&row.Id, &row.Queue, &row.Data, &row.Status, &row.CreatedAt, &row.TriedCount, &row.RetryAt,
-	); err == sql.ErrNoRows {
+	row, err := scanStdMessage(tx.QueryRowContext(ctx, querysql, args...))
+	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, errs.Trace(err)
 	}
+	return row, nil
+}
+
+// the columns to select when fetching a StdMessage, in the order of scanStdMessage.
+const stdSelectColumns = "{id}, {queue}, {data}, {status}, {created_at}, {tried_count}, " +
+	"{retry_at}, {priority}, {trace_context}, {headers}, {group_key}, {expires_at}, {type}"
+
+func scanStdMessage(scanner interface{ Scan(...interface{}) error }) (*StdMessage, error) {
+	row := StdMessage{}
+	var traceContext, headers []byte
+	var groupKey, typ sql.NullString
+	var expiresAt *time.Time
+	if err := scanner.Scan(
+		stdId{&row}, &row.Queue, &row.Data, &row.Status, &row.CreatedAt, &row.TriedCount, &row.RetryAt,
+		&row.Priority, &traceContext, &headers, &groupKey, &expiresAt, &typ,
+	); err != nil {
+		return nil, err
+	}
+	row.GroupKey, row.Type = groupKey.String, typ.String
+	if expiresAt != nil {
+		row.ExpiresAt = *expiresAt
+	}
+	if len(traceContext) > 0 {
+		if err := json.Unmarshal(traceContext, &row.TraceContext); err != nil {
+			return nil, err
+		}
+	}
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &row.Headers); err != nil {
+			return nil, err
+		}
+	}
 	return &row, nil
 }
 
@@ -143,6 +542,9 @@ func NewStdTable(db *sql.DB, name string, keep time.Duration, msgs ...Message) *
 		msg = msgs[0]
 	}
 	createTable(db, msg.TableSql(name))
+	if _, ok := msg.(*StdMessage); ok {
+		createTable(db, stdAddColumnsSql(stdColumnNames, name))
+	}
 	createIndex(db, msg.TableIndexSql(name)...)
 	if keep < 0 {
 		keep = 24 * time.Hour
@@ -150,30 +552,238 @@ func NewStdTable(db *sql.DB, name string, keep time.Duration, msgs ...Message) *
 	return &StdTable{name: name, keep: keep, msg: msg}
 }
 
+// NewBinaryStdTable create a standard `sqlmq.Table` instance, whose data column is bytea,
+// and the Data of StdMessage is marshaled by codec, such as a protobuf or msgpack codec.
+// Use table.Codec().Unmarshal to unmarshal the Data ([]byte) of a consumed message.
+func NewBinaryStdTable(db *sql.DB, name string, keep time.Duration, codec Codec) *StdTable {
+	return NewStdTableWithOptions(db, name, keep, StdTableOptions{Codec: codec, BinaryData: true})
+}
+
+// StdTableOptions customize the StdTable created by NewStdTableWithOptions.
+// The zero value creates the same table as NewStdTable.
+type StdTableOptions struct {
+	// Codec to marshal the Data of StdMessage, the default is JSONCodec.
+	Codec Codec
+	// If BinaryData is true, the data column is bytea instead of jsonb, for binary codecs.
+	BinaryData bool
+	// Storage parameters of the table, for example "fillfactor = 70".
+	StorageParams string
+	// The tablespace to create the table in.
+	Tablespace string
+	// Extra statements executed after the table and its default indexes are created, for example
+	// "CREATE INDEX IF NOT EXISTS sqlmq_queue_retry_at ON sqlmq (queue, retry_at)".
+	ExtraIndexes []string
+	// If NoMigrate is true, no DDL is executed, the table and its indexes must already exist,
+	// for example created by external migrations. It's for database roles without DDL privileges.
+	// The db passed to NewStdTableWithOptions is not used, so it can be nil.
+	NoMigrate bool
+	// The max bytes of the marshaled Data of a message to produce, see StdTable.SetMaxDataBytes.
+	MaxDataBytes int
+	// If PartitionBy is not empty, the table is created as a partitioned table, for example
+	// "RANGE (created_at)" or "LIST (queue)". The partition key columns are added to the primary
+	// key, and the indexes are created without CONCURRENTLY, since PostgreSQL requires so.
+	// The partitions must be created by StdTable.CreatePartition before producing, and old ones can
+	// be dropped by StdTable.DropPartition instead of cleaning messages one by one.
+	// There is no unique index on dedup_key, so ProduceMessageIfNew is not supported.
+	PartitionBy string
+	// If UUID is true, the id column is a uuid generated by producers, instead of a bigserial, to
+	// avoid the contention of a sequence and to reference messages across shards. The id of a
+	// StdMessage is its UUID field then, which is used by the mark methods. FIFO and GroupKey order
+	// messages by id, the generated UUIDs are time-ordered, so they keep the order of producing
+	// roughly. Methods taking an int64 id, like Cancel and Requeue, and ClaimAdvisoryLock are not
+	// supported.
+	UUID bool
+	// Columns rename the standard columns (id, queue, status, created_at, tried_count, retry_at,
+	// data, priority, trace_context, headers, dedup_key, locked_at, group_key, expires_at and type)
+	// to the columns of the table, for example {"queue": "topic", "data": "payload"}, to adopt an
+	// existing table or follow a naming convention. The DDL and all the generated statements are
+	// built with the renamed columns. PartitionBy, ExtraIndexes and the filter of
+	// StdTable.SetDataFilter are used as they are, so write them with the renamed columns.
+	Columns map[string]string
+	// If AuditAttempts is true, the table "<name>_attempts" is created, and every attempt to
+	// process a message is recorded into it by SqlMQ, with the same db or transaction marking the
+	// message, see Attempt. The attempts are not cleaned by CleanMessages.
+	AuditAttempts bool
+}
+
+func (opts StdTableOptions) tableSql(name string, c columnNames) string {
+	var idType, dataType, suffix = "bigserial", "jsonb", ""
+	if opts.UUID {
+		idType = "uuid"
+	}
+	if opts.BinaryData {
+		dataType = "bytea"
+	}
+	if opts.StorageParams != "" {
+		suffix += " WITH (" + opts.StorageParams + ")"
+	}
+	if opts.Tablespace != "" {
+		suffix += " TABLESPACE " + opts.Tablespace
+	}
+	return stdTableSql(c, name, idType, dataType, opts.PartitionBy, suffix)
+}
+
+func (opts StdTableOptions) attemptsSql(name string) []string {
+	var idType = "bigint"
+	if opts.UUID {
+		idType = "uuid"
+	}
+	var prefix = strings.Replace(name, ".", "_", 1)
+	return []string{fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s_attempts (
+	id          bigserial    NOT NULL PRIMARY KEY,
+	message_id  %-12s NOT NULL,
+	try_count   smallint     NOT NULL,
+	worker      text         NOT NULL,
+	started_at  timestamptz  NOT NULL,
+	finished_at timestamptz  NOT NULL,
+	error       text         NOT NULL,
+	outcome     text         NOT NULL
+);
+`, name, idType), fmt.Sprintf(
+		`CREATE INDEX IF NOT EXISTS %s_attempts_message_id ON %s_attempts (message_id)`, prefix, name,
+	)}
+}
+
+func (opts StdTableOptions) indexSql(name string, c columnNames) []string {
+	if opts.PartitionBy == "" {
+		return stdTableIndexSql(c, name)
+	}
+	prefix := strings.Replace(name, ".", "_", 1)
+	return []string{
+		c.sqlf(
+			`CREATE INDEX IF NOT EXISTS %s_queue_status_retry_at ON %s ({queue}, {status}, {retry_at})`,
+			prefix, name,
+		),
+		c.sqlf(stdFetchIndexes[0], "", prefix, name),
+		c.sqlf(stdFetchIndexes[1], "", prefix, name),
+		c.sqlf(
+			`CREATE INDEX IF NOT EXISTS %s_group_key ON %s ({group_key}, {id}) `+groupKeyCondition,
+			prefix, name,
+		),
+	}
+}
+
+// NewStdTableWithOptions create a standard `sqlmq.Table` instance using `*StdMessage` as messages,
+// with its DDL and codec customized by opts. It panics if the DDL failed, see OpenStdTable.
+func NewStdTableWithOptions(
+	db *sql.DB, name string, keep time.Duration, opts StdTableOptions,
+) *StdTable {
+	table, err := OpenStdTable(db, name, keep, opts)
+	if err != nil {
+		panic(time.Now().Format(time.RFC3339Nano) + " " + err.Error())
+	}
+	return table
+}
+
+// OpenStdTable is the same as NewStdTableWithOptions, except that it returns the error of DDL
+// instead of panicking, so the caller can decide to retry, log or exit.
+func OpenStdTable(
+	db *sql.DB, name string, keep time.Duration, opts StdTableOptions,
+) (*StdTable, error) {
+	if err := checkColumns(opts.Columns); err != nil {
+		return nil, err
+	}
+	var columns = newColumnNames(opts.Columns)
+	if !opts.NoMigrate {
+		if err := execDDL(
+			db, opts.tableSql(name, columns), stdAddColumnsSql(columns, name),
+		); err != nil {
+			return nil, err
+		}
+		var indexes = opts.indexSql(name, columns)
+		if err := execDDL(db, append(indexes, opts.ExtraIndexes...)...); err != nil {
+			return nil, err
+		}
+		if opts.AuditAttempts {
+			if err := execDDL(db, opts.attemptsSql(name)...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if keep < 0 {
+		keep = 24 * time.Hour
+	}
+	return &StdTable{
+		name: name, keep: keep, msg: &StdMessage{}, codec: opts.Codec, binaryData: opts.BinaryData,
+		maxDataBytes: opts.MaxDataBytes, uuid: opts.UUID, columns: columns,
+		auditAttempts: opts.AuditAttempts,
+	}, nil
+}
+
+// stdAddedColumns are the columns added to the table of StdMessage after its first release.
+// The constructors of StdTable add them to a table created by an earlier version before creating
+// the indexes.
+var stdAddedColumns = []string{
+	"{priority} smallint NOT NULL DEFAULT 0",
+	"{trace_context} jsonb",
+	"{headers} jsonb",
+	"{dedup_key} text",
+	"{locked_at} timestamptz",
+	"{group_key} text",
+	"{expires_at} timestamptz",
+	"{type} text",
+}
+
+func stdAddColumnsSql(c columnNames, tableName string) string {
+	return c.sqlf(
+		"ALTER TABLE %s ADD COLUMN IF NOT EXISTS "+
+			strings.Join(stdAddedColumns, ", ADD COLUMN IF NOT EXISTS "),
+		tableName,
+	)
+}
+
 func createTable(db *sql.DB, createSql string) {
-	ctx, cancel := sqlTimeout()
-	defer cancel()
-	if _, err := db.ExecContext(ctx, createSql); err != nil {
+	if err := execDDL(db, createSql); err != nil {
 		panic(time.Now().Format(time.RFC3339Nano) + " " + err.Error())
 	}
 }
 
 func createIndex(db *sql.DB, createSqls ...string) {
+	if err := execDDL(db, createSqls...); err != nil {
+		panic(time.Now().Format(time.RFC3339Nano) + " " + err.Error())
+	}
+}
+
+func execDDL(db *sql.DB, sqls ...string) error {
 	ctx, cancel := sqlTimeout()
 	defer cancel()
-	for i := range createSqls {
-		if _, err := db.ExecContext(ctx, createSqls[i]); err != nil {
-			panic(time.Now().Format(time.RFC3339Nano) + " " + err.Error())
+	for i := range sqls {
+		if _, err := db.ExecContext(ctx, sqls[i]); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 // StdTable is a standard `sqlmq.Table` implementation.
 type StdTable struct {
 	name               string
 	keep               time.Duration
+	retention          map[string]time.Duration
+	archive            string
+	cleanBatchSize     int
+	codec              Codec
+	binaryData         bool // the data column is bytea instead of jsonb.
+	uuid               bool // the id column is uuid instead of bigserial.
+	auditAttempts      bool // see StdTableOptions.AuditAttempts.
 	queues             []string
+	paused             []string
+	dataFilter         string        // the condition of SetDataFilter, its placeholders start at $1.
+	dataArgs           []interface{} // the args of dataFilter.
+	queuePattern       string        // the condition of SetQueuePattern.
+	claimMode          ClaimMode
+	strength           LockStrength
+	fifo               bool
+	maxDataBytes       int
+	now                func() time.Time
 	earliestMessageSql string
+	earliestArgs       []interface{} // the args of earliestMessageSql.
+	queueMessageSql    string        // the query of EarliestMessageOfQueue, the queue is $1.
+	priorities         map[string]int16
+	notifyChannel      string
+	debugSQL           func(query string, args ...interface{})
+	columns            columnNames // see StdTableOptions.Columns.
 	mutex              sync.RWMutex
 	msg                Message
 }
@@ -182,131 +792,1296 @@ func (table *StdTable) SetQueues(queues []string) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 	table.queues = queues
-	table.earliestMessageSql = ""
+	table.earliestMessageSql, table.queueMessageSql = "", ""
 }
 
-func (table *StdTable) EarliestMessage(tx *sql.Tx) (Message, error) {
-	querysql := table.getEarliestMessageSql()
-	return table.msg.EarliestMessage(tx, querysql)
+// SetPausedQueues set the queues whose messages are not consumed, they accumulate until resumed.
+// Only works if the table's message is a *StdMessage.
+func (table *StdTable) SetPausedQueues(queues []string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.paused = queues
+	table.earliestMessageSql, table.queueMessageSql = "", ""
 }
 
-func (table *StdTable) getEarliestMessageSql() string {
-	table.mutex.RLock()
-	if table.earliestMessageSql == "" {
-		// var queues []string
-		// for _, queue := range table.queues {
-		// 	queues = append(queues, Quote(queue))
-		// }
+// SetDataFilter set a condition on the data column, so that only the matched messages are consumed
+// by this table. For example, workers of different regions can handle their own messages by
+// `SetDataFilter("data->>'region' = $1", "us")`. The args are bound to the placeholders $1, $2...
+// as parameters of the fetching query, so they are safe from SQL injection; the placeholders are
+// renumbered to follow the other parameters of the query. "$n" in string literals, quoted
+// identifiers and comments of the filter is not a placeholder. An empty filter removes it.
+// The filter is ANDed with the other conditions, such as the one excluding paused queues.
+// Messages are not fetched by a "queue IN (...)" of the registered queues, so the filter applies
+// to all queues; add a "queue = $n" to the filter to restrict it to a queue.
+// Only works if the table's message is a *StdMessage and its data column is jsonb.
+func (table *StdTable) SetDataFilter(filter string, args ...string) error {
+	var cond string
+	var values []interface{}
+	if filter != "" {
+		if err := checkPlaceholders(filter, len(args)); err != nil {
+			return err
+		}
+		cond = " AND (" + filter + ")"
+		for _, arg := range args {
+			values = append(values, arg)
+		}
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.dataFilter, table.dataArgs = cond, values
+	table.earliestMessageSql, table.queueMessageSql = "", ""
+	return nil
+}
 
-		// sort.Strings(queues)
-		querySql := table.msg.EarliestMessageSql(table.name, nil)
-		table.mutex.RUnlock()
+// SetQueuePattern set a LIKE pattern of queues, so that only messages of the matched queues are
+// consumed by this table, for example `SetQueuePattern("user.%.notifications")` for queues named
+// per entity, which can't be enumerated. The matched queues are handled by their registered
+// handlers, or by the default handler, see SqlMQ.SetDefaultHandler. In the pattern, "%" matches
+// any characters, "_" matches one character, and "\" escapes them. An empty pattern removes it.
+// A pattern starting with a literal prefix, like "user.%", can use the (queue, status, retry_at)
+// index only if the collation of the queue column is "C"; otherwise create an index by
+// "CREATE INDEX ON <name> (queue text_pattern_ops, status, retry_at)", for example by
+// StdTableOptions.ExtraIndexes. A pattern starting with a wildcard can't use any index on queue,
+// the waiting messages are scanned then.
+func (table *StdTable) SetQueuePattern(pattern string) {
+	var cond string
+	if pattern != "" {
+		cond = table.columns.sqlf(" AND {queue} LIKE %s", Quote(pattern))
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.queuePattern = cond
+	table.earliestMessageSql, table.queueMessageSql = "", ""
+}
 
-		table.mutex.Lock()
-		table.earliestMessageSql = querySql
-		table.mutex.Unlock()
+// checkPlaceholders check that the placeholders $1, $2... in a sql fragment match n args.
+func checkPlaceholders(fragment string, n int) error {
+	var err error
+	var used = make([]bool, n)
+	scanPlaceholders(fragment, func(i int) string {
+		if i < 1 || i > n {
+			if err == nil {
+				err = fmt.Errorf("sqlmq: no arg for placeholder $%d", i)
+			}
+		} else {
+			used[i-1] = true
+		}
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+	for i := range used {
+		if !used[i] {
+			return fmt.Errorf("sqlmq: no placeholder for arg $%d", i+1)
+		}
+	}
+	return nil
+}
 
-		return querySql
+// renumberPlaceholders add offset to the placeholders $1, $2... in a sql fragment.
+func renumberPlaceholders(fragment string, offset int) string {
+	if offset == 0 {
+		return fragment
 	}
-	defer table.mutex.RUnlock()
-	return table.earliestMessageSql
+	return scanPlaceholders(fragment, func(i int) string {
+		return "$" + strconv.Itoa(i+offset)
+	})
 }
 
-func (table *StdTable) MarkSuccess(tx *sql.Tx, message Message) error {
-	sql := fmt.Sprintf(`
-	UPDATE %s
-	SET status = '%s', tried_count = tried_count+1, retry_at = '%s'
-	WHERE id = %d
-	`,
-		table.name,
-		StatusDone, time.Now().Format(Rfc3339Micro),
-		message.GetId(),
-	)
-	ctx, cancel := sqlTimeout()
-	defer cancel()
-	if result, err := tx.ExecContext(ctx, sql); err != nil {
-		return errs.Trace(err)
-	} else {
-		return checkAffectedOne(result)
+// scanPlaceholders call fn for each placeholder $n in a sql fragment, and replace the placeholder
+// by its result if the result is not empty. String literals, quoted identifiers, dollar-quoted
+// strings and comments are skipped, so a "$n" in them is left as it is.
+func scanPlaceholders(fragment string, fn func(n int) string) string {
+	var b strings.Builder
+	for i := 0; i < len(fragment); {
+		var end int
+		switch c := fragment[i]; {
+		case c == '\'' || c == '"':
+			// a quote in them is escaped by doubling it, which is skipped as two quoted parts.
+			if end = strings.IndexByte(fragment[i+1:], c); end < 0 {
+				end = len(fragment)
+			} else {
+				end += i + 2
+			}
+		case strings.HasPrefix(fragment[i:], "--"):
+			if end = strings.IndexByte(fragment[i:], '\n'); end < 0 {
+				end = len(fragment)
+			} else {
+				end += i + 1
+			}
+		case strings.HasPrefix(fragment[i:], "/*"):
+			if end = strings.Index(fragment[i+2:], "*/"); end < 0 {
+				end = len(fragment)
+			} else {
+				end += i + 4
+			}
+		case c == '$':
+			end = i + 1
+			for end < len(fragment) && fragment[end] >= '0' && fragment[end] <= '9' {
+				end++
+			}
+			if end > i+1 {
+				n, _ := strconv.Atoi(fragment[i+1 : end])
+				if s := fn(n); s != "" {
+					b.WriteString(s)
+					i = end
+					continue
+				}
+			} else if tag := dollarQuoteTag(fragment[i:]); tag != "" {
+				if end = strings.Index(fragment[i+len(tag):], tag); end < 0 {
+					end = len(fragment)
+				} else {
+					end += i + 2*len(tag)
+				}
+			}
+		default:
+			end = i + 1
+		}
+		b.WriteString(fragment[i:end])
+		i = end
 	}
+	return b.String()
 }
 
-func (table *StdTable) MarkRetry(db DBOrTx, message Message, retryAfter time.Duration) error {
-	sql := fmt.Sprintf(`
-	UPDATE %s
-	SET tried_count = tried_count + 1,  retry_at = '%s'
-	WHERE id = %d
-	`,
-		table.name,
-		time.Now().Add(retryAfter).Format(Rfc3339Micro),
-		message.GetId(),
-	)
-	ctx, cancel := sqlTimeout()
-	defer cancel()
-	if result, err := db.ExecContext(ctx, sql); err != nil {
-		return errs.Trace(err)
-	} else {
-		return checkAffectedOne(result)
+// dollarQuoteTag return the opening tag if s starts with a dollar quote like $$ or $tag$.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 1 && c >= '0' && c <= '9':
+		default:
+			return ""
+		}
 	}
+	return ""
 }
 
-func (table *StdTable) MarkGivenUp(db DBOrTx, message Message) error {
-	sql := fmt.Sprintf(`
-	UPDATE %s
-	SET status = '%s', tried_count = tried_count + 1, retry_at = '%s'
-	WHERE id = %d
-	`,
-		table.name,
-		StatusGivenUp, time.Now().Format(Rfc3339Micro),
-		message.GetId(),
-	)
-	ctx, cancel := sqlTimeout()
-	defer cancel()
-	if result, err := db.ExecContext(ctx, sql); err != nil {
-		return errs.Trace(err)
-	} else {
-		return checkAffectedOne(result)
+// SetClaimMode set how EarliestMessage claims a message, the default is ClaimSkipLocked.
+// Only works if the table's message is a *StdMessage.
+func (table *StdTable) SetClaimMode(mode ClaimMode) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.claimMode = mode
+	table.earliestMessageSql, table.queueMessageSql = "", ""
+}
+
+// SetNow set the clock to compute the times written into the table, like created_at and
+// retry_at. If now is nil, time.Now is used. Queries comparing with the current time still use
+// the database's now(), so a fake clock is only for tests, see SqlMQ.Now.
+func (table *StdTable) SetNow(now func() time.Time) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.now = now
+}
+
+// timeNow return the current time normalized by Timestamps.
+func (table *StdTable) timeNow() time.Time {
+	table.mutex.RLock()
+	now := table.now
+	table.mutex.RUnlock()
+	if now != nil {
+		return Timestamps.Normalize(now())
 	}
+	return Timestamps.Normalize(time.Now())
 }
 
-// if ProduceMessage runs succussfully, message id is set in message.
-func (table *StdTable) ProduceMessage(db DBOrTx, message Message) error {
-	sql, err := message.ProduceSql(table.name)
-	if err != nil {
-		return err
+// SetLockStrength set the row-level lock taken on the messages fetched by EarliestMessage,
+// EarliestMessages and Cancel, the default is LockForUpdate.
+// Only works if the table's message is a *StdMessage.
+func (table *StdTable) SetLockStrength(strength LockStrength) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.strength = strength
+	table.earliestMessageSql, table.queueMessageSql = "", ""
+}
+
+// the lock strength set, or LockForUpdate, must be called with table.mutex locked.
+func (table *StdTable) lockStrength() LockStrength {
+	if table.strength == "" {
+		return LockForUpdate
 	}
-	ctx, cancel := sqlTimeout()
-	defer cancel()
-	var id int64
-	if err := db.QueryRowContext(ctx, sql).Scan(&id); err != nil {
-		return errs.Trace(err)
+	return table.strength
+}
+
+// SetFIFO set whether due messages are consumed strictly in the order of producing (by id),
+// instead of in the order of RetryAt. Priority still comes first.
+// Only works if the table's message is a *StdMessage.
+func (table *StdTable) SetFIFO(fifo bool) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.fifo = fifo
+	table.earliestMessageSql, table.queueMessageSql = "", ""
+}
+
+// ClaimsByUpdate return true if the ClaimByUpdate mode is set.
+func (table *StdTable) ClaimsByUpdate() bool {
+	if _, ok := table.msg.(*StdMessage); !ok {
+		return false
 	}
-	message.SetId(id)
-	return nil
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.claimMode == ClaimByUpdate
 }
 
-func (table *StdTable) CleanMessages(db *sql.DB) (int64, error) {
-	sql := fmt.Sprintf(`
-	DELETE FROM %s
-	WHERE status = '%s' AND retry_at < '%s'
-	`,
-		table.name, StatusDone, time.Now().Add(-table.keep).Format(Rfc3339Micro),
-	)
-	if result, err := db.Exec(sql); err != nil {
+// ReapStale reset messages claimed by ClaimByUpdate mode before olderThan ago back to waiting,
+// they are considered stuck by crashed consumers. Their tried count is increased.
+// Return the number of reset messages.
+func (table *StdTable) ReapStale(db DBOrTx, olderThan time.Duration) (int64, error) {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {tried_count} = {tried_count} + 1, {retry_at} = $2, {locked_at} = NULL
+	WHERE {status} = $3 AND {locked_at} < $4
+	`, table.name)
+	var now = table.timeNow()
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, sql, StatusWaiting, now, StatusProcessing, now.Add(-olderThan))
+	if err != nil {
 		return 0, errs.Trace(err)
-	} else if n, err := result.RowsAffected(); err != nil {
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
 		return 0, errs.Trace(err)
-	} else {
-		return n, nil
 	}
+	return n, nil
 }
 
-func (table *StdTable) Name() string {
-	return table.name
+// SetDebugSQL set a function called with the query and args before each statement on messages
+// runs, such as the generated EarliestMessage query, inserts and updates, so that they can be
+// logged or EXPLAINed to check the index usage. DDL statements are not included.
+// If fn is nil, statements are run directly without any overhead.
+func (table *StdTable) SetDebugSQL(fn func(query string, args ...interface{})) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.debugSQL = fn
+}
+
+// wrap return a DBOrTx which calls the DebugSQL function before each statement runs, or db itself
+// if it's not set.
+func (table *StdTable) wrap(db DBOrTx) DBOrTx {
+	table.mutex.RLock()
+	fn := table.debugSQL
+	table.mutex.RUnlock()
+	if fn == nil {
+		return db
+	}
+	return stdDB{DBOrTx: db, debug: fn}
+}
+
+type stdDB struct {
+	DBOrTx
+	debug func(query string, args ...interface{})
+}
+
+func (db stdDB) prepare(query string, args []interface{}) string {
+	db.debug(query, args...)
+	return query
+}
+
+func (db stdDB) QueryContext(
+	ctx context.Context, query string, args ...interface{},
+) (*sql.Rows, error) {
+	return db.DBOrTx.QueryContext(ctx, db.prepare(query, args), args...)
+}
+
+func (db stdDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.DBOrTx.QueryRowContext(ctx, db.prepare(query, args), args...)
+}
+
+func (db stdDB) ExecContext(
+	ctx context.Context, query string, args ...interface{},
+) (sql.Result, error) {
+	return db.DBOrTx.ExecContext(ctx, db.prepare(query, args), args...)
+}
+
+// the columns of a table created by StdTableOptions, in the order of creating.
+var stdColumns = []string{
+	"id", "queue", "status", "created_at", "tried_count", "retry_at", "data", "priority",
+	"trace_context", "headers", "dedup_key", "locked_at", "group_key", "expires_at", "type",
+}
+
+// check the keys of a column mapping are standard columns.
+func checkColumns(columns map[string]string) error {
+	for column := range columns {
+		var ok bool
+		for _, std := range stdColumns {
+			ok = ok || column == std
+		}
+		if !ok {
+			return fmt.Errorf("sqlmq: unknown column %s to rename", column)
+		}
+	}
+	return nil
+}
+
+// columnNames resolve the standard columns written as "{column}" in the statements of StdTable to
+// the columns of a table, see StdTableOptions.Columns. The zero value resolves them to the
+// standard names.
+type columnNames struct {
+	replacer *strings.Replacer
+}
+
+var stdColumnNames = newColumnNames(nil)
+
+// newColumnNames build the columnNames from a column mapping checked by checkColumns.
+func newColumnNames(columns map[string]string) columnNames {
+	var oldnew []string
+	for _, std := range stdColumns {
+		var column = std
+		if columns[std] != "" {
+			column = columns[std]
+		}
+		// a resolved format is formatted by fmt.Sprintf then.
+		oldnew = append(oldnew, "{"+std+"}", strings.Replace(column, "%", "%%", -1))
+	}
+	return columnNames{strings.NewReplacer(oldnew...)}
+}
+
+// sqlf resolve the columns in format, and then format it with args like fmt.Sprintf.
+// Only format is resolved, args such as table names and quoted literals are kept as they are.
+func (c columnNames) sqlf(format string, args ...interface{}) string {
+	if c.replacer == nil {
+		c = stdColumnNames
+	}
+	return fmt.Sprintf(c.replacer.Replace(format), args...)
+}
+
+// ErrPayloadTooLarge is returned when producing a StdMessage whose marshaled Data exceeds the max
+// data bytes of the table, see StdTable.SetMaxDataBytes.
+var ErrPayloadTooLarge = errors.New("sqlmq: message data exceeds the max data bytes")
+
+// SetMaxDataBytes set the max bytes of the marshaled Data of a StdMessage to produce, a message
+// exceeds it is not inserted, and ErrPayloadTooLarge is returned. If max <= 0, there is no limit.
+func (table *StdTable) SetMaxDataBytes(max int) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.maxDataBytes = max
+}
+
+// SetQueuePriorities set the default priorities of queues. When a StdMessage with zero Priority
+// is produced, its Priority is set to the priority of its queue.
+// Due messages are consumed in the order of priority, and then in the order of RetryAt.
+func (table *StdTable) SetQueuePriorities(priorities map[string]int16) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.priorities = priorities
+}
+
+// SetNotifyChannel set the channel to NOTIFY when a message is produced, so the consuming loops
+// which LISTEN on it (see SqlMQ.ListenChannel) are waken up. An empty channel disables NOTIFY.
+func (table *StdTable) SetNotifyChannel(channel string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.notifyChannel = channel
+}
+
+func (table *StdTable) notify(db DBOrTx, consumeAt time.Time) error {
+	table.mutex.RLock()
+	channel := table.notifyChannel
+	table.mutex.RUnlock()
+	if channel == "" {
+		return nil
+	}
+	if err := notifyChannel(db, channel, consumeAt); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// Codec return the codec to marshal and unmarshal the Data of StdMessage.
+func (table *StdTable) Codec() Codec {
+	if table.codec != nil {
+		return table.codec
+	}
+	return JSONCodec
+}
+
+func (table *StdTable) produceArgs(msg *StdMessage) ([]interface{}, error) {
+	table.setPriority(msg)
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = table.timeNow()
+	}
+	args, err := msg.produceArgs(table.Codec(), table.binaryData)
+	if err != nil {
+		return nil, err
+	}
+	table.mutex.RLock()
+	maxDataBytes := table.maxDataBytes
+	table.mutex.RUnlock()
+	if maxDataBytes > 0 {
+		var size int
+		switch data := args[1].(type) {
+		case string:
+			size = len(data)
+		case []byte:
+			size = len(data)
+		}
+		if size > maxDataBytes {
+			return nil, ErrPayloadTooLarge
+		}
+	}
+	if table.uuid {
+		if msg.UUID == "" {
+			if msg.UUID, err = newUUID(); err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, msg.UUID)
+	}
+	return args, nil
+}
+
+// the columns to insert when producing a StdMessage, in the order of table.produceArgs.
+func (table *StdTable) produceColumns() string {
+	if table.uuid {
+		return stdProduceColumns + ", {id}"
+	}
+	return stdProduceColumns
+}
+
+// idOf return the value of the id column of a message.
+func (table *StdTable) idOf(message Message) interface{} {
+	if msg, ok := message.(*StdMessage); ok && table.uuid {
+		return msg.UUID
+	}
+	return message.GetId()
+}
+
+func (table *StdTable) setPriority(message Message) {
+	if msg, ok := message.(*StdMessage); ok && msg.Priority == 0 {
+		table.mutex.RLock()
+		msg.Priority = table.priorities[msg.Queue]
+		table.mutex.RUnlock()
+	}
+}
+
+func (table *StdTable) EarliestMessage(tx DBOrTx) (Message, error) {
+	tx = table.wrap(tx)
+	querysql, args := table.getEarliestMessageSql()
+	if _, ok := table.msg.(*StdMessage); ok {
+		return queryStdMessage(tx, querysql, args...)
+	}
+	return table.msg.EarliestMessage(tx, querysql)
+}
+
+// EarliestMessageOfQueue is the same as EarliestMessage, except that only messages of the queue
+// are fetched, see SqlMQ.QueueWeights. Only works if the table's message is a *StdMessage.
+func (table *StdTable) EarliestMessageOfQueue(tx DBOrTx, queue string) (Message, error) {
+	if _, ok := table.msg.(*StdMessage); !ok {
+		return nil, fmt.Errorf("table %s doesn't support fetching by queue", table.name)
+	}
+	table.mutex.RLock()
+	querySql, dataArgs := table.queueMessageSql, table.dataArgs
+	table.mutex.RUnlock()
+	if querySql == "" {
+		// built with the write lock held like getEarliestMessageSql.
+		table.mutex.Lock()
+		if table.queueMessageSql == "" {
+			table.queueMessageSql = stdEarliestMessageSql(
+				table.columns, table.name, table.columns.sqlf(" AND {queue} = $1")+table.fetchCond(1),
+				table.claimMode, table.lockStrength(), table.fifo,
+			)
+		}
+		querySql, dataArgs = table.queueMessageSql, table.dataArgs
+		table.mutex.Unlock()
+	}
+	var args = append([]interface{}{queue}, dataArgs...)
+	return queryStdMessage(table.wrap(tx), querySql, args...)
+}
+
+// getEarliestMessageSql return the cached query and its args, or build it if the cache is cleared
+// by SetQueues or other setters. A query being run by an in-flight transaction is not affected by
+// the setters, the new query is used since the next fetching.
+func (table *StdTable) getEarliestMessageSql() (string, []interface{}) {
+	table.mutex.RLock()
+	querySql, args := table.earliestMessageSql, table.earliestArgs
+	table.mutex.RUnlock()
+	if querySql != "" {
+		return querySql, args
+	}
+
+	// build it with the write lock held, so that it's not built from stale settings and then
+	// cached after a setter has cleared the cache.
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if table.earliestMessageSql == "" {
+		if _, ok := table.msg.(*StdMessage); ok {
+			table.earliestMessageSql = stdEarliestMessageSql(
+				table.columns, table.name, table.fetchCond(0), table.claimMode, table.lockStrength(),
+				table.fifo,
+			)
+			table.earliestArgs = table.dataArgs
+		} else {
+			table.earliestMessageSql = table.msg.EarliestMessageSql(table.name, nil)
+			table.earliestArgs = nil
+		}
+	}
+	return table.earliestMessageSql, table.earliestArgs
+}
+
+// the extra condition to fetch messages, its args are table.dataArgs, whose placeholders follow
+// argsBefore args of the query. It must be called with table.mutex locked.
+func (table *StdTable) fetchCond(argsBefore int) string {
+	return table.pausedCond() + table.queuePattern + stdGroupCond(table.columns, table.name) +
+		table.columns.sqlf(stdNotExpiredCond) + renumberPlaceholders(table.dataFilter, argsBefore)
+}
+
+// the condition to exclude paused queues, must be called with table.mutex locked.
+func (table *StdTable) pausedCond() string {
+	if len(table.paused) == 0 {
+		return ""
+	}
+	var paused []string
+	for _, queue := range table.paused {
+		paused = append(paused, Quote(queue))
+	}
+	sort.Strings(paused)
+	return table.columns.sqlf(" AND {queue} NOT IN (%s)", strings.Join(paused, ","))
+}
+
+// EarliestMessages get at most limit due messages in the order of consuming, and lock them by
+// "FOR UPDATE SKIP LOCKED". It returns no message if the table's message is not a *StdMessage or
+// the claim mode is not ClaimSkipLocked, so the caller falls back to EarliestMessage.
+func (table *StdTable) EarliestMessages(tx *sql.Tx, limit int) ([]Message, error) {
+	if _, ok := table.msg.(*StdMessage); !ok {
+		return nil, nil
+	}
+	table.mutex.RLock()
+	var cond, order, mode = table.fetchCond(0), "{retry_at}, {id}", table.claimMode
+	if table.fifo {
+		order = "{id}"
+	}
+	var strength, args = table.lockStrength(), table.dataArgs
+	table.mutex.RUnlock()
+	if mode != ClaimSkipLocked {
+		return nil, nil
+	}
+	querySql := table.columns.sqlf(`
+	SELECT `+stdSelectColumns+`
+	FROM %s
+	WHERE {status} = '%s' AND {retry_at} <= now() %s
+	ORDER BY {priority} DESC, `+order+`
+	LIMIT %d
+	%s SKIP LOCKED
+	`, table.name, StatusWaiting, cond, limit, strength)
+
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	rows, err := table.wrap(tx).QueryContext(ctx, querySql, args...)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	defer rows.Close()
+	var msgs []Message
+	for rows.Next() {
+		msg, err := scanStdMessage(rows)
+		if err != nil {
+			return nil, errs.Trace(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Trace(err)
+	}
+	return msgs, nil
+}
+
+func (table *StdTable) MarkSuccess(tx DBOrTx, message Message) error {
+	tx = table.wrap(tx)
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {tried_count} = {tried_count}+1, {retry_at} = $2
+	WHERE {id} = $3
+	`, table.name)
+	return execAffectedOne(tx, sql, StatusDone, table.timeNow(), table.idOf(message))
+}
+
+func (table *StdTable) MarkRetry(db DBOrTx, message Message, retryAfter time.Duration) error {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {tried_count} = {tried_count} + 1,  {retry_at} = $2
+	WHERE {id} = $3
+	`, table.name)
+	var retryAt = Timestamps.Normalize(table.timeNow().Add(retryAfter))
+	if err := execAffectedOne(db, sql, StatusWaiting, retryAt, table.idOf(message)); err != nil {
+		return err
+	}
+	setRetryAt(message, retryAt)
+	return nil
+}
+
+// setRetryAt set the retry_at written by MarkRetry or MarkDeferred to message if it's a StdMessage,
+// so that message.ConsumeAt() return the time it will be attempted next.
+func setRetryAt(message Message, retryAt time.Time) {
+	if msg, ok := message.(*StdMessage); ok {
+		msg.RetryAt = retryAt
+	}
+}
+
+// MarkDeferred reschedule a message like MarkRetry, but its tried count is not incremented.
+func (table *StdTable) MarkDeferred(db DBOrTx, message Message, retryAfter time.Duration) error {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {retry_at} = $2
+	WHERE {id} = $3
+	`, table.name)
+	var retryAt = Timestamps.Normalize(table.timeNow().Add(retryAfter))
+	if err := execAffectedOne(db, sql, StatusWaiting, retryAt, table.idOf(message)); err != nil {
+		return err
+	}
+	setRetryAt(message, retryAt)
+	return nil
+}
+
+func (table *StdTable) MarkGivenUp(db DBOrTx, message Message) error {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {tried_count} = {tried_count} + 1, {retry_at} = $2
+	WHERE {id} = $3
+	`, table.name)
+	return execAffectedOne(db, sql, StatusGivenUp, table.timeNow(), table.idOf(message))
+}
+
+// RecordAttempt insert an attempt of a message into the "<name>_attempts" table.
+// It does nothing unless the table is opened with StdTableOptions.AuditAttempts.
+func (table *StdTable) RecordAttempt(db DBOrTx, message Message, attempt Attempt) error {
+	if !table.auditAttempts {
+		return nil
+	}
+	db = table.wrap(db)
+	sql := fmt.Sprintf(`
+	INSERT INTO %s_attempts
+		(message_id, try_count, worker, started_at, finished_at, error, outcome)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, table.name)
+	return execAffectedOne(db, sql, table.idOf(message), attempt.TryCount, attempt.Worker,
+		attempt.StartedAt, attempt.FinishedAt, attempt.Error, attempt.Outcome)
+}
+
+// if ProduceMessage runs succussfully, message id is set in message.
+func (table *StdTable) ProduceMessage(db DBOrTx, message Message) error {
+	return table.ProduceMessageContext(context.Background(), db, message)
+}
+
+// ProduceMessageContext is the same as ProduceMessage, except that the INSERT is cancelled when
+// ctx is done, for example when producing in a request handler whose context has a deadline.
+func (table *StdTable) ProduceMessageContext(ctx context.Context, db DBOrTx, message Message) error {
+	db = table.wrap(db)
+	var sql string
+	var args []interface{}
+	var err error
+	var id int64
+	var dest interface{} = &id
+	if msg, ok := message.(*StdMessage); ok {
+		if args, err = table.produceArgs(msg); err == nil {
+			sql = stdProduceSql(table.columns, table.name, table.produceColumns(), args)
+		}
+		dest = stdId{msg}
+	} else if m, ok := message.(ParamMessage); ok {
+		table.setPriority(message)
+		sql, args, err = m.ParamProduceSql(table.name)
+	} else {
+		table.setPriority(message)
+		sql, err = message.ProduceSql(table.name)
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sqlTimeoutDuration)
+	defer cancel()
+	if err := db.QueryRowContext(ctx, sql, args...).Scan(dest); err != nil {
+		return errs.Trace(err)
+	}
+	if _, ok := dest.(*int64); ok {
+		message.SetId(id)
+	}
+	return table.notify(db, message.ConsumeAt())
+}
+
+// ProduceMessageIfNew produce a message only if no message with the same DedupKey exists.
+// It returns whether the message is produced. If it's produced, message id is set in message.
+func (table *StdTable) ProduceMessageIfNew(db DBOrTx, msg *StdMessage) (bool, error) {
+	db = table.wrap(db)
+	args, err := table.produceArgs(msg)
+	if err != nil {
+		return false, err
+	}
+	querySql := table.columns.sqlf(`
+	INSERT INTO %s
+		(`+table.produceColumns()+`)
+	VALUES
+		%s
+	ON CONFLICT ({dedup_key}) `+dedupKeyCondition+` DO NOTHING
+	RETURNING {id}
+	`, table.name, placeholders(0, len(args)))
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	if err := db.QueryRowContext(ctx, querySql, args...).Scan(stdId{msg}); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errs.Trace(err)
+	}
+	return true, table.notify(db, msg.ConsumeAt())
+}
+
+// The max number of messages inserted by a single statement in ProduceMessages.
+// Postgres allows at most 65535 bind parameters in a statement.
+const produceBatchSize = 1000
+
+// ProduceMessages produce multiple messages by multi-row INSERTs, to save round-trips.
+// if ProduceMessages runs succussfully, message id is set in every message.
+func (table *StdTable) ProduceMessages(db DBOrTx, msgs []*StdMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	db = table.wrap(db)
+	var earliest time.Time
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > produceBatchSize {
+			n = produceBatchSize
+		}
+		if err := table.produceBatch(db, msgs[:n]); err != nil {
+			return err
+		}
+		for _, msg := range msgs[:n] {
+			if earliest.IsZero() || msg.RetryAt.Before(earliest) {
+				earliest = msg.RetryAt
+			}
+		}
+		msgs = msgs[n:]
+	}
+	return table.notify(db, earliest)
 }
 
+func (table *StdTable) produceBatch(db DBOrTx, msgs []*StdMessage) error {
+	var values = make([]string, len(msgs))
+	var args []interface{}
+	for i, msg := range msgs {
+		msgArgs, err := table.produceArgs(msg)
+		if err != nil {
+			return err
+		}
+		values[i] = placeholders(len(args), len(msgArgs))
+		args = append(args, msgArgs...)
+	}
+	sql := table.columns.sqlf(`
+	INSERT INTO %s
+		(`+table.produceColumns()+`)
+	VALUES
+		%s
+	RETURNING {id}
+	`, table.name, strings.Join(values, ",\n\t\t"))
+
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	defer rows.Close()
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(stdId{msgs[i]}); err != nil {
+			return errs.Trace(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+func (table *StdTable) CleanMessages(db *sql.DB) (int64, error) {
+	cleaned, err := table.CleanMessagesByStatus(db)
+	var total int64
+	for _, n := range cleaned {
+		total += n
+	}
+	return total, err
+}
+
+// SetCleanRetention set how long to keep a message of a status after it's consumed (its retry_at)
+// before CleanMessages delete it. Messages of statuses not in retention are never deleted,
+// and waiting messages are never deleted. The default retention is {StatusDone: keep}.
+func (table *StdTable) SetCleanRetention(retention map[string]time.Duration) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.retention = retention
+}
+
+// VacuumAnalyze run "VACUUM ANALYZE" on the table, to reclaim the space of cleaned messages and
+// update the statistics used by the planner. On a high-volume table, dead rows left by cleaning
+// slow down fetching the earliest message until autovacuum catches up, run it after a big
+// cleaning or periodically if autovacuum isn't frequent enough for the table.
+// It can't run in a transaction, and it isn't bounded by a timeout since it may take long.
+func (table *StdTable) VacuumAnalyze(db *sql.DB) error {
+	if _, err := table.wrap(db).ExecContext(
+		context.Background(), fmt.Sprintf("VACUUM ANALYZE %s", table.name),
+	); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+// CreatePartition create a partition named "<table name>_<suffix>" of a table created with
+// StdTableOptions.PartitionBy if it doesn't exist. bound is the partition bound, for example
+// "FOR VALUES FROM ('2021-05-01') TO ('2021-06-01')" or "DEFAULT".
+func (table *StdTable) CreatePartition(db *sql.DB, suffix, bound string) error {
+	return execDDL(db, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s_%s PARTITION OF %s %s`, table.name, suffix, table.name, bound,
+	))
+}
+
+// DropPartition drop the partition named "<table name>_<suffix>" if it exists, with all its
+// messages. It's much cheaper than cleaning the messages one by one for a huge table.
+func (table *StdTable) DropPartition(db *sql.DB, suffix string) error {
+	return execDDL(db, fmt.Sprintf(`DROP TABLE IF EXISTS %s_%s`, table.name, suffix))
+}
+
+// SetCleanBatchSize set at most how many messages to delete by one statement in CleanMessages,
+// so that cleaning a large backlog doesn't lock too many rows or write a big WAL at once.
+// A non-positive size deletes all the messages of a status by one statement.
+func (table *StdTable) SetCleanBatchSize(size int) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.cleanBatchSize = size
+}
+
+// SetArchiveTable set the table to move cleaned messages into, instead of deleting them.
+// The archive table, for example "<name>_archive", is created with the same columns as the table
+// if it doesn't exist. The columns of the two tables must keep the same. Empty archive disables it.
+func (table *StdTable) SetArchiveTable(db *sql.DB, archive string) error {
+	if archive != "" {
+		ctx, cancel := sqlTimeout()
+		defer cancel()
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s (LIKE %s)`, archive, table.name,
+		)); err != nil {
+			return errs.Trace(err)
+		}
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.archive = archive
+	return nil
+}
+
+// CleanMessagesByStatus clean messages by the clean retention, and return the number of cleaned
+// messages of every status. Cleaned messages are moved into the archive table if it's set.
+func (table *StdTable) CleanMessagesByStatus(db *sql.DB) (map[string]int64, error) {
+	table.mutex.RLock()
+	retention, archive, batchSize := table.retention, table.archive, table.cleanBatchSize
+	table.mutex.RUnlock()
+	if retention == nil {
+		retention = map[string]time.Duration{StatusDone: table.keep}
+	}
+
+	var cond = table.columns.sqlf("{status} = $1 AND {retry_at} < $2")
+	if batchSize > 0 {
+		cond = table.columns.sqlf(
+			"{id} IN (SELECT {id} FROM %s WHERE %s LIMIT %d)", table.name, cond, batchSize,
+		)
+	}
+	sql := fmt.Sprintf(`
+	DELETE FROM %s
+	WHERE %s
+	`, table.name, cond)
+	if archive != "" {
+		sql = fmt.Sprintf(`
+	WITH archived AS (
+		DELETE FROM %s
+		WHERE %s
+		RETURNING *
+	)
+	INSERT INTO %s SELECT * FROM archived
+	`, table.name, cond, archive)
+	}
+	var conn = table.wrap(db)
+	var cleaned = make(map[string]int64)
+	for status, keep := range retention {
+		if status == StatusWaiting || status == StatusProcessing {
+			continue
+		}
+		var before = table.timeNow().Add(-keep)
+		for {
+			if result, err := conn.ExecContext(context.Background(), sql, status, before); err != nil {
+				return cleaned, errs.Trace(err)
+			} else if n, err := result.RowsAffected(); err != nil {
+				return cleaned, errs.Trace(err)
+			} else {
+				cleaned[status] += n
+				if batchSize <= 0 || n < int64(batchSize) {
+					break
+				}
+			}
+		}
+	}
+	return cleaned, nil
+}
+
+// Cancel set a waiting message to be StatusCancelled, so it's never consumed, and return whether
+// it's cancelled. It returns false if the message doesn't exist or is not waiting, or if it's
+// being consumed: a message locked by a consumer is skipped instead of waited for, so Cancel
+// always loses the race to an in-progress consume, even if the message is retried afterwards.
+// Cancelled messages are cleaned if StatusCancelled is set in StdTable.SetCleanRetention.
+func (table *StdTable) Cancel(db DBOrTx, id int64) (bool, error) {
+	db = table.wrap(db)
+	table.mutex.RLock()
+	var cond, lock = "", string(table.lockStrength()) + " SKIP LOCKED"
+	if table.claimMode == ClaimAdvisoryLock {
+		cond, lock = " AND pg_try_advisory_xact_lock({id})", string(table.lockStrength())
+	}
+	table.mutex.RUnlock()
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1
+	WHERE {id} = (
+		SELECT {id} FROM %s
+		WHERE {id} = $2 AND {status} = $3`+cond+`
+		%s
+	)
+	`, table.name, table.name, lock)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, sql, StatusCancelled, id, StatusWaiting)
+	if err != nil {
+		return false, errs.Trace(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errs.Trace(err)
+	}
+	return n == 1, nil
+}
+
+// ExpireMessages set the waiting messages whose ExpiresAt has passed to be StatusExpired, and
+// return the number of expired messages. Messages being consumed are skipped like Cancel.
+// It's called by SqlMQ before cleaning, expired messages are cleaned if StatusExpired is set in
+// StdTable.SetCleanRetention.
+func (table *StdTable) ExpireMessages(db DBOrTx) (int64, error) {
+	db = table.wrap(db)
+	table.mutex.RLock()
+	var cond, lock = "", string(table.lockStrength()) + " SKIP LOCKED"
+	if table.claimMode == ClaimAdvisoryLock {
+		cond, lock = " AND pg_try_advisory_xact_lock({id})", string(table.lockStrength())
+	}
+	table.mutex.RUnlock()
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {retry_at} = $2
+	WHERE {id} IN (
+		SELECT {id} FROM %s
+		WHERE {status} = $3 AND {expires_at} <= $2`+cond+`
+		%s
+	)
+	`, table.name, table.name, lock)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, sql, StatusExpired, table.timeNow(), StatusWaiting)
+	if err != nil {
+		return 0, errs.Trace(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errs.Trace(err)
+	}
+	return n, nil
+}
+
+// Requeue reset a message to be waiting, and to be consumed right now, so a given up or done message
+// can be consumed again. If resetTriedCount is true, its tried count is reset to 0.
+// Requeue a waiting message is a no-op. A message claimed by ClaimByUpdate (StatusProcessing) is
+// being handled by a consumer, it's not requeued and an error is returned, otherwise it would be
+// handled twice.
+func (table *StdTable) Requeue(db DBOrTx, id int64, resetTriedCount bool) error {
+	db = table.wrap(db)
+	var set string
+	if resetTriedCount {
+		set = ", {tried_count} = 0"
+	}
+	querySql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {retry_at} = $2 `+set+`
+	WHERE {id} = $3 AND {status} NOT IN ($1, $4)
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, querySql, StatusWaiting, table.timeNow(), id, StatusProcessing)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errs.Trace(err)
+	} else if n == 0 {
+		var status string
+		if err := db.QueryRowContext(ctx, table.columns.sqlf(
+			`SELECT {status} FROM %s WHERE {id} = $1`, table.name,
+		), id).Scan(&status); err == sql.ErrNoRows {
+			return errs.Tracef("message %d not found", id)
+		} else if err != nil {
+			return errs.Trace(err)
+		}
+		if status == StatusProcessing {
+			return errs.Tracef("message %d is being consumed", id)
+		}
+		return nil
+	}
+	return table.notify(db, time.Now())
+}
+
+// RequeueWhere reset all the non-waiting messages matching queue, status and before to be waiting,
+// and to be consumed right now. It returns the number of requeued messages.
+// Messages being handled (StatusProcessing) are never matched, like Requeue.
+// Empty queue or status matches any one, but at least one of them must not be empty.
+// Zero before matches any time, otherwise only messages whose retry_at is before it are matched.
+func (table *StdTable) RequeueWhere(
+	db DBOrTx, queue, status string, before time.Time,
+) (int64, error) {
+	if queue == "" && status == "" {
+		return 0, errors.New("RequeueWhere: queue and status must not be both empty")
+	}
+	db = table.wrap(db)
+	var conds = []string{"{status} NOT IN ($1, $3)"}
+	var args = []interface{}{StatusWaiting, table.timeNow(), StatusProcessing}
+	if queue != "" {
+		args = append(args, queue)
+		conds = append(conds, fmt.Sprintf("{queue} = $%d", len(args)))
+	}
+	if status != "" {
+		args = append(args, status)
+		conds = append(conds, fmt.Sprintf("{status} = $%d", len(args)))
+	}
+	if !before.IsZero() {
+		args = append(args, before)
+		conds = append(conds, fmt.Sprintf("{retry_at} < $%d", len(args)))
+	}
+	sql := table.columns.sqlf(`
+	UPDATE %s
+	SET {status} = $1, {retry_at} = $2
+	WHERE `+strings.Join(conds, " AND ")+`
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	result, err := db.ExecContext(ctx, sql, args...)
+	if err != nil {
+		return 0, errs.Trace(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errs.Trace(err)
+	}
+	if n > 0 {
+		if err := table.notify(db, time.Now()); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// QueueStat is the statistics of messages in a queue.
+type QueueStat struct {
+	Queue         string
+	Waiting       int
+	Done          int
+	GivenUp       int
+	Cancelled     int
+	OldestRetryAt time.Time // the earliest retry_at of waiting messages, zero if no waiting ones.
+}
+
+// Stats return the statistics of every queue, ordered by queue name.
+func (table *StdTable) Stats(db DBOrTx) ([]QueueStat, error) {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	SELECT {queue},
+		count(*) FILTER (WHERE {status} = $1),
+		count(*) FILTER (WHERE {status} = $2),
+		count(*) FILTER (WHERE {status} = $3),
+		count(*) FILTER (WHERE {status} = $4),
+		min({retry_at}) FILTER (WHERE {status} = $1)
+	FROM %s
+	GROUP BY {queue}
+	ORDER BY {queue}
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, sql, StatusWaiting, StatusDone, StatusGivenUp, StatusCancelled)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	defer rows.Close()
+	var stats []QueueStat
+	for rows.Next() {
+		var stat QueueStat
+		var oldestRetryAt *time.Time
+		if err := rows.Scan(
+			&stat.Queue, &stat.Waiting, &stat.Done, &stat.GivenUp, &stat.Cancelled, &oldestRetryAt,
+		); err != nil {
+			return nil, errs.Trace(err)
+		}
+		if oldestRetryAt != nil {
+			stat.OldestRetryAt = *oldestRetryAt
+		}
+		stats = append(stats, stat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Trace(err)
+	}
+	return stats, nil
+}
+
+// Backlog count the waiting messages of every queue.
+func (table *StdTable) Backlog(db DBOrTx) (map[string]int64, error) {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	SELECT {queue}, count(*)
+	FROM %s
+	WHERE {status} = $1
+	GROUP BY {queue}
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, sql, StatusWaiting)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	defer rows.Close()
+	var backlog = make(map[string]int64)
+	for rows.Next() {
+		var queue string
+		var count int64
+		if err := rows.Scan(&queue, &count); err != nil {
+			return nil, errs.Trace(err)
+		}
+		backlog[queue] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Trace(err)
+	}
+	return backlog, nil
+}
+
+// NextDue return the earliest retry_at of all the waiting messages, which is when the consuming
+// loop should wake up next for this table. It's zero if there are no waiting messages.
+func (table *StdTable) NextDue(db DBOrTx) (time.Time, error) {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`SELECT min({retry_at}) FROM %s WHERE {status} = $1`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	var nextDue *time.Time
+	if err := db.QueryRowContext(ctx, sql, StatusWaiting).Scan(&nextDue); err != nil {
+		return time.Time{}, errs.Trace(err)
+	}
+	if nextDue == nil {
+		return time.Time{}, nil
+	}
+	return *nextDue, nil
+}
+
+// Peek return the next waiting message of a queue without consuming or locking it,
+// or nil if the queue has no waiting messages. Only works if the table's message is a *StdMessage.
+func (table *StdTable) Peek(db DBOrTx, queue string) (Message, error) {
+	if _, ok := table.msg.(*StdMessage); !ok {
+		return nil, fmt.Errorf("table %s doesn't support peek", table.name)
+	}
+	db = table.wrap(db)
+	querySql := table.columns.sqlf(`
+	SELECT `+stdSelectColumns+`
+	FROM %s
+	WHERE {queue} = $1 AND {status} = $2
+	ORDER BY {retry_at} > now(), CASE WHEN {retry_at} > now() THEN 0 ELSE {priority} END DESC,
+		{retry_at}, {id}
+	LIMIT 1
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	msg, err := scanStdMessage(db.QueryRowContext(ctx, querySql, queue, StatusWaiting))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errs.Trace(err)
+	}
+	return msg, nil
+}
+
+// QueueLen count the waiting messages of a queue.
+func (table *StdTable) QueueLen(db DBOrTx, queue string) (int, error) {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(
+		`SELECT count(*) FROM %s WHERE {queue} = $1 AND {status} = $2`, table.name,
+	)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	var n int
+	if err := db.QueryRowContext(ctx, sql, queue, StatusWaiting).Scan(&n); err != nil {
+		return 0, errs.Trace(err)
+	}
+	return n, nil
+}
+
+// CountByStatus count the waiting, done and given up messages of a queue by a single query,
+// which can use the (queue, status, retry_at) index, so it's cheap enough for frequent polling.
+func (table *StdTable) CountByStatus(db DBOrTx, queue string) (
+	waiting, done, givenUp int64, err error,
+) {
+	db = table.wrap(db)
+	sql := table.columns.sqlf(`
+	SELECT {status}, count(*) FROM %s
+	WHERE {queue} = $1 AND {status} IN ($2, $3, $4)
+	GROUP BY {status}
+	`, table.name)
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, sql, queue, StatusWaiting, StatusDone, StatusGivenUp)
+	if err != nil {
+		return 0, 0, 0, errs.Trace(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return 0, 0, 0, errs.Trace(err)
+		}
+		switch status {
+		case StatusWaiting:
+			waiting = n
+		case StatusDone:
+			done = n
+		case StatusGivenUp:
+			givenUp = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, 0, errs.Trace(err)
+	}
+	return
+}
+
+func (table *StdTable) Name() string {
+	return table.name
+}
+
+const sqlTimeoutDuration = 10 * time.Second
+
 func sqlTimeout() (context.Context, func()) {
-	return context.WithTimeout(context.Background(), 10*time.Second)
+	return context.WithTimeout(context.Background(), sqlTimeoutDuration)
+}
+
+// execute a statement which should affect exactly one row.
+func execAffectedOne(db DBOrTx, sql string, args ...interface{}) error {
+	ctx, cancel := sqlTimeout()
+	defer cancel()
+	if result, err := db.ExecContext(ctx, sql, args...); err != nil {
+		return errs.Trace(err)
+	} else {
+		return checkAffectedOne(result)
+	}
 }
 
 func checkAffectedOne(result sql.Result) error {
@@ -319,6 +2094,7 @@ func checkAffectedOne(result sql.Result) error {
 }
 
 // Quote a string, removing all zero byte('\000') in it.
+// Bound parameters should be preferred, use Quote only where they are unavailable.
 func Quote(s string) string {
 	s = strings.Replace(s, "'", "''", -1)
 	s = strings.Replace(s, "\000", "", -1)
@@ -3,7 +3,10 @@ package sqlmq
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -14,6 +17,1036 @@ func ExampleNewStdTable() {
 	// test_name 24h0m0s
 }
 
+func ExampleNewStdTable_migrate() {
+	if _, err := testDB.Exec(`
+DROP TABLE IF EXISTS test_migrate;
+CREATE TABLE test_migrate (
+	id            bigserial    NOT NULL PRIMARY KEY,
+	queue         text         NOT NULL,
+	status        text         NOT NULL,
+	created_at    timestamptz  NOT NULL,
+	tried_count   smallint     NOT NULL,
+	retry_at      timestamptz  NOT NULL,
+	data          jsonb        NOT NULL
+)`); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_migrate", 0)
+	msg := &StdMessage{Queue: "migrated", Priority: 1}
+	fmt.Println(table.ProduceMessage(testDB, msg), msg.Id > 0)
+	// Output:
+	// <nil> true
+}
+
+func ExampleNewStdTableWithOptions() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_options"); err != nil {
+		panic(err)
+	}
+	table := NewStdTableWithOptions(testDB, "test_options", 0, StdTableOptions{
+		StorageParams: "fillfactor = 70",
+		ExtraIndexes: []string{
+			"CREATE INDEX IF NOT EXISTS test_options_queue_retry_at ON test_options (queue, retry_at)",
+		},
+	})
+	fmt.Println(table.Name(), table.Codec() == JSONCodec)
+
+	var options string
+	if err := testDB.QueryRow(
+		`SELECT array_to_string(reloptions, ',') FROM pg_class WHERE relname = 'test_options'`,
+	).Scan(&options); err != nil {
+		panic(err)
+	}
+	var indexes int
+	if err := testDB.QueryRow(
+		`SELECT count(*) FROM pg_indexes WHERE indexname = 'test_options_queue_retry_at'`,
+	).Scan(&indexes); err != nil {
+		panic(err)
+	}
+	fmt.Println(options, indexes)
+	// Output:
+	// test_options true
+	// fillfactor=70 1
+}
+
+func ExampleStdTableOptions_NoMigrate() {
+	table := NewStdTableWithOptions(nil, "not_existing", -1, StdTableOptions{NoMigrate: true})
+	fmt.Println(table.Name(), table.keep)
+
+	var exists bool
+	if err := testDB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM pg_class WHERE relname = 'not_existing')`,
+	).Scan(&exists); err != nil {
+		panic(err)
+	}
+	fmt.Println(exists)
+	// Output:
+	// not_existing 24h0m0s
+	// false
+}
+
+func ExampleStdTable_SetLockStrength() {
+	table := NewStdTableWithOptions(nil, "test_lock", 0, StdTableOptions{NoMigrate: true})
+	querySql, _ := table.getEarliestMessageSql()
+	fmt.Println(strings.Contains(querySql, "FOR UPDATE SKIP LOCKED"))
+	table.SetLockStrength(LockForNoKeyUpdate)
+	querySql, _ = table.getEarliestMessageSql()
+	fmt.Println(strings.Contains(querySql, "FOR NO KEY UPDATE SKIP LOCKED"))
+	table.SetClaimMode(ClaimAdvisoryLock)
+	querySql, _ = table.getEarliestMessageSql()
+	fmt.Println(strings.Contains(querySql, "FOR NO KEY UPDATE\n"))
+	// Output:
+	// true
+	// true
+	// true
+}
+
+func Example_stdEarliestMessageSql() {
+	var c = newColumnNames(map[string]string{"status": "state"})
+	for _, mode := range []ClaimMode{ClaimSkipLocked, ClaimAdvisoryLock} {
+		querySql := stdEarliestMessageSql(c, "sqlmq", "AND queue = 'a'", mode, LockForUpdate, true)
+		querySql = strings.Replace(querySql, c.sqlf(stdSelectColumns), "...", -1)
+		fmt.Println(strings.Join(strings.Fields(querySql), " "))
+	}
+	// Output:
+	// WITH due AS ( SELECT ... FROM sqlmq WHERE state = 'waiting' AND retry_at <= now() AND queue = 'a' ORDER BY priority DESC, id LIMIT 1 FOR UPDATE SKIP LOCKED ) SELECT * FROM due UNION ALL ( SELECT ... FROM sqlmq WHERE state = 'waiting' AND retry_at > now() AND queue = 'a' ORDER BY retry_at, id LIMIT 1 ) LIMIT 1
+	// WITH due AS ( SELECT ... FROM sqlmq WHERE state = 'waiting' AND retry_at <= now() AND queue = 'a' AND pg_try_advisory_xact_lock(id) ORDER BY priority DESC, id LIMIT 1 FOR UPDATE ) SELECT * FROM due UNION ALL ( SELECT ... FROM sqlmq WHERE state = 'waiting' AND retry_at > now() AND queue = 'a' ORDER BY retry_at, id LIMIT 1 ) LIMIT 1
+}
+
+func ExampleStdTableOptions_Columns() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_columns"); err != nil {
+		panic(err)
+	}
+	table := NewStdTableWithOptions(testDB, "test_columns", 0, StdTableOptions{
+		Columns: map[string]string{"queue": "topic", "data": "payload"},
+	})
+	if err := table.SetDataFilter(`payload->>'kind' = $1`, "a"); err != nil {
+		panic(err)
+	}
+	for _, kind := range []string{"b", "a"} {
+		msg := &StdMessage{Queue: "test", Data: map[string]string{"kind": kind}}
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.GetId(), msg.QueueName(), table.MarkSuccess(tx, msg))
+
+	var topic string
+	if err := tx.QueryRow(
+		`SELECT topic FROM test_columns WHERE payload->>'kind' = 'a'`,
+	).Scan(&topic); err != nil {
+		panic(err)
+	}
+	fmt.Println(topic)
+
+	_, err = OpenStdTable(testDB, "test_columns", 0, StdTableOptions{
+		Columns: map[string]string{"topic": "queue"},
+	})
+	fmt.Println(err)
+	// Output:
+	// 2 test <nil>
+	// test
+	// sqlmq: unknown column topic to rename
+}
+
+func ExampleStdTableOptions_AuditAttempts() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_audit, test_audit_attempts"); err != nil {
+		panic(err)
+	}
+	table, err := OpenStdTable(testDB, "test_audit", 0, StdTableOptions{AuditAttempts: true})
+	if err != nil {
+		panic(err)
+	}
+	var mq = &SqlMQ{DB: testDB, Table: table, Worker: "worker-1"}
+	var failed bool
+	if err := mq.Register("test", func(ctx context.Context, tx *sql.Tx, msg Message) (
+		time.Duration, bool, error,
+	) {
+		if !failed {
+			failed = true
+			return 0, true, errors.New("failed")
+		}
+		return 0, false, nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := mq.Produce(nil, &StdMessage{Queue: "test"}); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := mq.ConsumeOnce(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+	rows, err := testDB.Query(`
+	SELECT try_count, worker, error, outcome, finished_at >= started_at
+	FROM test_audit_attempts ORDER BY id`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tryCount int
+		var worker, errStr, outcome string
+		var ordered bool
+		if err := rows.Scan(&tryCount, &worker, &errStr, &outcome, &ordered); err != nil {
+			panic(err)
+		}
+		fmt.Printf("%d %s %q %s %v\n", tryCount, worker, errStr, outcome, ordered)
+	}
+	// Output:
+	// 1 worker-1 "failed" retry true
+	// 2 worker-1 "" success true
+}
+
+func Example_columnNames() {
+	var c = newColumnNames(map[string]string{"queue": "topic", "data": "payload", "status": "state"})
+	fmt.Println(c.sqlf(
+		`SELECT {id}, {queue}, {data} FROM %s WHERE {status} = %s`, "queue", Quote("{status}"),
+	))
+	fmt.Println(StdTableOptions{PartitionBy: "LIST (topic)"}.indexSql("sqlmq", c)[0])
+	fmt.Println(columnNames{}.sqlf(`SELECT {id}, {queue} FROM %s`, "sqlmq"))
+	// Output:
+	// SELECT id, topic, payload FROM queue WHERE state = '{status}'
+	// CREATE INDEX IF NOT EXISTS sqlmq_queue_status_retry_at ON sqlmq (topic, state, retry_at)
+	// SELECT id, queue FROM sqlmq
+}
+
+func ExampleOpenStdTable() {
+	table, err := OpenStdTable(testDB, "test_open", 0, StdTableOptions{})
+	fmt.Println(table.Name(), err)
+
+	table, err = OpenStdTable(testDB, "test_open1", 0, StdTableOptions{Tablespace: "not_existing"})
+	fmt.Println(table == nil, err)
+
+	table, err = OpenStdTable(testDB, "test_open2", 0, StdTableOptions{
+		ExtraIndexes: []string{"CREATE INDEX ON not_existing (id)"},
+	})
+	fmt.Println(table == nil, err)
+	// Output:
+	// test_open <nil>
+	// true pq: tablespace "not_existing" does not exist
+	// true pq: relation "not_existing" does not exist
+}
+
+func ExampleStdTableOptions_tableSql() {
+	fmt.Println(StdTableOptions{}.tableSql("sqlmq", stdColumnNames) == (&StdMessage{}).TableSql("sqlmq"))
+	// Output:
+	// true
+}
+
+func ExampleStdTableOptions_partitionBy() {
+	fmt.Print(StdTableOptions{PartitionBy: "RANGE (created_at, queue)", Tablespace: "fast"}.tableSql(
+		"sqlmq", stdColumnNames,
+	))
+	// Output:
+	// CREATE TABLE IF NOT EXISTS sqlmq (
+	// 	id            bigserial    NOT NULL,
+	// 	queue         text         NOT NULL,
+	// 	status        text         NOT NULL,
+	// 	created_at    timestamptz  NOT NULL,
+	// 	tried_count   smallint     NOT NULL,
+	// 	retry_at      timestamptz  NOT NULL,
+	// 	data          jsonb        NOT NULL,
+	// 	priority      smallint     NOT NULL DEFAULT 0,
+	// 	trace_context jsonb,
+	// 	headers       jsonb,
+	// 	dedup_key     text,
+	// 	locked_at     timestamptz,
+	// 	group_key     text,
+	// 	expires_at    timestamptz,
+	// 	type          text,
+	// 	PRIMARY KEY (id, created_at, queue)
+	// ) PARTITION BY RANGE (created_at, queue) TABLESPACE fast;
+}
+
+func ExampleStdTable_VacuumAnalyze() {
+	table := NewStdTable(testDB, "test_vacuum", 0)
+	if _, err := testDB.Exec("TRUNCATE test_vacuum RESTART IDENTITY"); err != nil {
+		panic(err)
+	}
+	var now = time.Now()
+	for _, status := range []string{StatusDone, StatusDone, StatusWaiting, StatusWaiting} {
+		msg := &StdMessage{Queue: "test", Status: status, RetryAt: now.Add(-time.Minute)}
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(table.CleanMessages(testDB))
+	fmt.Println(table.VacuumAnalyze(testDB))
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	// messages with the same retry_at are still consumed in the order of producing.
+	fmt.Println(msg.GetId() == 3)
+	// Output:
+	// 2 <nil>
+	// <nil>
+	// true
+}
+
+func ExampleStdTable_CreatePartition() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_partitioned"); err != nil {
+		panic(err)
+	}
+	table := NewStdTableWithOptions(testDB, "test_partitioned", 0, StdTableOptions{
+		PartitionBy: "LIST (queue)",
+	})
+	fmt.Println(table.CreatePartition(testDB, "a", "FOR VALUES IN ('a')"))
+	fmt.Println(table.CreatePartition(testDB, "default", "DEFAULT"))
+	for _, queue := range []string{"a", "b"} {
+		if err := table.ProduceMessage(testDB, &StdMessage{Queue: queue}); err != nil {
+			panic(err)
+		}
+	}
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.QueueName(), table.MarkSuccess(tx, msg))
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	fmt.Println(table.DropPartition(testDB, "a"))
+	var count int
+	if err := testDB.QueryRow("SELECT count(*) FROM test_partitioned").Scan(&count); err != nil {
+		panic(err)
+	}
+	fmt.Println(count)
+	// Output:
+	// <nil>
+	// <nil>
+	// a <nil>
+	// <nil>
+	// 1
+}
+
+func ExampleStdTable_ProduceMessage() {
+	table := NewStdTable(testDB, "test_table", 0)
+	msg := &StdMessage{Queue: "it's a \\queue", Data: `'quote', \backslash, 中文`}
+	if err := table.ProduceMessage(testDB, msg); err != nil {
+		panic(err)
+	}
+	var queue, data string
+	if err := testDB.QueryRow(
+		`SELECT queue, data FROM test_table WHERE id = $1`, msg.Id,
+	).Scan(&queue, &data); err != nil {
+		panic(err)
+	}
+	fmt.Println(queue)
+	fmt.Println(data)
+	// Output:
+	// it's a \queue
+	// "'quote', \\backslash, 中文"
+}
+
+func ExampleStdTable_ProduceMessageContext() {
+	table := NewStdTable(testDB, "test_table", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	msg := &StdMessage{Queue: "test"}
+	fmt.Println(table.ProduceMessageContext(ctx, testDB, msg), msg.Id > 0)
+
+	cancel()
+	msg = &StdMessage{Queue: "test"}
+	fmt.Println(table.ProduceMessageContext(ctx, testDB, msg), msg.Id)
+	// Output:
+	// <nil> true
+	// context canceled 0
+}
+
+func ExampleStdTable_SetMaxDataBytes() {
+	table := NewStdTable(testDB, "test_table", 0)
+	table.SetMaxDataBytes(5)
+	fmt.Println(table.ProduceMessage(testDB, &StdMessage{Queue: "test", Data: "abc"}))
+	fmt.Println(table.ProduceMessage(testDB, &StdMessage{Queue: "test", Data: "abcd"}))
+	fmt.Println(table.ProduceMessages(testDB, []*StdMessage{{Queue: "test", Data: []int{1, 2}}}))
+	// Output:
+	// <nil>
+	// sqlmq: message data exceeds the max data bytes
+	// sqlmq: message data exceeds the max data bytes
+}
+
+func ExampleStdTable_ProduceMessages() {
+	table := NewStdTable(testDB, "test_table", 0)
+	var msgs []*StdMessage
+	for i := 0; i < produceBatchSize+1; i++ {
+		msgs = append(msgs, &StdMessage{Queue: "batch", Data: i})
+	}
+	if err := table.ProduceMessages(testDB, msgs); err != nil {
+		panic(err)
+	}
+	fmt.Println(msgs[0].Id > 0, msgs[len(msgs)-1].Id > msgs[0].Id)
+	fmt.Println(table.ProduceMessages(testDB, []*StdMessage{{Data: make(chan int)}}))
+	// Output:
+	// true true
+	// json: unsupported type: chan int
+}
+
+func ExampleStdTable_SetQueuePriorities() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_priority"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_priority", 0)
+	table.SetQueuePriorities(map[string]int16{"urgent": 9})
+	var now = time.Now()
+	for _, msg := range []*StdMessage{
+		{Queue: "normal", RetryAt: now.Add(-time.Hour)},
+		{Queue: "urgent", RetryAt: now.Add(-time.Minute)},
+		{Queue: "urgent", RetryAt: now.Add(time.Hour)},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.QueueName(), msg.(*StdMessage).Priority, msg.ConsumeAt().Before(now))
+	// Output:
+	// urgent 9 true
+}
+
+func ExampleStdTable_SetDataFilter() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_filter"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_filter", 0)
+	for _, region := range []string{"eu", "us"} {
+		msg := &StdMessage{Queue: "test", Data: map[string]string{"region": region}}
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(table.SetDataFilter("data->>'region' = $1", "us"))
+	fmt.Println(table.SetDataFilter("data->>'region' = $2", "us"))
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(msg.(*StdMessage).Data.([]byte)))
+	// Output:
+	// <nil>
+	// sqlmq: no arg for placeholder $2
+	// {"region": "us"}
+}
+
+func ExampleStdTable_SetDataFilter_args() {
+	table := NewStdTableWithOptions(nil, "test_filter", 0, StdTableOptions{NoMigrate: true})
+	fmt.Println(table.SetDataFilter("data->>'region' = $1 AND data->>'note' <> '$2'", "us"))
+	db := sqliteFake.open()
+	defer db.Close()
+	fmt.Println(table.EarliestMessage(db))
+	// the arg is bound as a parameter instead of being quoted into the query.
+	var statement = strings.TrimSpace(sqliteFake.statements())
+	fmt.Println(strings.Contains(statement, "data->>'region' = $1 AND data->>'note' <> '$2'"))
+	fmt.Println(strings.HasSuffix(statement, " [us]"))
+	// Output:
+	// <nil>
+	// <nil> <nil>
+	// true
+	// true
+}
+
+func ExampleStdTable_EarliestMessageOfQueue() {
+	table := NewStdTableWithOptions(nil, "test_queue", 0, StdTableOptions{NoMigrate: true})
+	fmt.Println(table.SetDataFilter("data->>'region' = $1", "us"))
+	db := sqliteFake.open()
+	defer db.Close()
+	fmt.Println(table.EarliestMessageOfQueue(db, "a'b"))
+	fmt.Println(table.EarliestMessageOfQueue(db, "c"))
+	// the queue is bound as $1, and the placeholders of the filter follow it.
+	for _, statement := range strings.Split(strings.TrimSpace(sqliteFake.statements()), "\n") {
+		fmt.Println(
+			strings.Contains(statement, "queue = $1 AND") &&
+				strings.Contains(statement, "data->>'region' = $2"),
+			statement[strings.LastIndex(statement, " ["):],
+		)
+	}
+	// Output:
+	// <nil>
+	// <nil> <nil>
+	// <nil> <nil>
+	// true  [a'b us]
+	// true  [c us]
+}
+
+func Example_renumberPlaceholders() {
+	fmt.Println(renumberPlaceholders(`a = $1 AND b = '$1''$2' AND "c$1" = $2 -- $1`, 2))
+	fmt.Println(renumberPlaceholders(`d = $$ $1 $$ AND e = $tag$ $2 $tag$ /* $1 */ AND $10`, 2))
+	fmt.Println(checkPlaceholders("a = $1 AND b = '$2'", 1))
+	fmt.Println(checkPlaceholders("a = $1 AND b = '$2'", 2))
+	fmt.Println(checkPlaceholders("a = $2", 2))
+	// Output:
+	// a = $3 AND b = '$1''$2' AND "c$1" = $4 -- $1
+	// d = $$ $1 $$ AND e = $tag$ $2 $tag$ /* $1 */ AND $12
+	// <nil>
+	// sqlmq: no placeholder for arg $2
+	// sqlmq: no placeholder for arg $1
+}
+
+func ExampleStdTable_SetQueuePattern() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_pattern"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_pattern", 0)
+	for _, queue := range []string{"user.1.orders", "user.2.notifications"} {
+		if err := table.ProduceMessage(testDB, &StdMessage{Queue: queue}); err != nil {
+			panic(err)
+		}
+	}
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	for _, pattern := range []string{"user.%.notifications", "", "order.%"} {
+		table.SetQueuePattern(pattern)
+		msg, err := table.EarliestMessage(tx)
+		if err != nil {
+			panic(err)
+		}
+		if msg == nil {
+			fmt.Printf("%q none\n", pattern)
+		} else {
+			fmt.Printf("%q %s\n", pattern, msg.QueueName())
+		}
+	}
+	// Output:
+	// "user.%.notifications" user.2.notifications
+	// "" user.1.orders
+	// "order.%" none
+}
+
+func ExampleStdTable_SetDebugSQL() {
+	table := NewStdTable(testDB, "test_table", 0)
+	table.SetDebugSQL(func(query string, args ...interface{}) {
+		fmt.Println(strings.Fields(query)[0], args[0], args[2])
+	})
+	fmt.Println(table.MarkGivenUp(testDB, &StdMessage{Id: -1}))
+	table.SetDebugSQL(nil)
+	fmt.Println(table.MarkGivenUp(testDB, &StdMessage{Id: -1}))
+	// Output:
+	// UPDATE givenUp -1
+	// affected 0 rows
+	// affected 0 rows
+}
+
+func ExampleStdTable_SetClaimMode() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_claim"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_claim", 0)
+	table.SetClaimMode(ClaimAdvisoryLock)
+	for i := 0; i < 2; i++ {
+		if err := table.ProduceMessage(testDB, &StdMessage{Queue: "test", Data: i}); err != nil {
+			panic(err)
+		}
+	}
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		tx, err := testDB.Begin()
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback()
+		msg, err := table.EarliestMessage(tx)
+		if err != nil {
+			panic(err)
+		}
+		if msg != nil {
+			ids = append(ids, msg.GetId())
+		}
+	}
+	fmt.Println(len(ids), ids[0] != ids[1])
+	// Output:
+	// 2 true
+}
+
+func ExampleStdTable_ClaimsByUpdate() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_claim"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_claim", 0)
+	fmt.Println(table.ClaimsByUpdate())
+	table.SetClaimMode(ClaimByUpdate)
+	fmt.Println(table.ClaimsByUpdate())
+	var now = time.Now()
+	for _, msg := range []*StdMessage{
+		{Queue: "test", RetryAt: now.Add(-time.Minute)},
+		{Queue: "test", RetryAt: now.Add(time.Hour)},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	var earliest = func() Message {
+		tx, err := testDB.Begin()
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Commit()
+		msg, err := table.EarliestMessage(tx)
+		if err != nil {
+			panic(err)
+		}
+		return msg
+	}
+	msg := earliest().(*StdMessage)
+	fmt.Println(msg.Status, msg.ConsumeAt().Before(now))
+	msg = earliest().(*StdMessage)
+	fmt.Println(msg.Status, msg.ConsumeAt().After(now))
+
+	fmt.Println(table.ReapStale(testDB, time.Hour))
+	fmt.Println(table.ReapStale(testDB, 0))
+	// Output:
+	// false
+	// true
+	// processing true
+	// waiting true
+	// 0 <nil>
+	// 1 <nil>
+}
+
+func ExampleStdTable_SetFIFO() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_fifo"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_fifo", 0)
+	var now = time.Now()
+	var msgs = []*StdMessage{
+		{Queue: "test", Data: 1, RetryAt: now.Add(-time.Minute)},
+		{Queue: "test", Data: 2, RetryAt: now.Add(-time.Minute)},
+		{Queue: "test", Data: 3, RetryAt: now.Add(-time.Hour)},
+	}
+	for _, msg := range msgs {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	var earliest = func() int64 {
+		tx, err := testDB.Begin()
+		if err != nil {
+			panic(err)
+		}
+		defer tx.Rollback()
+		msg, err := table.EarliestMessage(tx)
+		if err != nil {
+			panic(err)
+		}
+		return msg.GetId()
+	}
+	fmt.Println(earliest() == msgs[2].Id)
+	if _, err := testDB.Exec(`UPDATE test_fifo SET retry_at = $1`, now.Add(-time.Minute)); err != nil {
+		panic(err)
+	}
+	fmt.Println(earliest() == msgs[0].Id) // same retry_at, ordered by id.
+
+	if _, err := testDB.Exec(
+		`UPDATE test_fifo SET retry_at = $1 WHERE id = $2`, now.Add(-time.Hour), msgs[1].Id,
+	); err != nil {
+		panic(err)
+	}
+	table.SetFIFO(true)
+	fmt.Println(earliest() == msgs[0].Id)
+	// Output:
+	// true
+	// true
+	// true
+}
+
+func ExampleStdMessage_DataInto() {
+	var v struct {
+		Id   int64
+		Name string
+	}
+	msg := &StdMessage{Data: []byte(`{"Id": 9007199254740993, "Name": "a"}`)}
+	fmt.Println(msg.DataInto(&v), v.Id, v.Name)
+
+	var i interface{}
+	fmt.Println(msg.DataInto(&i), i.(map[string]interface{})["Id"])
+
+	msg = &StdMessage{Data: map[string]int{"Id": 1}}
+	fmt.Println(msg.DataInto(&v), v.Id)
+	// Output:
+	// <nil> 9007199254740993 a
+	// <nil> 9007199254740993
+	// <nil> 1
+}
+
+func ExampleStdMessage_Headers() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_headers"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_headers", 0)
+	var headers = map[string]string{"correlationId": "abc", "source": "order's service"}
+	if err := table.ProduceMessage(testDB, &StdMessage{Queue: "test", Headers: headers}); err != nil {
+		panic(err)
+	}
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.(*StdMessage).Headers)
+	// Output:
+	// map[correlationId:abc source:order's service]
+}
+
+func ExampleStdMessage_GroupKey() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_group"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_group", 0)
+	var now = time.Now()
+	var msgs = []*StdMessage{
+		{Queue: "test", GroupKey: "user-1", RetryAt: now.Add(time.Hour)},
+		{Queue: "test", GroupKey: "user-1", RetryAt: now.Add(-time.Hour)},
+		{Queue: "test", GroupKey: "user-2", RetryAt: now.Add(-time.Minute)},
+	}
+	for _, msg := range msgs {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	// msgs[1] is due but waits for msgs[0] of the same group.
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.GetId() == msgs[2].Id, msg.(*StdMessage).GroupKey)
+	// Output:
+	// true user-2
+}
+
+func ExampleStdTable_ProduceMessageIfNew() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_dedup"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_dedup", 0)
+	fmt.Println(table.ProduceMessageIfNew(testDB, &StdMessage{Queue: "test", DedupKey: "order-1"}))
+	fmt.Println(table.ProduceMessageIfNew(testDB, &StdMessage{Queue: "test", DedupKey: "order-1"}))
+	fmt.Println(table.ProduceMessageIfNew(testDB, &StdMessage{Queue: "test"}))
+	fmt.Println(table.ProduceMessageIfNew(testDB, &StdMessage{Queue: "test"}))
+	// Output:
+	// true <nil>
+	// false <nil>
+	// true <nil>
+	// true <nil>
+}
+
+func ExampleStdTable_SetCleanRetention() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_clean"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_clean", 0)
+	var now = time.Now()
+	for _, msg := range []*StdMessage{
+		{Queue: "test", Status: StatusDone, RetryAt: now.Add(-2 * time.Hour)},
+		{Queue: "test", Status: StatusDone, RetryAt: now.Add(-time.Minute)},
+		{Queue: "test", Status: StatusGivenUp, RetryAt: now.Add(-time.Minute)},
+		{Queue: "test", Status: StatusWaiting, RetryAt: now.Add(-time.Hour)},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	table.SetCleanRetention(map[string]time.Duration{
+		StatusDone: time.Hour, StatusGivenUp: 0, StatusWaiting: 0,
+	})
+	fmt.Println(table.CleanMessagesByStatus(testDB))
+	fmt.Println(table.CleanMessages(testDB))
+	// Output:
+	// map[done:1 givenUp:1] <nil>
+	// 0 <nil>
+}
+
+func ExampleStdTable_SetCleanBatchSize() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_clean_batch"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_clean_batch", 0)
+	table.SetCleanBatchSize(2)
+	for i := 0; i < 5; i++ {
+		var msg = &StdMessage{Queue: "test", Status: StatusDone, RetryAt: time.Now().Add(-time.Minute)}
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(table.CleanMessages(testDB))
+	fmt.Println(table.CleanMessages(testDB))
+	// Output:
+	// 5 <nil>
+	// 0 <nil>
+}
+
+func ExampleStdTable_SetArchiveTable() {
+	for _, name := range []string{"test_archive", "test_archive_archive"} {
+		if _, err := testDB.Exec("DROP TABLE IF EXISTS " + name); err != nil {
+			panic(err)
+		}
+	}
+	table := NewStdTable(testDB, "test_archive", 0)
+	if err := table.SetArchiveTable(testDB, "test_archive_archive"); err != nil {
+		panic(err)
+	}
+	var msg = &StdMessage{Queue: "test", Status: StatusDone, RetryAt: time.Now().Add(-time.Minute)}
+	if err := table.ProduceMessage(testDB, msg); err != nil {
+		panic(err)
+	}
+	fmt.Println(table.CleanMessages(testDB))
+	var id int64
+	if err := testDB.QueryRow(`SELECT id FROM test_archive_archive`).Scan(&id); err != nil {
+		panic(err)
+	}
+	fmt.Println(id == msg.Id)
+	// Output:
+	// 1 <nil>
+	// true
+}
+
+func ExampleStdTable_Stats() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_stats"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_stats", 0)
+	var retryAt = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, msg := range []*StdMessage{
+		{Queue: "a", Status: StatusWaiting, RetryAt: retryAt.Add(time.Hour)},
+		{Queue: "a", Status: StatusWaiting, RetryAt: retryAt},
+		{Queue: "a", Status: StatusDone},
+		{Queue: "b", Status: StatusGivenUp},
+		{Queue: "b", Status: StatusCancelled},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	stats, err := table.Stats(testDB)
+	if err != nil {
+		panic(err)
+	}
+	for _, stat := range stats {
+		fmt.Println(stat.Queue, stat.Waiting, stat.Done, stat.GivenUp, stat.Cancelled,
+			stat.OldestRetryAt.UTC())
+	}
+	// Output:
+	// a 2 1 0 0 2021-05-01 00:00:00 +0000 UTC
+	// b 0 0 1 1 0001-01-01 00:00:00 +0000 UTC
+}
+
+func ExampleStdTable_NextDue() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_next_due"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_next_due", 0)
+	fmt.Println(table.NextDue(testDB))
+	var at = time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, msg := range []*StdMessage{
+		{Queue: "a", RetryAt: at.Add(time.Hour)},
+		{Queue: "b", RetryAt: at},
+		{Queue: "b", RetryAt: at.Add(-time.Hour), Status: StatusDone},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	nextDue, err := table.NextDue(testDB)
+	fmt.Println(nextDue.UTC(), err)
+	// Output:
+	// 0001-01-01 00:00:00 +0000 UTC <nil>
+	// 2021-05-01 00:00:00 +0000 UTC <nil>
+}
+
+func ExampleStdTable_Peek() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_peek"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_peek", 0)
+	var now = time.Now()
+	for _, msg := range []*StdMessage{
+		{Queue: "a", Data: 1, RetryAt: now.Add(time.Hour)},
+		{Queue: "a", Data: 2, RetryAt: now.Add(-time.Minute)},
+		{Queue: "a", Data: 3, Status: StatusDone},
+		{Queue: "b", Data: 4},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	for _, queue := range []string{"a", "b", "c"} {
+		msg, err := table.Peek(testDB, queue)
+		if err != nil {
+			panic(err)
+		}
+		if msg != nil {
+			fmt.Print(string(msg.(*StdMessage).Data.([]byte)), " ")
+		}
+		fmt.Println(table.QueueLen(testDB, queue))
+	}
+	// Output:
+	// 2 2 <nil>
+	// 4 1 <nil>
+	// 0 <nil>
+}
+
+func ExampleStdMessage_ProduceSql() {
+	var msg = &StdMessage{
+		Queue: "test", Data: "it's {queue}", Priority: 1,
+		CreatedAt: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	sql, err := msg.ProduceSql("sqlmq")
+	fmt.Println(strings.Join(strings.Fields(sql), " "), err)
+	sql, args, err := msg.ParamProduceSql("sqlmq")
+	fmt.Println(strings.Join(strings.Fields(sql), " "), len(args), err)
+	// Output:
+	// INSERT INTO sqlmq (queue, data, status, created_at, tried_count, retry_at, priority, trace_context, headers, dedup_key, group_key, expires_at, type) VALUES ('test', '"it''s {queue}"', 'waiting', '2021-05-01T00:00:00Z', 0, '2021-05-01T00:00:00Z', 1, NULL, NULL, NULL, NULL, NULL, NULL) RETURNING id <nil>
+	// INSERT INTO sqlmq (queue, data, status, created_at, tried_count, retry_at, priority, trace_context, headers, dedup_key, group_key, expires_at, type) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id 13 <nil>
+}
+
+func ExampleStdMessage_type() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_type"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_type", 0)
+	if err := table.ProduceMessage(testDB, &StdMessage{Queue: "events", Type: "created"}); err != nil {
+		panic(err)
+	}
+	msg, err := table.EarliestMessage(testDB)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.(*StdMessage).Type)
+	// Output:
+	// created
+}
+
+func ExampleStdTable_ExpireMessages() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_expire"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_expire", 0)
+	for _, msg := range []*StdMessage{
+		{Queue: "otp", Data: "expired", ExpiresAt: time.Now().Add(-time.Second)},
+		{Queue: "otp", Data: "expiring", ExpiresAt: time.Now().Add(time.Hour)},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	msg, err := table.EarliestMessage(testDB)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(msg.(*StdMessage).Data.([]byte)), !msg.(*StdMessage).ExpiresAt.IsZero())
+	fmt.Println(table.ExpireMessages(testDB))
+	fmt.Println(table.ExpireMessages(testDB))
+	var status string
+	if err := testDB.QueryRow(`SELECT status FROM test_expire WHERE id = 1`).Scan(&status); err != nil {
+		panic(err)
+	}
+	fmt.Println(status)
+	// Output:
+	// "expiring" true
+	// 1 <nil>
+	// 0 <nil>
+	// expired
+}
+
+func ExampleStdTable_CountByStatus() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_count"); err != nil {
+		panic(err)
+	}
+	table := NewStdTable(testDB, "test_count", 0)
+	for _, msg := range []*StdMessage{
+		{Queue: "a"}, {Queue: "a"}, {Queue: "a", Status: StatusDone},
+		{Queue: "a", Status: StatusGivenUp}, {Queue: "a", Status: StatusCancelled}, {Queue: "b"},
+	} {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(table.CountByStatus(testDB, "a"))
+	fmt.Println(table.CountByStatus(testDB, "c"))
+	// Output:
+	// 2 1 1 <nil>
+	// 0 0 0 <nil>
+}
+
+func ExampleStdTable_Cancel() {
+	table := NewStdTable(testDB, "test_table", 0)
+	msg := &StdMessage{Queue: "test", RetryAt: time.Now().Add(time.Hour)}
+	if err := table.ProduceMessage(testDB, msg); err != nil {
+		panic(err)
+	}
+	// a message locked by a consumer is not cancelled.
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := tx.Exec(`SELECT id FROM test_table WHERE id = $1 FOR UPDATE`, msg.Id); err != nil {
+		panic(err)
+	}
+	fmt.Println(table.Cancel(testDB, msg.Id))
+	if err := tx.Rollback(); err != nil {
+		panic(err)
+	}
+
+	fmt.Println(table.Cancel(testDB, msg.Id))
+	fmt.Println(table.Cancel(testDB, msg.Id))
+
+	var status string
+	if err := testDB.QueryRow(
+		`SELECT status FROM test_table WHERE id = $1`, msg.Id,
+	).Scan(&status); err != nil {
+		panic(err)
+	}
+	fmt.Println(status)
+	// Output:
+	// false <nil>
+	// true <nil>
+	// false <nil>
+	// cancelled
+}
+
 func ExampleCreateTable() {
 	defer func() {
 		fmt.Println(recover() != nil)
@@ -0,0 +1,54 @@
+package sqlmq
+
+import "time"
+
+// Timestamps is the format of all the timestamps stored or sent by sqlmq, such as CreatedAt and
+// RetryAt of a StdMessage, the times set by Mark* methods, and the consume time in notifications.
+// Change it only before any SqlMQ or Table is used.
+var Timestamps = TimeFormat{Precision: time.Microsecond}
+
+// TimeFormat is the precision and timezone of timestamps.
+type TimeFormat struct {
+	// Convert timestamps to UTC, so that they're independent of the local timezone of producers
+	// and consumers. It matters for columns without timezone, such as MySQL DATETIME.
+	UTC bool
+	// Timestamps are truncated to Precision, so that a message in memory has exactly the same time
+	// as it's stored, and messages with the same RetryAt in the database keep their order in memory.
+	// PostgreSQL timestamptz only supports microseconds, a finer precision like time.Nanosecond
+	// only works for columns that support it. Zero means no truncation.
+	Precision time.Duration
+}
+
+// Normalize return t truncated to the precision and converted to UTC if required.
+// The monotonic clock reading is always stripped.
+func (format TimeFormat) Normalize(t time.Time) time.Time {
+	if format.Precision > 0 {
+		t = t.Truncate(format.Precision)
+	} else {
+		t = t.Round(0)
+	}
+	if format.UTC {
+		t = t.UTC()
+	}
+	return t
+}
+
+// Format return t normalized in RFC 3339 with fractional seconds up to the precision,
+// trailing zeros of fractional seconds are removed.
+func (format TimeFormat) Format(t time.Time) string {
+	return format.Normalize(t).Format(format.Layout())
+}
+
+// Layout return the RFC 3339 layout with fractional seconds up to the precision.
+func (format TimeFormat) Layout() string {
+	switch {
+	case format.Precision >= time.Second:
+		return time.RFC3339
+	case format.Precision >= time.Millisecond:
+		return "2006-01-02T15:04:05.999Z07:00"
+	case format.Precision >= time.Microsecond:
+		return Rfc3339Micro
+	default:
+		return time.RFC3339Nano
+	}
+}
@@ -0,0 +1,29 @@
+package sqlmq
+
+import (
+	"fmt"
+	"time"
+)
+
+func ExampleTimeFormat() {
+	var t = time.Date(2026, 1, 2, 3, 4, 5, 123456789, time.FixedZone("CST", 8*3600))
+	fmt.Println(Timestamps.Format(t))
+	fmt.Println(TimeFormat{UTC: true, Precision: time.Millisecond}.Format(t))
+	fmt.Println(TimeFormat{Precision: time.Nanosecond}.Format(t))
+	fmt.Println(TimeFormat{UTC: true, Precision: time.Second}.Normalize(t))
+	// Output:
+	// 2026-01-02T03:04:05.123456+08:00
+	// 2026-01-01T19:04:05.123Z
+	// 2026-01-02T03:04:05.123456789+08:00
+	// 2026-01-01 19:04:05 +0000 UTC
+}
+
+func ExampleTimeFormat_produce() {
+	var msg = &StdMessage{Queue: "test", RetryAt: time.Unix(0, 1500)}
+	if _, err := msg.prepare(JSONCodec); err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.RetryAt.Equal(time.Unix(0, 1000)), msg.CreatedAt.Nanosecond()%1000)
+	// Output:
+	// true 0
+}
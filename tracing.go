@@ -0,0 +1,19 @@
+package sqlmq
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts a span for handling a message, it can be implemented by OpenTelemetry, for example:
+//   - extract the parent span context from StdMessage.TraceContext by a TextMapPropagator;
+//   - start a span with attributes for the message's queue, id and tried count;
+//   - record the error and retryAfter on the span when it ends.
+type Tracer interface {
+	// StartSpan start a span for handling msg. It returns a context carrying the span, which is
+	// passed to the handler, and a function to end the span, which is called after the transaction
+	// is committed or rollbacked.
+	StartSpan(ctx context.Context, msg Message) (
+		context.Context, func(retryAfter time.Duration, err error),
+	)
+}
@@ -0,0 +1,45 @@
+package sqlmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type testTracer struct{}
+
+type spanKey struct{}
+
+func (testTracer) StartSpan(ctx context.Context, msg Message) (
+	context.Context, func(retryAfter time.Duration, err error),
+) {
+	fmt.Println("start", msg.QueueName(), msg.(*StdMessage).TraceContext["traceparent"])
+	return context.WithValue(ctx, spanKey{}, "span"), func(retryAfter time.Duration, err error) {
+		fmt.Println("end", retryAfter, err)
+	}
+}
+
+func ExampleTracer() {
+	var mq = recreateSqlMQ()
+	mq.Tracer = testTracer{}
+	if err := mq.Register("test", failHandler); err != nil {
+		panic(err)
+	}
+	if err := mq.Produce(nil, &StdMessage{
+		Queue: "test", TraceContext: map[string]string{"traceparent": "00-0af7651916cd43dd-01"},
+	}); err != nil {
+		panic(err)
+	}
+	tx, lease, err := mq.beginTx()
+	if err != nil {
+		panic(err)
+	}
+	msg, err := mq.Table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	mq.handle(context.Background(), lease, mq.Table, tx, msg)
+	// Output:
+	// start test 00-0af7651916cd43dd-01
+	// end 0s error happened
+}
@@ -0,0 +1,33 @@
+//go:build go1.18
+// +build go1.18
+
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Produce a StdMessage with data of type T into a queue. db can be a *sql.DB or *sql.Tx.
+// Unlike SqlMQ.Produce, it doesn't check the queue's handler and doesn't notify the consuming loop.
+func Produce[T any](db DBOrTx, table Table, queue string, data T) error {
+	return table.ProduceMessage(db, &StdMessage{Queue: queue, Data: data})
+}
+
+// RegisterTyped register a handler for a queue, whose message data is json unmarshaled into a T
+// before calling fn. If the data can't be unmarshaled, the message is given up.
+func RegisterTyped[T any](
+	mq *SqlMQ, queue string,
+	fn func(ctx context.Context, tx *sql.Tx, data T) (retryAfter time.Duration, canCommit bool, err error),
+) error {
+	return mq.Register(queue, func(ctx context.Context, tx *sql.Tx, msg Message) (
+		time.Duration, bool, error,
+	) {
+		var data T
+		if err := unmarshalData(msg, &data); err != nil {
+			return -1, true, err
+		}
+		return fn(ctx, tx, data)
+	})
+}
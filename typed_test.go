@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type typedData struct {
+	Name string
+	Age  int
+}
+
+func ExampleRegisterTyped() {
+	var mq = recreateSqlMQ()
+	if err := RegisterTyped(mq, "typed", func(
+		ctx context.Context, tx *sql.Tx, data typedData,
+	) (time.Duration, bool, error) {
+		fmt.Println(data.Name, data.Age)
+		return 0, true, nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := Produce(testDB, mq.Table, "typed", typedData{Name: "sqlmq", Age: 3}); err != nil {
+		panic(err)
+	}
+	msg := &StdMessage{Queue: "typed", Data: []byte(`{"Name":"typed","Age":1}`)}
+	handler, err := mq.handlerOf(mq.Table, msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(handler(context.Background(), nil, msg))
+	msg.Data = []byte(`[]`)
+	retryAfter, _, err := handler(context.Background(), nil, msg)
+	fmt.Println(retryAfter, err != nil)
+	// Output:
+	// typed 1
+	// 0s true <nil>
+	// -1ns true
+}
@@ -0,0 +1,42 @@
+package sqlmq
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// newUUID return a version 7 UUID, whose first 48 bits are the unix milliseconds, so that UUIDs
+// are ordered by the time generated, like a sequence, without the contention of a sequence.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// stdId scans the id column into the Id of a StdMessage, or into its UUID for a uuid column.
+type stdId struct {
+	msg *StdMessage
+}
+
+func (id stdId) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		id.msg.Id = v
+	case []byte:
+		id.msg.UUID = string(v)
+	case string:
+		id.msg.UUID = v
+	default:
+		return fmt.Errorf("sqlmq: unsupported id type %T", src)
+	}
+	return nil
+}
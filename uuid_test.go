@@ -0,0 +1,53 @@
+package sqlmq
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+func Example_newUUID() {
+	a, err := newUUID()
+	if err != nil {
+		panic(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	b, err := newUUID()
+	if err != nil {
+		panic(err)
+	}
+	var uuidV7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	fmt.Println(uuidV7.MatchString(a), uuidV7.MatchString(b), a < b)
+	// Output:
+	// true true true
+}
+
+func ExampleStdTableOptions_UUID() {
+	if _, err := testDB.Exec("DROP TABLE IF EXISTS test_uuid"); err != nil {
+		panic(err)
+	}
+	table := NewStdTableWithOptions(testDB, "test_uuid", 0, StdTableOptions{UUID: true})
+	var msgs = []*StdMessage{{Queue: "test"}, {Queue: "test", UUID: "0188e8a2-0000-7000-8000-000000000001"}}
+	for _, msg := range msgs {
+		if err := table.ProduceMessage(testDB, msg); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(msgs[0].UUID != "", msgs[0].Id, msgs[1].UUID)
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	msg, err := table.EarliestMessage(tx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(msg.(*StdMessage).UUID == msgs[0].UUID)
+	fmt.Println(table.MarkSuccess(tx, msg))
+	// Output:
+	// true 0 0188e8a2-0000-7000-8000-000000000001
+	// true
+	// <nil>
+}
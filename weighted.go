@@ -0,0 +1,95 @@
+package sqlmq
+
+import (
+	"sort"
+	"time"
+)
+
+// weightedQueues return the registered queues not paused in the order to fetch by weighted
+// round-robin, ok is false if QueueWeights is not set or the table is not a QueueTable.
+func (mq *SqlMQ) weightedQueues(table Table) (queues []string, ok bool) {
+	if len(mq.QueueWeights) == 0 {
+		return nil, false
+	}
+	if _, ok := table.(QueueTable); !ok {
+		return nil, false
+	}
+	mq.mutex.RLock()
+	defer mq.mutex.RUnlock()
+	var paused = make(map[string]bool)
+	for _, queue := range mq.pausedQueues() {
+		paused[queue] = true
+	}
+	for _, queue := range mq.handledQueues() {
+		if !paused[queue] {
+			queues = append(queues, queue)
+		}
+	}
+	// the queue with the most credit after earning its weight is the next one.
+	sort.Slice(queues, func(i, j int) bool {
+		a := mq.weightCredits[queues[i]] + mq.queueWeight(queues[i])
+		b := mq.weightCredits[queues[j]] + mq.queueWeight(queues[j])
+		if a != b {
+			return a > b
+		}
+		return queues[i] < queues[j]
+	})
+	return queues, true
+}
+
+// consumeWeighted try the queues one by one, until a due message is handled. Every queue is
+// fetched in its own transaction, so a message which is not due is not locked while others are
+// handled.
+func (mq *SqlMQ) consumeWeighted(table Table, idleWait time.Duration, queues []string) (
+	wait time.Duration, idle bool, handled int, err error,
+) {
+	wait, idle = idleWait, true
+	for _, queue := range queues {
+		queueWait, queueIdle, handled, err := mq.consumeQueue(table, queue, idleWait, 1)
+		if err != nil {
+			return 0, false, 0, err
+		}
+		if queueWait <= 0 {
+			mq.chargeWeight(queues, queue)
+			return queueWait, false, handled, nil
+		}
+		if !queueIdle {
+			idle = false
+		}
+		if queueWait < wait {
+			wait = queueWait
+		}
+	}
+	return
+}
+
+// chargeWeight record a message of queue is handled by smooth weighted round-robin: every active
+// queue earns its weight as credit, and queue pays the total weights.
+func (mq *SqlMQ) chargeWeight(queues []string, queue string) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	var credits = make(map[string]int, len(queues))
+	var total int
+	for _, q := range queues {
+		weight := mq.queueWeight(q)
+		credits[q] = mq.weightCredits[q] + weight
+		total += weight
+	}
+	credits[queue] -= total
+	mq.weightCredits = credits
+}
+
+func (mq *SqlMQ) queueWeight(queue string) int {
+	if weight := mq.QueueWeights[queue]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// fetch the earliest message of the table, or of the queue if it's not empty.
+func earliestMessage(table Table, tx DBOrTx, queue string) (Message, error) {
+	if queue != "" {
+		return table.(QueueTable).EarliestMessageOfQueue(tx, queue)
+	}
+	return table.EarliestMessage(tx)
+}
@@ -0,0 +1,43 @@
+package sqlmq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func ExampleSqlMQ_QueueWeights() {
+	var table = NewMockTable("mock", 0)
+	// no transaction is began, so the DB is never connected in this example.
+	var mq = &SqlMQ{
+		DB: testDB, Table: table, NoHandlerTx: true, QueueWeights: map[string]int{"a": 3},
+	}
+	var handled []string
+	var handler = func(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, bool, error) {
+		handled = append(handled, msg.QueueName())
+		return 0, false, nil
+	}
+	for _, queue := range []string{"a", "b"} {
+		if err := mq.Register(queue, handler); err != nil {
+			panic(err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := mq.Produce(nil, &StdMessage{Queue: queue}); err != nil {
+				panic(err)
+			}
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if _, _, err := mq.ConsumeOnce(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+	// queue a is fetched 3 times as often as b, until it has no due message.
+	fmt.Println(strings.Join(handled, " "))
+	fmt.Println(mq.ConsumeOnce(context.Background()))
+	// Output:
+	// a a b a a b b b
+	// false 1m0s <nil>
+}
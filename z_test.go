@@ -13,6 +13,8 @@ import (
 	"github.com/lovego/logger"
 )
 
+const testDSN = "postgres://develop:@localhost/postgres?sslmode=disable"
+
 var testDB = getDB()
 var testMQ = recreateSqlMQ()
 
@@ -62,7 +64,7 @@ func testHandler(ctx context.Context, tx *sql.Tx, msg Message) (time.Duration, b
 }
 
 func getDB() *sql.DB {
-	db, err := sql.Open("postgres", "postgres://develop:@localhost/postgres?sslmode=disable")
+	db, err := sql.Open("postgres", testDSN)
 	if err != nil {
 		panic(err)
 	}